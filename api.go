@@ -1,10 +1,9 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"io"
 	"net/http"
 	"net/url"
 	"sort"
@@ -17,8 +16,6 @@ import (
 	"github.com/rcrowley/go-tigertonic"
 )
 
-var apiMux *tigertonic.TrieServeMux
-
 type PersonRequest struct {
 	Name       string
 	Department int
@@ -29,15 +26,47 @@ type PersonRequest struct {
 	Phone      string
 }
 
+// person returns the person described by the request.
+func (rq *PersonRequest) person() person {
+	return person{
+		Name:       rq.Name,
+		Role:       rq.Role,
+		Department: rq.Department,
+		Email:      rq.Email,
+		Img:        rq.Img,
+		Phone:      rq.Phone,
+		Info:       rq.Info,
+	}
+}
+
 type PersonResponse struct {
 	ID   int
-	Data json.RawMessage
+	Data person
+}
+
+// PersonChangesResponse lists the changes to persons since a sequence number,
+// oldest first. Latest is the number of the last change, to pass as since to
+// get the next changes. If since is ahead of Latest, as after the database has
+// been restored from a backup, or so far behind that the tombstones of the
+// persons deleted since are no longer kept, Reset is set and all persons are
+// returned, as with since=0.
+type PersonChangesResponse struct {
+	Changes []PersonChange
+	Latest  uint64
+	Reset   bool `json:",omitempty"`
+}
+
+// PersonChange is the last change to a person. Deleted persons have no Data.
+type PersonChange struct {
+	Seq     uint64
+	ID      int
+	Deleted bool    `json:",omitempty"`
+	Data    *person `json:",omitempty"`
 }
 
-type SeveralItemsResponse struct {
-	Count  int
-	TimeMs float64
-	Hits   json.RawMessage
+type StatusResponse struct {
+	Persons int
+	Saver   SaverStatus
 }
 
 func srAsIntSet(sr *index.SearchResults) *intset.BitSet {
@@ -48,207 +77,389 @@ func srAsIntSet(sr *index.SearchResults) *intset.BitSet {
 	return s
 }
 
-func init() {
-	setupAPIRouting()
-}
-
-func setupAPIRouting() {
-	apiMux = tigertonic.NewTrieServeMux()
-	apiMux.Handle(
+func (app *App) setupAPIRouting() {
+	app.apiMux = tigertonic.NewTrieServeMux()
+	api := router{app, app.apiMux, "/api"}
+	api.HandleFunc(
 		"GET",
 		"/person",
-		tigertonic.Marshaled(searchPerson))
-	apiMux.Handle(
+		app.searchPerson)
+	api.Handle(
+		"GET",
+		"/person/changes",
+		tigertonic.Marshaled(app.personChanges))
+	api.HandleFunc(
 		"GET",
 		"/person/{id}",
-		tigertonic.Marshaled(getPerson))
-	apiMux.Handle(
+		withVCard(tigertonic.Marshaled(app.getPerson), app.personVCard))
+	api.Handle(
 		"POST",
 		"/person",
-		tigertonic.Marshaled(createPerson))
-	apiMux.Handle(
+		tigertonic.Marshaled(app.createPerson))
+	api.Handle(
 		"PATCH",
 		"/person/{id}",
-		tigertonic.Marshaled(updatePerson))
-	apiMux.HandleFunc(
+		tigertonic.Marshaled(app.updatePerson))
+	api.HandleFunc(
 		"DELETE",
 		"/person/{id}",
-		deletePerson)
+		app.deletePerson)
+	api.Handle(
+		"POST",
+		"/batch",
+		tigertonic.Marshaled(app.batchPersons))
+	api.HandleFunc(
+		"POST",
+		"/import",
+		app.importPersons)
+	api.HandleFunc(
+		"GET",
+		"/export",
+		app.exportHandler)
+	api.Handle(
+		"GET",
+		"/status",
+		tigertonic.Marshaled(app.getStatus))
+	api.HandleFunc(
+		"GET",
+		"/changes",
+		app.changesHandler)
+	api.HandleFunc(
+		"GET",
+		"/department/{id}/persons",
+		app.departmentPersons)
+	api.HandleFunc(
+		"GET",
+		"/department/{id}",
+		withVCard(http.NotFoundHandler(), app.departmentVCard))
+	api.Handle(
+		"GET",
+		"/tokens",
+		tigertonic.Marshaled(app.listTokens))
+	api.Handle(
+		"POST",
+		"/tokens",
+		tigertonic.Marshaled(app.createToken))
+	api.Handle(
+		"DELETE",
+		"/tokens/{id}",
+		tigertonic.Marshaled(app.revokeToken))
+	api.Handle(
+		"GET",
+		"/webhooks",
+		tigertonic.Marshaled(app.listWebhooks))
+	api.Handle(
+		"POST",
+		"/webhooks",
+		tigertonic.Marshaled(app.createWebhook))
+	api.Handle(
+		"DELETE",
+		"/webhooks/{id}",
+		tigertonic.Marshaled(app.deleteWebhook))
+	api.Handle(
+		"GET",
+		"/webhooks/{id}/deliveries",
+		tigertonic.Marshaled(app.listDeliveries))
+	api.Handle(
+		"POST",
+		"/deliveries/{id}/redeliver",
+		tigertonic.Marshaled(app.redeliver))
+	api.HandleFunc(
+		"GET",
+		"/openapi.json",
+		serveFile(app.assetPath("openapi.json")))
 }
 
-// POST /person
-func createPerson(u *url.URL, h http.Header, rq *PersonRequest) (int, http.Header, *PersonResponse, error) {
-	if rq.Department == 0 || rq.Name == "" || rq.Email == "" {
-		return http.StatusBadRequest, nil, nil, errors.New("required parameters: name, department, email")
-	}
-	if _, ok := mapDepartments[rq.Department]; !ok {
-		return http.StatusBadRequest, nil, nil, errors.New("department doesn't exist")
+// addPerson stores a new person, and indexes it. It is the way persons are
+// created by the API and SCIM.
+func (app *App) addPerson(p person) (int, error) {
+	id, err := app.persons.Create(p)
+	if err != nil {
+		return 0, err
 	}
-	img := rq.Img
-	if img == "" {
-		img = "dummy.png"
+	p.ID = id
+	app.personChanged(id, nil, &p)
+	return id, nil
+}
+
+// replacePerson stores p in place of oldp, and reindexes it.
+func (app *App) replacePerson(id int, oldp, p person) error {
+	if err := app.persons.Put(id, p); err != nil {
+		return err
 	}
-	p := PersonRequest{Name: rq.Name, Department: rq.Department, Email: rq.Email, Img: img}
-	b, err := json.Marshal(p)
+	app.personChanged(id, &oldp, &p)
+	return nil
+}
+
+// removePerson deletes the person id, and unindexes it. It returns the
+// deleted person, or ErrNotFound if there is none, as when a concurrent
+// request deleted it first.
+func (app *App) removePerson(id int) (person, error) {
+	var oldp person
+	err := app.persons.Update(func(tx *TypedTx[person]) error {
+		var err error
+		if oldp, err = tx.Get(id); err != nil {
+			return err
+		}
+		tx.Delete(id)
+		return nil
+	})
 	if err != nil {
-		return http.StatusInternalServerError, nil, nil, errors.New("failed to marshal JSON")
+		return oldp, err
 	}
-	id := persons.Create(&b)
-	person, err := persons.Get(id)
+	app.personChanged(id, &oldp, nil)
+	return oldp, nil
+}
+
+// POST /person
+func (app *App) createPerson(u *url.URL, h http.Header, rq *PersonRequest) (int, http.Header, *PersonResponse, error) {
+	p, code, err := app.createPersonFromRequest(h, rq)
 	if err != nil {
-		log.Println(err)
-		return http.StatusInternalServerError, nil, nil, errors.New("failed to save person to database")
+		return code, nil, nil, err
 	}
 
-	folkSaver.Inc()
-	// index the person:
-	go func() {
-		analyzer.Index(fmt.Sprintf("%v %v", rq.Name, mapDepartments[rq.Department].Name), id)
-	}()
-
 	return http.StatusCreated, http.Header{
 		"Content-Location": {fmt.Sprintf(
-			"%s://%s/api/person/%s",
+			"%s://%s/api/person/%d",
 			u.Scheme,
 			u.Host,
-			id,
+			p.ID,
 		)},
-	}, &PersonResponse{id, *person}, nil
+	}, &PersonResponse{p.ID, p}, nil
+}
+
+// createPersonFromRequest validates rq, and stores it as a new person. It is
+// shared by the REST and GraphQL APIs; on failure, code is the HTTP status of
+// the error.
+func (app *App) createPersonFromRequest(h http.Header, rq *PersonRequest) (p person, code int, err error) {
+	if rq.Department == 0 || rq.Name == "" || rq.Email == "" {
+		return p, http.StatusBadRequest, errors.New("required parameters: name, department, email")
+	}
+	if _, ok := app.mapDepartments[rq.Department]; !ok {
+		return p, http.StatusBadRequest, errors.New("department doesn't exist")
+	}
+	img := rq.Img
+	if img == "" {
+		img = "dummy.png"
+	}
+	p = person{Name: rq.Name, Department: rq.Department, Email: rq.Email, Img: img}
+	id, err := app.addPerson(p)
+	if _, ok := err.(*UniqueError); ok {
+		return p, http.StatusConflict, errors.New("a person with this email already exists")
+	}
+	if err != nil {
+		app.logError(h, "POST /person: %v", err)
+		return p, http.StatusInternalServerError, errors.New("failed to save person to database")
+	}
+	p.ID = id
+	return p, http.StatusCreated, nil
 }
 
 // PATCH /person/{id}
-func updatePerson(u *url.URL, h http.Header, rq *PersonRequest) (int, http.Header, *PersonResponse, error) {
+func (app *App) updatePerson(u *url.URL, h http.Header, rq *PersonRequest) (int, http.Header, *PersonResponse, error) {
 	full := u.Query().Get("full")
 	idStr := u.Query().Get("id")
-	var p, oldp PersonRequest
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
 		return http.StatusBadRequest, nil, nil, errors.New("person ID must be an integer")
 	}
-	oldperson, err := persons.Get(id)
+	p, code, err := app.updatePersonFromRequest(h, id, rq, full == "yes")
 	if err != nil {
-		return http.StatusNotFound, nil, nil, errors.New("person not found")
+		return code, nil, nil, err
+	}
+
+	return http.StatusOK, nil, &PersonResponse{id, p}, nil
+}
+
+// updatePersonFromRequest validates rq, and stores its fields on the person
+// id. Unless full is set, the Info, Role and Phone of the person are kept, as
+// are the fields the request doesn't carry, like Inactive and the LDAP link. It is shared by
+// the REST and GraphQL APIs; on failure, code is the HTTP status of the error.
+func (app *App) updatePersonFromRequest(h http.Header, id int, rq *PersonRequest, full bool) (p person, code int, err error) {
+	oldp, err := app.persons.Get(id)
+	if err == ErrNotFound {
+		return p, http.StatusNotFound, errors.New("person not found")
 	}
-	err = json.Unmarshal(*oldperson, &oldp)
 	if err != nil {
-		log.Println("PATCH unmarshal oldperson: %v ", err)
-		return http.StatusInternalServerError, nil, nil, errors.New("failed to store in database")
+		app.logError(h, "PATCH /person/%d: %v", id, err)
+		return p, http.StatusInternalServerError, errors.New("failed to store in database")
 	}
-	if _, ok := mapDepartments[rq.Department]; !ok {
-		return http.StatusBadRequest, nil, nil, errors.New("department doesn't exist")
+	if _, ok := app.mapDepartments[rq.Department]; !ok {
+		return p, http.StatusBadRequest, errors.New("department doesn't exist")
 	}
-	if full == "yes" {
-		p = *rq
-	} else {
-		p = PersonRequest{
-			Name: rq.Name, Department: rq.Department, Email: rq.Email, Img: rq.Img,
-			Info: oldp.Info, Role: oldp.Role, Phone: oldp.Phone}
+	p = oldp
+	p.Name, p.Department, p.Email, p.Img = rq.Name, rq.Department, rq.Email, rq.Img
+	if full {
+		p.Role, p.Info, p.Phone = rq.Role, rq.Info, rq.Phone
 	}
-	b, err := json.Marshal(p)
-	if err != nil {
-		return http.StatusInternalServerError, nil, nil, errors.New("failed to marshal JSON")
+	p.ID = id
+	err = app.replacePerson(id, oldp, p)
+	if _, ok := err.(*UniqueError); ok {
+		return p, http.StatusConflict, errors.New("a person with this email already exists")
 	}
-	persons.Set(id, &b)
-	newperson, err := persons.Get(id)
 	if err != nil {
-		return http.StatusInternalServerError, nil, nil, errors.New("failed to store in database")
+		app.logError(h, "PATCH /person/%d: %v", id, err)
+		return p, http.StatusInternalServerError, errors.New("failed to store in database")
 	}
-
-	folkSaver.Inc()
-	go func() {
-		// 1. unindex old person:
-		analyzer.UnIndex(fmt.Sprintf("%v %v %v %v",
-			oldp.Name, mapDepartments[oldp.Department].Name, oldp.Role, oldp.Info), id)
-		// 2. index new person:
-		analyzer.Index(fmt.Sprintf("%v %v %v %v",
-			p.Name, mapDepartments[p.Department].Name, p.Role, p.Info), id)
-
-	}()
-
-	return http.StatusOK, nil, &PersonResponse{id, *newperson}, nil
+	return p, http.StatusOK, nil
 }
 
 // GET /person/{id}
-func getPerson(u *url.URL, h http.Header, _ interface{}) (int, http.Header, *PersonResponse, error) {
+func (app *App) getPerson(u *url.URL, h http.Header, _ interface{}) (int, http.Header, *PersonResponse, error) {
 	idStr := u.Query().Get("id")
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
 		return http.StatusBadRequest, nil, nil, errors.New("person ID must be an integer")
 	}
-	person, err := persons.Get(id)
-	if err != nil {
+	p, err := app.persons.Get(id)
+	if err == ErrNotFound {
 		return http.StatusNotFound, nil, nil, errors.New("person not found")
 	}
-	return http.StatusOK, nil, &PersonResponse{id, *person}, nil
+	if err != nil {
+		app.logError(h, "GET /person/%d: %v", id, err)
+		return http.StatusInternalServerError, nil, nil, errors.New("failed to read person from database")
+	}
+	return http.StatusOK, nil, &PersonResponse{id, p}, nil
+}
+
+// GET /person/changes?since=<seq>
+func (app *App) personChanges(u *url.URL, h http.Header, _ interface{}) (int, http.Header, *PersonChangesResponse, error) {
+	var since uint64
+	if s := u.Query().Get("since"); s != "" {
+		var err error
+		if since, err = strconv.ParseUint(s, 10, 64); err != nil {
+			return http.StatusBadRequest, nil, nil, errors.New("since must be a change sequence number")
+		}
+	}
+	changes, latest, err := app.persons.Changes(since)
+	if err != nil {
+		app.logError(h, "GET /person/changes: %v", err)
+		return http.StatusInternalServerError, nil, nil, errors.New("failed to read changes from database")
+	}
+	res := &PersonChangesResponse{Changes: []PersonChange{}, Latest: latest}
+	// the horizon is read after the changes, so that a compaction in between
+	// resets
+	if since > latest || (since > 0 && since < app.persons.DB().Horizon()) {
+		res.Reset = true
+		if changes, latest, err = app.persons.Changes(0); err != nil {
+			app.logError(h, "GET /person/changes: %v", err)
+			return http.StatusInternalServerError, nil, nil, errors.New("failed to read changes from database")
+		}
+		res.Latest = latest
+	}
+	for _, c := range changes {
+		res.Changes = append(res.Changes, PersonChange{c.Seq, c.ID, c.Deleted, c.Value})
+	}
+	return http.StatusOK, nil, res, nil
+}
+
+// GET /status
+func (app *App) getStatus(u *url.URL, h http.Header, _ interface{}) (int, http.Header, *StatusResponse, error) {
+	return http.StatusOK, nil, &StatusResponse{app.persons.Size(), app.saver.Status()}, nil
 }
 
 // DELETE /person/{id}
-func deletePerson(w http.ResponseWriter, r *http.Request) {
+func (app *App) deletePerson(w http.ResponseWriter, r *http.Request) {
 	idStr := strings.TrimPrefix(r.URL.Path, "/person/")
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
 		http.Error(w, "person ID must be an integer", http.StatusBadRequest)
 		return
 	}
-	p, err := persons.Get(id)
-	if err != nil {
-		http.Error(w, "person not found", http.StatusBadRequest)
+	if code, err := app.deletePersonByID(r.Header, id); err != nil {
+		http.Error(w, err.Error(), code)
+		return
 	}
-	var oldp PersonRequest
-	err = json.Unmarshal(*p, &oldp)
-	if err != nil {
-		log.Println("failed to unindex person to-be delted")
-	}
-	go func() {
-		//  unindex deleted person:
-		analyzer.UnIndex(fmt.Sprintf("%v %v %v %v",
-			oldp.Name, mapDepartments[oldp.Department].Name, oldp.Role, oldp.Info), id)
-	}()
-	persons.Del(id)
-	folkSaver.Inc()
 	fmt.Fprint(w, "OK")
 }
 
-// GET /person?q="searchterm" or /person?page=x
-func searchPerson(u *url.URL, h http.Header, _ interface{}) (int, http.Header, *SeveralItemsResponse, error) {
-	// fetch persons for admin listing
-	page := u.Query().Get("page")
-	if page != "" {
-		t0 := time.Now()
-		all := persons.all.All()
-		sort.Sort(sort.Reverse(sort.IntSlice(all)))
-		max := 150
-		if len(all) < 150 {
-			max = len(all)
-		}
-		return http.StatusOK, nil, &SeveralItemsResponse{
-				Count:  len(all[0:max]),
-				TimeMs: float64(time.Now().Sub(t0)) / 1000,
-				Hits:   persons.GetSeveral(all[0:max])},
-			nil
+// deletePersonByID deletes the person id. It is shared by the REST and
+// GraphQL APIs; on failure, code is the HTTP status of the error.
+func (app *App) deletePersonByID(h http.Header, id int) (code int, err error) {
+	_, err = app.removePerson(id)
+	if err == ErrNotFound {
+		return http.StatusNotFound, errors.New("person not found")
+	}
+	if err != nil {
+		app.logError(h, "DELETE /person/%d: %v", id, err)
+		return http.StatusInternalServerError, errors.New("failed to delete from database")
 	}
+	return http.StatusOK, nil
+}
 
-	// search
-	q := u.Query().Get("q")
+// GET /person?q="searchterm" or /person?page=x or /person?email=x
+func (app *App) searchPerson(w http.ResponseWriter, r *http.Request) {
 	t0 := time.Now()
-	var size int
-	var hitsPersons []byte
-	if q == "" {
-		hitsPersons = persons.All()
-		size = persons.Size()
+	var ids []int
+	if page := r.URL.Query().Get("page"); page != "" {
+		// fetch persons for admin listing
+		ids = app.persons.IDs()
+		sort.Sort(sort.Reverse(sort.IntSlice(ids)))
+		if len(ids) > app.cfg.AdminPageSize {
+			ids = ids[0:app.cfg.AdminPageSize]
+		}
+	} else if email := r.URL.Query().Get("email"); email != "" {
+		ids = app.persons.Lookup("email", emailKey(email))
+	} else if q := r.URL.Query().Get("q"); q == "" {
+		ids = app.persons.IDs()
 	} else {
-		// TODO remove single char from query stirng, eg 'Frank Z' => 'Frank'
-		parsedQuery := strings.Split(strings.ToLower(q), " ") // TODO Query Parser
-		query := index.NewQuery().Must(parsedQuery)
-		res := analyzer.Idx.Query(query)
-		hits := srAsIntSet(res)
-		size = hits.Size()
-		hitsPersons = persons.GetSeveral(hits.All())
-	}
-
-	return http.StatusOK, nil, &SeveralItemsResponse{
-			Count:  size,
-			TimeMs: float64(time.Now().Sub(t0)) / 1000,
-			Hits:   hitsPersons},
-		nil
+		ids = app.search(q)
+	}
+	app.writeHits(w, r, t0, ids)
+}
+
+// search returns the IDs of the persons matching the query q, in ascending
+// order.
+func (app *App) search(q string) []int {
+	t0 := time.Now()
+	// TODO remove single char from query stirng, eg 'Frank Z' => 'Frank'
+	parsedQuery := strings.Split(strings.ToLower(q), " ") // TODO Query Parser
+	query := index.NewQuery().Must(parsedQuery)
+	res := app.analyzer.Idx.Query(query)
+	ids := srAsIntSet(res).All()
+	app.metrics.observeSearch(time.Since(t0))
+	return ids
+}
+
+// departmentMembers returns the IDs of the persons in a department and its
+// subdepartments, in ascending order.
+func (app *App) departmentMembers(id int) []int {
+	members := intset.NewBitSet(0)
+	for _, d := range app.mapDepartments {
+		if d.ID != id && d.Parent != id {
+			continue
+		}
+		for _, pid := range app.persons.Lookup("department", strconv.Itoa(d.ID)) {
+			members.Add(pid)
+		}
+	}
+	return members.All()
+}
+
+// GET /department/{id}/persons
+func (app *App) departmentPersons(w http.ResponseWriter, r *http.Request) {
+	t0 := time.Now()
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "department ID must be an integer", http.StatusBadRequest)
+		return
+	}
+	if _, ok := app.mapDepartments[id]; !ok {
+		http.Error(w, "department not found", http.StatusNotFound)
+		return
+	}
+	app.writeHits(w, r, t0, app.departmentMembers(id))
+}
+
+// writeHits streams the persons with the given IDs as a response, in the form:
+// {"Count": 2, "TimeMs": 0.1, "Hits": [{"ID": 1, "Data": {..}},{..}]}
+func (app *App) writeHits(w http.ResponseWriter, r *http.Request, t0 time.Time, ids []int) {
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"Count":%d,"TimeMs":%s,"Hits":`,
+		len(ids), strconv.FormatFloat(float64(time.Since(t0))/float64(time.Millisecond), 'f', -1, 64))
+	if err := app.persons.DB().WriteSeveral(w, ids); err != nil {
+		app.logError(r.Header, "%s %s: %v", r.Method, r.URL.Path, err)
+		return
+	}
+	io.WriteString(w, "}\n")
 }
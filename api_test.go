@@ -2,27 +2,82 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
 	"regexp"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
-	"github.com/knakk/ftx"
 	"github.com/knakk/specs"
 	//"github.com/rcrowley/go-tigertonic"
 )
 
-func TestApiCRUD(t *testing.T) {
-	persons = New(512)
-	mapDepartments = make(map[int]dept)
-	mapDepartments[1] = dept{1, "main", 0}
-	mapDepartments[2] = dept{2, "xyz", 1}
+// writeTestData writes a department database with the given departments, and
+// an empty person database, to dir.
+func writeTestData(t *testing.T, dir string, depts ...dept) {
+	t.Helper()
+	deptsdb := New(len(depts))
+	for _, d := range depts {
+		b, _ := json.Marshal(d)
+		deptsdb.Set(d.ID, &b)
+	}
+	for fname, db := range map[string]Store{"avd.db": deptsdb, "folk.db": New(0)} {
+		if err := db.Dump(filepath.Join(dir, fname)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// newTestApp returns an App with an empty person database and the given
+// departments, in a temporary data directory.
+func newTestApp(t *testing.T, depts ...dept) *App {
+	t.Helper()
+	dir := t.TempDir()
+	writeTestData(t, dir, depts...)
+	cfg := defaultConfig()
+	cfg.DataDir = dir
+	app, err := NewApp(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.logOut = testLogWriter{t}
+	return app
+}
+
+// testToken creates and saves a token with the given scope, and returns its
+// secret.
+func testToken(t *testing.T, app *App, scope string) string {
+	t.Helper()
+	secret := newToken()
+	_, err := app.tokens.Create(apiToken{Name: "test " + scope, Scope: scope, Hash: hashToken(secret), Created: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.saveTokens(nil)
+	return secret
+}
 
-	analyzer = ftx.NewStandardAnalyzer()
+// testLogWriter writes the app log to the test log, which is only shown if
+// the test fails.
+type testLogWriter struct {
+	t *testing.T
+}
+
+func (w testLogWriter) Write(b []byte) (int, error) {
+	w.t.Log(strings.TrimSuffix(string(b), "\n"))
+	return len(b), nil
+}
+
+func TestApiCRUD(t *testing.T) {
+	app := newTestApp(t, dept{1, "main", 0}, dept{2, "xyz", 1})
 	s := specs.New(t)
 
-	testServer := httptest.NewServer(apiMux)
+	testServer := httptest.NewServer(app.apiMux)
 	defer testServer.Close()
 
 	var testsPOST = []struct {
@@ -35,9 +90,10 @@ func TestApiCRUD(t *testing.T) {
 		{"/person", "{\"department\": 1}", 400, "required parameters: name, department, email"},
 		{"/person", "{\"name\": \"Mr. P\", \"email\":\"a@b\", \"department\": 100}", 400, "department doesn't exist"},
 		{"/person", "{\"name\": \"Mr. P\", \"email\":\"a@b\", \"department\": 1}", 201, "\"Name\":\"Mr. P\""},
-		{"/person", "{\"name\": \"a\", \"department\": 1, \"email\":\"a@b\"}", 201, "\"Name\":\"a\""},
-		{"/person", "{\"name\": \"bill\", \"department\": 2, \"email\":\"a@b\"}", 201, "\"Name\":\"bill\""},
-		{"/person", "{\"name\": \"Mr. c\", \"department\": 2, \"email\":\"a@b\"}", 201, "\"Name\":\"Mr. c\""},
+		{"/person", "{\"name\": \"a\", \"department\": 1, \"email\":\"b@b\"}", 201, "\"Name\":\"a\""},
+		{"/person", "{\"name\": \"bill\", \"department\": 2, \"email\":\"c@b\"}", 201, "\"Name\":\"bill\""},
+		{"/person", "{\"name\": \"Mr. c\", \"department\": 2, \"email\":\"d@b\"}", 201, "\"Name\":\"Mr. c\""},
+		{"/person", "{\"name\": \"Mr. d\", \"department\": 2, \"email\":\"A@B\"}", 409, "a person with this email already exists"},
 	}
 
 	for _, tt := range testsPOST {
@@ -59,6 +115,12 @@ func TestApiCRUD(t *testing.T) {
 	}{
 		{"/person/88", 404, "person not found"},
 		{"/person/jabba", 400, "person ID must be an integer"},
+		{"/person?email=B@b", 200, `"Count":1,.*"Name":"a"`},
+		{"/person?email=x@b", 200, `"Count":0,.*"Hits":\[\]`},
+		{"/department/2/persons", 200, `"Count":2,.*"Name":"bill".*"Name":"Mr. c"`},
+		{"/department/1/persons", 200, `"Count":4`},
+		{"/department/9/persons", 404, "department not found"},
+		{"/status", 200, `"Persons":4,"Saver":{"File":".*folk.db","Dirty":4,`},
 	}
 
 	for _, tt := range testsGET {
@@ -79,7 +141,8 @@ func TestApiCRUD(t *testing.T) {
 		respCode  int
 		bodyMatch string
 	}{
-		{"/person/1", `{"Name":"Mr. Q", "Department":2}`, 200, `"Name":"Mr. Q"`},
+		{"/person/1", `{"Name":"Mr. Q", "Department":2, "Email":"a@b"}`, 200, `"Name":"Mr. Q"`},
+		{"/person/1", `{"Name":"Mr. Q", "Department":2, "Email":"b@b"}`, 409, "a person with this email already exists"},
 	}
 
 	for _, tt := range testsPATCH {
@@ -106,3 +169,180 @@ func TestApiCRUD(t *testing.T) {
 	s.ExpectMatches(string(body), "Mr. c")
 	s.ExpectNotMatches(string(body), "bill")
 }
+
+func TestUpdatePersonKeepsFlags(t *testing.T) {
+	app := newTestApp(t, dept{1, "main", 0}, dept{2, "xyz", 1})
+	s := specs.New(t)
+	id, err := app.addPerson(person{Name: "Kari", Department: 1, Email: "kari@example.com",
+		Role: "Leder", Inactive: true, LDAPDN: "uid=kari,ou=people,dc=example,dc=com", GoneFromLDAP: true})
+	s.ExpectNilFatal(err)
+
+	// an edit doesn't reactivate a person deactivated by SCIM, nor unlink a
+	// person from LDAP
+	for _, target := range []string{"/person/1", "/person/1?full=yes"} {
+		req := httptest.NewRequest("PATCH", target, strings.NewReader(`{"Name":"Kari N","Department":2,"Email":"kari@example.com","Role":"Sjef"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Accept", "application/json")
+		w := httptest.NewRecorder()
+		app.apiMux.ServeHTTP(w, req)
+		s.Expect(http.StatusOK, w.Code)
+		p, err := app.persons.Get(id)
+		s.ExpectNilFatal(err)
+		s.Expect("Kari N", p.Name)
+		s.Expect(2, p.Department)
+		s.Expect(true, p.Inactive)
+		s.Expect("uid=kari,ou=people,dc=example,dc=com", p.LDAPDN)
+		s.Expect(true, p.GoneFromLDAP)
+	}
+	app.bg.Wait()
+}
+
+func TestDeletePersonConcurrently(t *testing.T) {
+	app := newTestApp(t, dept{1, "main", 0})
+	s := specs.New(t)
+	_, err := app.webhooks.Create(webhook{URL: "http://example.com/hook", Events: webhookEvents, Secret: "hemmelig"})
+	s.ExpectNilFatal(err)
+	id, err := app.addPerson(person{Name: "Kari", Department: 1, Email: "kari@example.com"})
+	s.ExpectNilFatal(err)
+
+	// only one of concurrent deletes deletes the person, and publishes the
+	// change
+	codes := make(chan int, 10)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(codes); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			code, _ := app.deletePersonByID(nil, id)
+			codes <- code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+	n := map[int]int{}
+	for code := range codes {
+		n[code]++
+	}
+	s.Expect(map[int]int{http.StatusOK: 1, http.StatusNotFound: 9}, n)
+	// one delivery for the creation, and one for the deletion
+	s.Expect(2, len(app.deliveries.Lookup("webhook", "1")))
+	app.bg.Wait()
+}
+
+func TestPersonChanges(t *testing.T) {
+	app := newTestApp(t, dept{1, "main", 0})
+	s := specs.New(t)
+	testServer := httptest.NewServer(app.apiMux)
+	defer testServer.Close()
+
+	changes := func(since string) (int, PersonChangesResponse) {
+		resp, err := http.Get(testServer.URL + "/person/changes?since=" + since)
+		s.ExpectNilFatal(err)
+		defer resp.Body.Close()
+		var res PersonChangesResponse
+		if resp.StatusCode == http.StatusOK {
+			s.ExpectNilFatal(json.NewDecoder(resp.Body).Decode(&res))
+		}
+		return resp.StatusCode, res
+	}
+	seqs := func(res PersonChangesResponse) []uint64 {
+		var seqs []uint64
+		for _, c := range res.Changes {
+			seqs = append(seqs, c.Seq)
+		}
+		return seqs
+	}
+
+	code, res := changes("")
+	s.Expect(http.StatusOK, code)
+	s.Expect(uint64(0), res.Latest)
+	s.Expect(0, len(res.Changes))
+	code, _ = changes("x")
+	s.Expect(http.StatusBadRequest, code)
+
+	for _, email := range []string{"a@b", "b@b", "c@b"} {
+		id, err := app.addPerson(person{Name: email, Department: 1, Email: email})
+		s.ExpectNilFatal(err)
+		s.Expect(true, id > 0)
+	}
+	p, _ := app.persons.Get(1)
+	oldp := p
+	p.Name = "Mr. A"
+	s.ExpectNilFatal(app.replacePerson(1, oldp, p)) // 4
+	_, err := app.removePerson(2)                   // 5
+	s.ExpectNilFatal(err)
+
+	code, res = changes("0")
+	s.Expect(http.StatusOK, code)
+	s.Expect(uint64(5), res.Latest)
+	s.Expect([]uint64{3, 4, 5}, seqs(res))
+	c := res.Changes[1]
+	s.Expect(1, c.ID)
+	s.Expect(false, c.Deleted)
+	s.Expect("Mr. A", c.Data.Name)
+	c = res.Changes[2]
+	s.Expect(2, c.ID)
+	s.Expect(true, c.Deleted)
+	s.Expect(true, c.Data == nil)
+
+	code, res = changes("4")
+	s.Expect(uint64(5), res.Latest)
+	s.Expect([]uint64{5}, seqs(res))
+	s.Expect(false, res.Reset)
+	code, res = changes("5")
+	s.Expect(0, len(res.Changes))
+
+	// a consumer ahead of the database starts over
+	code, res = changes("9")
+	s.Expect(http.StatusOK, code)
+	s.Expect(true, res.Reset)
+	s.Expect(uint64(5), res.Latest)
+	s.Expect([]uint64{3, 4, 5}, seqs(res))
+
+	// tombstones are removed after TombstoneRetention changes, on the first
+	// write and then every TombstoneRetention writes, and consumers which
+	// may have missed them start over
+	app.cfg.TombstoneRetention = 2
+	app.writes = 0
+	addPerson := func(email string) {
+		_, err := app.addPerson(person{Name: email, Department: 1, Email: email})
+		s.ExpectNilFatal(err)
+		app.bg.Wait()
+	}
+	addPerson("d@b") // 6, horizon 4
+	_, res = changes("3")
+	s.Expect(true, res.Reset)
+	s.Expect([]uint64{3, 4, 5, 6}, seqs(res))
+	_, res = changes("4")
+	s.Expect(false, res.Reset)
+	s.Expect([]uint64{5, 6}, seqs(res))
+	addPerson("e@b") // 7
+	addPerson("f@b") // 8, horizon 6
+	_, res = changes("0")
+	s.Expect(false, res.Reset)
+	s.Expect([]uint64{3, 4, 6, 7, 8}, seqs(res))
+	_, res = changes("5")
+	s.Expect(true, res.Reset)
+	s.Expect([]uint64{3, 4, 6, 7, 8}, seqs(res))
+	_, res = changes("6")
+	s.Expect(false, res.Reset)
+	s.Expect([]uint64{7, 8}, seqs(res))
+
+	// with a retention of 1, every write removes the tombstones before it
+	app.cfg.TombstoneRetention = 1
+	app.writes = 0
+	_, err = app.removePerson(3) // 9, horizon 8
+	s.ExpectNilFatal(err)
+	app.bg.Wait()
+	_, res = changes("7")
+	s.Expect(true, res.Reset)
+	addPerson("g@b") // 10, horizon 9
+	_, res = changes("0")
+	s.Expect([]uint64{4, 6, 7, 8, 10}, seqs(res))
+	_, res = changes("8")
+	s.Expect(true, res.Reset)
+	_, res = changes("9")
+	s.Expect(false, res.Reset)
+	s.Expect([]uint64{10}, seqs(res))
+	app.bg.Wait()
+}
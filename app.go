@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"html/template"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/graphql-go/graphql"
+	"github.com/knakk/ftx"
+	"github.com/rcrowley/go-tigertonic"
+)
+
+// App is an instance of the folk application, with its databases, search
+// index and HTTP routing. Several Apps can run in the same process.
+type App struct {
+	cfg            Config
+	templates      *template.Template
+	mux            *tigertonic.TrieServeMux
+	apiMux         *tigertonic.TrieServeMux
+	scimMux        *tigertonic.TrieServeMux
+	graphql        graphql.Schema
+	persons        *TypedStore[person]
+	departments    []depts
+	mapDepartments map[int]dept
+	sessions       *sessions.CookieStore
+	saver          *saver
+	tokens         *TypedStore[apiToken]
+	tokenSaver     *saver
+	webhooks       *TypedStore[webhook]
+	webhookSaver   *saver
+	deliveries     *TypedStore[delivery]
+	deliverySaver  *saver
+	dispatcher     *webhookDispatcher
+	changes        *changeFeed
+	analyzer       *ftx.Analyzer
+	indexed        int64          // number of persons in the search index
+	writes         int64          // to the persons, see compactTombstones
+	bg             sync.WaitGroup // background indexing
+	loadErrs       []error        // databases which failed to load
+	metrics        *metrics
+	handler        http.Handler // mux, wrapped with the access log
+	authLimits     *authLimits
+	oidc           *oidcProvider // nil if OIDC login isn't configured
+	oidcRoles      oidcRoles
+	writeLimit     *limiter     // nil if API writes aren't limited
+	trustedProxies []*net.IPNet // see Config.TrustedProxies
+
+	logMu  sync.Mutex
+	logOut io.Writer // access and error log, as JSON lines
+}
+
+// NewApp validates cfg, loads the templates and databases it describes, and
+// indexes the persons for search.
+func NewApp(cfg Config) (*App, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	app := &App{
+		cfg:            cfg,
+		mapDepartments: make(map[int]dept),
+		metrics:        newMetrics(),
+		logOut:         os.Stderr,
+		authLimits:     newAuthLimits(cfg),
+		analyzer:       ftx.NewNGramAnalyzer(1, 20),
+		sessions: sessions.NewCookieStore(
+			securecookie.GenerateRandomKey(32), securecookie.GenerateRandomKey(32)),
+	}
+	if cfg.OIDCIssuer != "" {
+		app.oidc = newOIDCProvider(cfg)
+		app.oidcRoles = newOIDCRoles(cfg)
+	}
+	if cfg.APIWriteRate > 0 {
+		app.writeLimit = newLimiter(float64(cfg.APIWriteRate), cfg.APIWriteBurst)
+	}
+	app.trustedProxies, _ = parseTrustedProxies(cfg.TrustedProxies) // validated
+	var err error
+	app.templates, err = template.ParseFiles(
+		app.assetPath("html/folk.html"),
+		app.assetPath("html/admin.html"),
+		app.assetPath("html/login.html"))
+	if err != nil {
+		return nil, err
+	}
+	if err := app.loadData(); err != nil {
+		return nil, err
+	}
+	if app.graphql, err = app.newGraphQLSchema(); err != nil {
+		return nil, err
+	}
+	app.setupRouting()
+	app.handler = app.logRequests(app.mux)
+	return app, nil
+}
+
+// dataPath returns the path of a file in the data directory.
+func (app *App) dataPath(name string) string {
+	return filepath.Join(app.cfg.DataDir, filepath.FromSlash(name))
+}
+
+// assetPath returns the path of a file in the assets directory.
+func (app *App) assetPath(name string) string {
+	return filepath.Join(app.cfg.AssetsDir, filepath.FromSlash(name))
+}
+
+// ServeHTTP serves the web interface and the API.
+func (app *App) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	app.handler.ServeHTTP(w, r)
+}
+
+// background runs fn in a goroutine, which Close waits for.
+func (app *App) background(fn func()) {
+	app.bg.Add(1)
+	go func() {
+		defer app.bg.Done()
+		fn()
+	}()
+}
+
+// Close waits for background indexing to finish, saves the person, token,
+// webhook and delivery databases if they have unsaved edits, and closes the
+// person database.
+func (app *App) Close() error {
+	app.bg.Wait()
+	err := app.saver.Flush()
+	for _, s := range []*saver{app.tokenSaver, app.webhookSaver, app.deliverySaver} {
+		if serr := s.Flush(); err == nil {
+			err = serr
+		}
+	}
+	if c, ok := app.persons.DB().(io.Closer); ok {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// serve serves the app on l until the process receives SIGINT or SIGTERM. It
+// then stops accepting connections, waits up to ShutdownTimeout for in-flight
+// requests to finish, and closes the app. Scheduled LDAP syncs and webhook
+// deliveries run while serving.
+func (app *App) serve(l net.Listener) error {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	server := tigertonic.NewServer(l.Addr().String(), app)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- server.Serve(l)
+	}()
+	stopSync := app.scheduleLDAPSync()
+	stopWebhooks := app.startWebhooks()
+	select {
+	case err := <-errc:
+		stopSync()
+		stopWebhooks()
+		app.Close()
+		return err
+	case sig := <-sigs:
+		log.Printf("Received %v, shutting down", sig)
+	}
+
+	// end the change streams, which would otherwise keep the server waiting
+	app.changes.close()
+	ctx, cancel := context.WithTimeout(context.Background(),
+		time.Duration(app.cfg.ShutdownTimeout)*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		// Save what we have, even if some requests didn't finish.
+		log.Printf("Failed to drain requests: %v", err)
+	}
+	stopSync()
+	stopWebhooks()
+	if err := app.Close(); err != nil {
+		return err
+	}
+	log.Println("Shut down")
+	return nil
+}
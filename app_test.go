@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/knakk/specs"
+)
+
+func TestNewApp(t *testing.T) {
+	s := specs.New(t)
+	dir := t.TempDir()
+	db := New(1)
+	b := []byte(`{"Name":"Åse","Department":1,"Email":"ase@example.com"}`)
+	db.Set(7, &b)
+	s.ExpectNilFatal(db.Dump(filepath.Join(dir, "folk.db")))
+
+	cfg := defaultConfig()
+	cfg.DataDir = dir
+	app, err := NewApp(cfg)
+	s.ExpectNilFatal(err)
+	s.Expect(1, app.persons.Size())
+	s.Expect([]int{7}, app.persons.Lookup("email", "ase@example.com"))
+
+	testServer := httptest.NewServer(app)
+	defer testServer.Close()
+	for _, url := range []string{"/", "/api/person?q=åse"} {
+		resp, err := http.Get(testServer.URL + url)
+		s.ExpectNilFatal(err)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		s.Expect(200, resp.StatusCode)
+		if url != "/" {
+			s.ExpectMatches(string(body), `"Count":1,`)
+		}
+	}
+
+	// no templates
+	cfg.AssetsDir = t.TempDir()
+	_, err = NewApp(cfg)
+	s.ExpectNot(nil, err)
+}
+
+func TestAppsAreIsolated(t *testing.T) {
+	s := specs.New(t)
+	a := newTestApp(t, dept{1, "main", 0})
+	b := newTestApp(t, dept{1, "other", 0})
+
+	_, err := a.persons.Create(person{Name: "a", Department: 1, Email: "a@b"})
+	s.ExpectNilFatal(err)
+	s.Expect(1, a.persons.Size())
+	s.Expect(0, b.persons.Size())
+	s.Expect("other", b.mapDepartments[1].Name)
+	s.ExpectNot(a.dataPath("folk.db"), b.dataPath("folk.db"))
+}
+
+// TestServeHelper serves an app in a subprocess started by TestServeShutdown.
+func TestServeHelper(t *testing.T) {
+	dir := os.Getenv("FOLK_TEST_SERVE_DIR")
+	if dir == "" {
+		t.Skip("only run as a subprocess")
+	}
+	cfg := defaultConfig()
+	cfg.DataDir = dir
+	app, err := NewApp(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Println(l.Addr())
+	if err := app.serve(l); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServeShutdown(t *testing.T) {
+	s := specs.New(t)
+	dir := t.TempDir()
+	writeTestData(t, dir, dept{1, "main", 0})
+	cfg := defaultConfig()
+	cfg.DataDir = dir
+	app, err := NewApp(cfg)
+	s.ExpectNilFatal(err)
+	auth := "Bearer " + testToken(t, app, scopePersonsWrite)
+	s.ExpectNilFatal(app.Close())
+	post := func(url, contentType string, body io.Reader) (*http.Response, error) {
+		req, err := http.NewRequest("POST", url, body)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("Authorization", auth)
+		return http.DefaultClient.Do(req)
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestServeHelper$")
+	cmd.Env = append(os.Environ(), "FOLK_TEST_SERVE_DIR="+dir)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	s.ExpectNilFatal(err)
+	s.ExpectNilFatal(cmd.Start())
+	defer cmd.Process.Kill()
+	addr, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatalf("failed to read address: %v\n%s", err, stderr.String())
+	}
+	addr = strings.TrimSpace(addr)
+	url := "http://" + addr
+
+	// a single edit, which the saver doesn't save by itself
+	resp, err := post(url+"/api/person", "application/json",
+		strings.NewReader(`{"Name":"a","Department":1,"Email":"a@b"}`))
+	s.ExpectNilFatal(err)
+	resp.Body.Close()
+	s.Expect(201, resp.StatusCode)
+
+	// a request in flight during shutdown, whose body is sent after SIGTERM
+	body, bodyw := io.Pipe()
+	respc := make(chan *http.Response)
+	go func() {
+		resp, err := post(url+"/api/import", "text/csv", body)
+		if err != nil {
+			t.Error(err)
+		}
+		respc <- resp
+	}()
+	time.Sleep(500 * time.Millisecond) // the request headers are sent
+	s.ExpectNilFatal(cmd.Process.Signal(syscall.SIGTERM))
+
+	// new connections are refused
+	for i := 0; ; i++ {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			break
+		}
+		c.Close()
+		if i == 100 {
+			t.Fatal("server still accepts connections after SIGTERM")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	io.WriteString(bodyw, "name,email,department\nb,b@b,1\n")
+	bodyw.Close()
+	resp = <-respc
+	if resp != nil {
+		resp.Body.Close()
+		s.Expect(200, resp.StatusCode)
+	}
+
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("exit: %v\n%s", err, stderr.String())
+	}
+	db, err := NewFromFile(filepath.Join(dir, "folk.db"))
+	s.ExpectNilFatal(err)
+	s.Expect(2, db.Size())
+}
+
+func TestUpload(t *testing.T) {
+	s := specs.New(t)
+	app := newTestApp(t, dept{1, "IT", 0})
+	s.ExpectNilFatal(os.MkdirAll(app.dataPath("img"), 0755))
+	auth := "Bearer " + testToken(t, app, scopePersonsWrite)
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	html := []byte("<html><script>alert(document.cookie)</script></html>")
+
+	upload := func(name string, data []byte, auth string) int {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		fw, err := mw.CreateFormFile("photo1", name)
+		s.ExpectNilFatal(err)
+		fw.Write(data)
+		s.ExpectNilFatal(mw.Close())
+		req := httptest.NewRequest("POST", "/upload", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// only images are stored, as the files are served from the same origin
+	var tests = []struct {
+		name   string
+		data   []byte
+		want   int
+		stored bool
+	}{
+		{"kari.png", png, http.StatusOK, true},
+		{"../ola.PNG", png, http.StatusOK, true},
+		{"evil.html", html, http.StatusBadRequest, false},
+		{"evil.png", html, http.StatusBadRequest, false},
+		{"evil.html", png, http.StatusBadRequest, false},
+		{"evil.jpg", png, http.StatusBadRequest, false},
+	}
+	for _, tt := range tests {
+		if got := upload(tt.name, tt.data, auth); got != tt.want {
+			t.Errorf("upload %s => %d; want %d", tt.name, got, tt.want)
+		}
+		_, err := os.Stat(filepath.Join(app.dataPath("img"), filepath.Base(tt.name)))
+		if stored := err == nil; stored != tt.stored {
+			t.Errorf("upload %s: stored = %v; want %v", tt.name, stored, tt.stored)
+		}
+	}
+
+	// uploads need a login or a valid token
+	s.Expect(http.StatusUnauthorized, upload("per.png", png, ""))
+	s.Expect(http.StatusUnauthorized, upload("per.png", png, "Bearer x"))
+	_, err := os.Stat(filepath.Join(app.dataPath("img"), "per.png"))
+	s.Expect(true, os.IsNotExist(err))
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+// BatchOperation is a single write in a batch. Op is one of "create",
+// "update" or "delete". ID is the person to update or delete. On update, only
+// the non-empty fields of Person are changed.
+type BatchOperation struct {
+	Op     string
+	ID     int
+	Person PersonRequest
+}
+
+type BatchRequest struct {
+	Operations []BatchOperation
+}
+
+// BatchResult is the outcome of a BatchOperation. Data is left out for
+// deleted persons.
+type BatchResult struct {
+	Op   string
+	ID   int
+	Data *person `json:",omitempty"`
+}
+
+type BatchResponse struct {
+	Results []BatchResult
+}
+
+// batchError fails a batch, naming the operation which failed.
+type batchError struct {
+	op   int // index in BatchRequest.Operations
+	code int
+	msg  string
+}
+
+func (e *batchError) Error() string {
+	return fmt.Sprintf("operation %d: %s", e.op, e.msg)
+}
+
+// batchChanges tracks the persons changed by a batch, so that they can be
+// reindexed once it is committed.
+type batchChanges struct {
+	ids    []int
+	before map[int]*person // nil if the person didn't exist
+	after  map[int]*person // nil if the person was deleted
+}
+
+func newBatchChanges() *batchChanges {
+	return &batchChanges{before: make(map[int]*person), after: make(map[int]*person)}
+}
+
+func (c *batchChanges) record(id int, before, after *person) {
+	if _, ok := c.before[id]; !ok {
+		c.ids = append(c.ids, id)
+		c.before[id] = before
+	}
+	c.after[id] = after
+}
+
+// personsChanged is called after every committed write to the persons. It
+// schedules a save of the person database, reindexes the changed persons,
+// compacts the tombstones when due, and publishes the changes on the change
+// feed and to the webhooks.
+func (app *App) personsChanged(c *batchChanges) {
+	app.saver.Inc()
+	app.background(func() { app.reindexBatch(c) })
+	app.compactTombstones()
+	evs := changeEvents(c, time.Now().UTC())
+	app.changes.publish(evs)
+	app.notifyWebhooks(evs)
+}
+
+// compactTombstones removes the tombstones of the persons deleted more than
+// TombstoneRetention changes ago. To not go through the changes on every
+// write, it does so on the first write after starting, and then once every
+// TombstoneRetention writes.
+func (app *App) compactTombstones() {
+	n := app.cfg.TombstoneRetention
+	w := atomic.AddInt64(&app.writes, 1)
+	if n == 0 || (w-1)%int64(n) != 0 {
+		return
+	}
+	app.background(func() {
+		if _, err := app.persons.DB().Compact(uint64(n)); err != nil {
+			log.Printf("Failed to compact tombstones: %v", err)
+		}
+	})
+}
+
+// personChanged is personsChanged for a single person, with before nil for
+// a created person, and after nil for a deleted one.
+func (app *App) personChanged(id int, before, after *person) {
+	c := newBatchChanges()
+	c.record(id, before, after)
+	app.personsChanged(c)
+}
+
+// reindexBatch updates the search index with the changes made by a batch.
+func (app *App) reindexBatch(c *batchChanges) {
+	for _, id := range c.ids {
+		if p := c.before[id]; p != nil {
+			app.unindex(id, *p)
+		}
+		if p := c.after[id]; p != nil {
+			app.index(id, *p)
+		}
+	}
+}
+
+// merge sets the non-empty fields of the request on p.
+func (rq *PersonRequest) merge(p *person) {
+	set := func(dst *string, src string) {
+		if src != "" {
+			*dst = src
+		}
+	}
+	set(&p.Name, rq.Name)
+	set(&p.Email, rq.Email)
+	set(&p.Img, rq.Img)
+	set(&p.Role, rq.Role)
+	set(&p.Info, rq.Info)
+	set(&p.Phone, rq.Phone)
+	if rq.Department != 0 {
+		p.Department = rq.Department
+	}
+}
+
+// applyBatchOp applies a single operation of a batch in tx.
+func (app *App) applyBatchOp(tx *TypedTx[person], op BatchOperation, c *batchChanges) (BatchResult, error) {
+	rq := op.Person
+	switch op.Op {
+	case "create":
+		if rq.Department == 0 || rq.Name == "" || rq.Email == "" {
+			return BatchResult{}, &batchError{code: http.StatusBadRequest, msg: "required parameters: name, department, email"}
+		}
+		if _, ok := app.mapDepartments[rq.Department]; !ok {
+			return BatchResult{}, &batchError{code: http.StatusBadRequest, msg: "department doesn't exist"}
+		}
+		p := rq.person()
+		if p.Img == "" {
+			p.Img = "dummy.png"
+		}
+		id, err := tx.Create(p)
+		if err != nil {
+			return BatchResult{}, err
+		}
+		p.ID = id
+		c.record(id, nil, &p)
+		return BatchResult{op.Op, id, &p}, nil
+	case "update":
+		oldp, err := tx.Get(op.ID)
+		if err == ErrNotFound {
+			return BatchResult{}, &batchError{code: http.StatusNotFound, msg: "person not found"}
+		}
+		if err != nil {
+			return BatchResult{}, err
+		}
+		if rq.Department != 0 {
+			if _, ok := app.mapDepartments[rq.Department]; !ok {
+				return BatchResult{}, &batchError{code: http.StatusBadRequest, msg: "department doesn't exist"}
+			}
+		}
+		p := oldp
+		rq.merge(&p)
+		if err := tx.Put(op.ID, p); err != nil {
+			return BatchResult{}, err
+		}
+		c.record(op.ID, &oldp, &p)
+		return BatchResult{op.Op, op.ID, &p}, nil
+	case "delete":
+		oldp, err := tx.Get(op.ID)
+		if err == ErrNotFound {
+			return BatchResult{}, &batchError{code: http.StatusNotFound, msg: "person not found"}
+		}
+		if err != nil {
+			return BatchResult{}, err
+		}
+		tx.Delete(op.ID)
+		c.record(op.ID, &oldp, nil)
+		return BatchResult{op.Op, op.ID, nil}, nil
+	}
+	return BatchResult{}, &batchError{code: http.StatusBadRequest, msg: `op must be one of "create", "update", "delete"`}
+}
+
+// POST /batch
+//
+// Applies a list of create, update and delete operations atomically: either
+// all of them are applied, or none are.
+func (app *App) batchPersons(u *url.URL, h http.Header, rq *BatchRequest) (int, http.Header, *BatchResponse, error) {
+	if len(rq.Operations) == 0 {
+		return http.StatusBadRequest, nil, nil, errors.New("no operations")
+	}
+	res := &BatchResponse{Results: make([]BatchResult, len(rq.Operations))}
+	c := newBatchChanges()
+	err := app.persons.Update(func(tx *TypedTx[person]) error {
+		for i, op := range rq.Operations {
+			r, err := app.applyBatchOp(tx, op, c)
+			switch err := err.(type) {
+			case nil:
+				res.Results[i] = r
+				continue
+			case *batchError:
+				err.op = i
+				return err
+			case *UniqueError:
+				return &batchError{i, http.StatusConflict, "a person with this email already exists"}
+			}
+			return fmt.Errorf("operation %d: %v", i, err)
+		}
+		return nil
+	})
+	if err, ok := err.(*batchError); ok {
+		return err.code, nil, nil, err
+	}
+	if err != nil {
+		app.logError(h, "POST /batch: %v", err)
+		return http.StatusInternalServerError, nil, nil, errors.New("failed to store in database")
+	}
+
+	app.personsChanged(c)
+
+	return http.StatusOK, nil, res, nil
+}
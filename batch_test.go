@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/knakk/specs"
+)
+
+func TestBatchAPI(t *testing.T) {
+	app := newTestApp(t, dept{1, "main", 0}, dept{2, "xyz", 1})
+	for _, p := range []person{
+		{Name: "a", Department: 1, Email: "a@b", Role: "boss"},
+		{Name: "b", Department: 1, Email: "b@b"},
+		{Name: "c", Department: 1, Email: "c@b"},
+	} {
+		app.persons.Create(p)
+	}
+	s := specs.New(t)
+	testServer := httptest.NewServer(app.apiMux)
+	defer testServer.Close()
+
+	var tests = []struct {
+		body      string
+		respCode  int
+		bodyMatch string
+	}{
+		{`{"Operations":[]}`, 400, "no operations"},
+		{`{"Operations":[{"Op":"update","ID":1,"Person":{"Department":2}},{"Op":"rename","ID":2}]}`, 400, `operation 1: op must be one of`},
+		{`{"Operations":[{"Op":"update","ID":1,"Person":{"Department":2}},{"Op":"delete","ID":9}]}`, 404, `operation 1: person not found`},
+		{`{"Operations":[{"Op":"update","ID":1,"Person":{"Department":9}}]}`, 400, `operation 0: department doesn't exist`},
+		{`{"Operations":[{"Op":"update","ID":1,"Person":{"Email":"x@b"}},{"Op":"create","Person":{"Name":"d","Department":1,"Email":"X@B"}}]}`, 409, `operation 1: a person with this email already exists`},
+		{`{"Operations":[{"Op":"create","Person":{"Name":"d"}}]}`, 400, `operation 0: required parameters`},
+	}
+	for _, tt := range tests {
+		resp, err := http.Post(testServer.URL+"/batch", "application/json", bytes.NewBufferString(tt.body))
+		s.ExpectNilFatal(err)
+		body, err := ioutil.ReadAll(resp.Body)
+		s.ExpectNilFatal(err)
+		resp.Body.Close()
+		s.Expect(tt.respCode, resp.StatusCode)
+		s.ExpectMatches(string(body), tt.bodyMatch)
+	}
+
+	// none of the failed batches were applied
+	s.Expect([]int{1, 2, 3}, app.persons.IDs())
+	p, _ := app.persons.Get(1)
+	s.Expect(person{ID: 1, Name: "a", Department: 1, Email: "a@b", Role: "boss"}, p)
+	s.Expect(0, app.saver.count)
+
+	body := `{"Operations":[
+		{"Op":"update","ID":1,"Person":{"Department":2}},
+		{"Op":"update","ID":2,"Person":{"Department":2,"Email":"a@b2"}},
+		{"Op":"delete","ID":3},
+		{"Op":"create","Person":{"Name":"d","Department":2,"Email":"c@b"}}]}`
+	resp, err := http.Post(testServer.URL+"/batch", "application/json", bytes.NewBufferString(body))
+	s.ExpectNilFatal(err)
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	s.Expect(200, resp.StatusCode)
+	s.ExpectMatches(string(b), `"Op":"delete","ID":3}`)
+	s.ExpectMatches(string(b), `"Op":"create","ID":4,"Data":{"Name":"d"`)
+	s.Expect(1, app.saver.count)
+	s.Expect([]int{1, 2, 4}, app.departmentMembers(2))
+	p, _ = app.persons.Get(1)
+	s.Expect("boss", p.Role)
+	s.Expect([]int{2}, app.persons.Lookup("email", "a@b2"))
+}
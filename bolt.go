@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltBucket = []byte("docs")
+	// boltChanges maps the sequence number of the last change to each
+	// document to its ID, followed by a 1 byte if it was deleted. Its bucket
+	// sequence is the number of the last change.
+	boltChanges = []byte("changes")
+	// boltSeqs maps the ID of each changed document to the sequence number of
+	// its last change, so the previous one can be removed from boltChanges.
+	// ID 0, which no document has, maps to the horizon, see Compact.
+	boltSeqs = []byte("seqs")
+)
+
+// BoltDB is a Store backed by an embedded bbolt database file. Unlike DB,
+// every write is persisted immediately. Secondary indexes are kept in memory,
+// and built from the stored documents when they are declared.
+type BoltDB struct {
+	db      *bolt.DB
+	mu      sync.RWMutex // guards indexes, and serialises writes with index updates
+	indexes []*dbIndex
+}
+
+// OpenBolt opens, or creates, a bbolt database file.
+func OpenBolt(fname string) (*BoltDB, error) {
+	db, err := bolt.Open(fname, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltBucket, boltChanges, boltSeqs} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		// number the documents stored before changes were numbered
+		ops := newBoltOps(nil, tx)
+		if ops.lastSeq() > 0 {
+			return nil
+		}
+		return ops.bk.ForEach(func(k, _ []byte) error {
+			return ops.logChange(btoi(k), false)
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltDB{db: db}, nil
+}
+
+// Close closes the database file.
+func (b *BoltDB) Close() error {
+	return b.db.Close()
+}
+
+// itob encodes an ID as a big endian key, so that keys sort by ID.
+func itob(id int) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, uint64(id))
+	return k
+}
+
+func btoi(k []byte) int {
+	return int(binary.BigEndian.Uint64(k))
+}
+
+// Size returns the number of documents.
+func (b *BoltDB) Size() int {
+	var n int
+	b.db.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket(boltBucket).Stats().KeyN
+		return nil
+	})
+	return n
+}
+
+// IDs returns the IDs of all documents, in ascending order.
+func (b *BoltDB) IDs() []int {
+	var ids []int
+	b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).ForEach(func(k, _ []byte) error {
+			ids = append(ids, btoi(k))
+			return nil
+		})
+	})
+	return ids
+}
+
+// update runs fn in a bolt write transaction, with the write lock held. If
+// the transaction fails to commit after fn has updated the in-memory indexes,
+// they are rebuilt from the database.
+func (b *BoltDB) update(fn func(ops *boltOps) error) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var fnErr error
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		fnErr = fn(newBoltOps(b, tx))
+		return fnErr
+	})
+	if err != nil && fnErr == nil {
+		b.rebuildIndexes()
+	}
+	return err
+}
+
+// rebuildIndexes rebuilds all secondary indexes from the stored documents.
+// It must be called with the write lock held.
+func (b *BoltDB) rebuildIndexes() {
+	for i, idx := range b.indexes {
+		b.indexes[i] = newIndex(idx.name, idx.unique, idx.fn)
+		b.buildIndex(b.indexes[i])
+	}
+}
+
+// buildIndex adds all stored documents to a new index.
+func (b *BoltDB) buildIndex(idx *dbIndex) error {
+	var err error
+	b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).ForEach(func(k, v []byte) error {
+			if berr := idx.build(btoi(k), v); err == nil {
+				err = berr
+			}
+			return nil
+		})
+	})
+	return err
+}
+
+// Create inserts a new document. It returns the id of the created document,
+// or an error if a unique index would be violated or the write failed.
+func (b *BoltDB) Create(data *[]byte) (int, error) {
+	var id int
+	err := b.update(func(ops *boltOps) (err error) {
+		id, err = ops.create(*data)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// Get returns a document by a given id.
+func (b *BoltDB) Get(id int) (*[]byte, error) {
+	var (
+		data []byte
+		ok   bool
+	)
+	b.db.View(func(tx *bolt.Tx) error {
+		data, ok = newBoltOps(b, tx).get(id)
+		return nil
+	})
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &data, nil
+}
+
+// Set updates a document at a given id. The document does not need to exist.
+func (b *BoltDB) Set(id int, data *[]byte) error {
+	return b.update(func(ops *boltOps) error {
+		return ops.set(id, *data)
+	})
+}
+
+// Del removes a document. Return false if doc doesn't exist. Otherwise true.
+func (b *BoltDB) Del(id int) bool {
+	found := false
+	err := b.update(func(ops *boltOps) error {
+		found = ops.del(id)
+		return nil
+	})
+	return err == nil && found
+}
+
+// Update runs fn in a transaction, see Tx. The writes are committed to disk
+// in a single bolt transaction when fn returns, or rolled back if it returns
+// an error.
+func (b *BoltDB) Update(fn func(tx *Tx) error) error {
+	return b.update(func(ops *boltOps) error {
+		return runTx(ops, fn)
+	})
+}
+
+// Changes returns the last change to each document made after the change
+// numbered seq, in the order they were made, and the number of the last
+// change. Deleted documents are returned as tombstones.
+func (b *BoltDB) Changes(seq uint64) ([]Change, uint64) {
+	var (
+		cs   []Change
+		last uint64
+	)
+	b.db.View(func(tx *bolt.Tx) error {
+		ops := newBoltOps(b, tx)
+		last = ops.changes.Sequence()
+		c := ops.changes.Cursor()
+		for k, v := c.Seek(itob(int(seq + 1))); k != nil; k, v = c.Next() {
+			ch := Change{Seq: uint64(btoi(k)), ID: btoi(v[:8]), Deleted: len(v) > 8}
+			if !ch.Deleted {
+				ch.Data, _ = ops.get(ch.ID)
+			}
+			cs = append(cs, ch)
+		}
+		return nil
+	})
+	return cs, last
+}
+
+// Compact removes the tombstones of the documents deleted more than keep
+// changes ago, see Store.Compact.
+func (b *BoltDB) Compact(keep uint64) (int, error) {
+	n := 0
+	err := b.update(func(ops *boltOps) error {
+		last := ops.changes.Sequence()
+		if last <= keep {
+			return nil
+		}
+		seq := last - keep
+		var ids []int
+		c := ops.changes.Cursor()
+		for k, v := c.First(); k != nil && uint64(btoi(k)) <= seq; k, v = c.Next() {
+			if id := btoi(v[:8]); len(v) > 8 && id != ops.maxID() {
+				ids = append(ids, id)
+			}
+		}
+		for _, id := range ids {
+			if err := ops.setChange(id, change{}, false); err != nil {
+				return err
+			}
+		}
+		n = len(ids)
+		return ops.seqs.Put(itob(0), itob(int(seq)))
+	})
+	return n, err
+}
+
+// Horizon returns the horizon of the last Compact, or 0.
+func (b *BoltDB) Horizon() uint64 {
+	var h uint64
+	b.db.View(func(tx *bolt.Tx) error {
+		h = newBoltOps(b, tx).horizon()
+		return nil
+	})
+	return h
+}
+
+// boltOps implements txOps within a bolt write transaction.
+type boltOps struct {
+	b       *BoltDB
+	bk      *bolt.Bucket
+	changes *bolt.Bucket
+	seqs    *bolt.Bucket
+}
+
+func newBoltOps(b *BoltDB, tx *bolt.Tx) *boltOps {
+	return &boltOps{b, tx.Bucket(boltBucket), tx.Bucket(boltChanges), tx.Bucket(boltSeqs)}
+}
+
+func (o *boltOps) get(id int) ([]byte, bool) {
+	v := o.bk.Get(itob(id))
+	if v == nil {
+		return nil, false
+	}
+	// v is only valid for the life of the bolt transaction
+	return append([]byte(nil), v...), true
+}
+
+func (o *boltOps) create(data []byte) (int, error) {
+	id := int(o.bk.Sequence() + 1)
+	keys, err := indexKeys(o.b.indexes, id, data)
+	if err != nil {
+		return 0, err
+	}
+	if err := o.bk.SetSequence(uint64(id)); err != nil {
+		return 0, err
+	}
+	if err := o.bk.Put(itob(id), data); err != nil {
+		return 0, err
+	}
+	if err := o.logChange(id, false); err != nil {
+		return 0, err
+	}
+	setIndexKeys(o.b.indexes, id, keys)
+	return id, nil
+}
+
+func (o *boltOps) set(id int, data []byte) error {
+	keys, err := indexKeys(o.b.indexes, id, data)
+	if err != nil {
+		return err
+	}
+	// Keep the sequence at the highest ID, like DB.idMax.
+	if uint64(id) > o.bk.Sequence() {
+		if err := o.bk.SetSequence(uint64(id)); err != nil {
+			return err
+		}
+	}
+	if err := o.bk.Put(itob(id), data); err != nil {
+		return err
+	}
+	if err := o.logChange(id, false); err != nil {
+		return err
+	}
+	setIndexKeys(o.b.indexes, id, keys)
+	return nil
+}
+
+func (o *boltOps) del(id int) bool {
+	if o.bk.Get(itob(id)) == nil {
+		return false
+	}
+	if err := o.logChange(id, true); err != nil {
+		return false
+	}
+	if err := o.bk.Delete(itob(id)); err != nil {
+		return false
+	}
+	for _, idx := range o.b.indexes {
+		idx.remove(id)
+	}
+	return true
+}
+
+func (o *boltOps) maxID() int {
+	return int(o.bk.Sequence())
+}
+
+func (o *boltOps) setMaxID(id int) error {
+	return o.bk.SetSequence(uint64(id))
+}
+
+func (o *boltOps) logChange(id int, deleted bool) error {
+	seq, err := o.changes.NextSequence()
+	if err != nil {
+		return err
+	}
+	return o.setChange(id, change{seq, deleted}, true)
+}
+
+func (o *boltOps) horizon() uint64 {
+	if k := o.seqs.Get(itob(0)); k != nil {
+		return uint64(btoi(k))
+	}
+	return 0
+}
+
+func (o *boltOps) changeOf(id int) (change, bool) {
+	k := o.seqs.Get(itob(id))
+	if k == nil {
+		return change{}, false
+	}
+	v := o.changes.Get(k)
+	return change{uint64(btoi(k)), len(v) > 8}, true
+}
+
+func (o *boltOps) setChange(id int, c change, ok bool) error {
+	if k := o.seqs.Get(itob(id)); k != nil {
+		if err := o.changes.Delete(append([]byte(nil), k...)); err != nil {
+			return err
+		}
+	}
+	if !ok {
+		return o.seqs.Delete(itob(id))
+	}
+	v := itob(id)
+	if c.deleted {
+		v = append(v, 1)
+	}
+	if err := o.changes.Put(itob(int(c.seq)), v); err != nil {
+		return err
+	}
+	return o.seqs.Put(itob(id), itob(int(c.seq)))
+}
+
+func (o *boltOps) lastSeq() uint64 {
+	return o.changes.Sequence()
+}
+
+func (o *boltOps) setLastSeq(seq uint64) error {
+	return o.changes.SetSequence(seq)
+}
+
+// Iterate calls fn for each of the documents with the given IDs, in order.
+// Each document is read in its own transaction, so fn is free to do slow I/O.
+func (b *BoltDB) Iterate(ids []int, fn func(id int, data []byte) error) error {
+	for _, id := range ids {
+		data, err := b.Get(id)
+		if err != nil {
+			continue
+		}
+		if err := fn(id, *data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteSeveral writes the documents with the given IDs to w as a JSON array.
+func (b *BoltDB) WriteSeveral(w io.Writer, ids []int) error {
+	return writeSeveral(b, w, ids)
+}
+
+// WriteAll writes all the documents to w as a JSON array.
+func (b *BoltDB) WriteAll(w io.Writer) error {
+	return b.WriteSeveral(w, b.IDs())
+}
+
+// All returns all the documents as a JSON array.
+func (b *BoltDB) All() []byte {
+	var buf bytes.Buffer
+	b.WriteAll(&buf) // writing to a bytes.Buffer never fails
+	return buf.Bytes()
+}
+
+// GetSeveral fetches several documents, as requested by slice of IDs.
+func (b *BoltDB) GetSeveral(ids []int) []byte {
+	var buf bytes.Buffer
+	b.WriteSeveral(&buf, ids) // writing to a bytes.Buffer never fails
+	return buf.Bytes()
+}
+
+// Dump dumps all documents into a JSON file, which can be loaded with
+// NewFromFile.
+func (b *BoltDB) Dump(fname string) error {
+	return dump(b, fname)
+}
+
+// AddIndex declares a secondary index, as described for DB.AddIndex.
+func (b *BoltDB) AddIndex(name string, unique bool, fn IndexFunc) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	idx := newIndex(name, unique, fn)
+	err := b.buildIndex(idx)
+	b.indexes = append(b.indexes, idx)
+	return err
+}
+
+// Lookup returns the IDs of the documents with the given key in the named
+// index, in ascending order.
+func (b *BoltDB) Lookup(name, key string) []int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return lookup(b.indexes, name, key)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// changesHeartbeat is how often a comment is sent on an idle change stream,
+// to keep proxies from closing it.
+const changesHeartbeat = 30 * time.Second
+
+// changeEvent is a change to a person, as sent on the change feed and to
+// webhooks.
+type changeEvent struct {
+	// Seq numbers the changes in the order they were made, from 1 when the
+	// server starts. The numbers kept by the store are those of Store.Changes.
+	Seq      uint64
+	Event    string
+	Time     time.Time
+	PersonID int
+	Person   *person `json:",omitempty"` // nil when deleted
+	Previous *person `json:",omitempty"` // nil when created
+}
+
+// changeEvents returns the events of the changes in c, leaving out persons
+// stored unchanged.
+func changeEvents(c *batchChanges, now time.Time) []changeEvent {
+	var evs []changeEvent
+	for _, id := range c.ids {
+		ev := changeEvent{Time: now, PersonID: id, Previous: c.before[id], Person: c.after[id]}
+		switch {
+		case ev.Previous == nil:
+			ev.Event = eventPersonCreated
+		case ev.Person == nil:
+			ev.Event = eventPersonDeleted
+		case *ev.Previous == *ev.Person:
+			continue
+		default:
+			ev.Event = eventPersonUpdated
+		}
+		evs = append(evs, ev)
+	}
+	return evs
+}
+
+// changeFeed numbers the change events, and keeps the last ones for the
+// clients of the change stream.
+type changeFeed struct {
+	mu     sync.Mutex
+	epoch  string        // random, so that event IDs differ between restarts
+	seq    uint64        // of the last event
+	events []changeEvent // the last size events, oldest first
+	size   int
+	notify chan struct{} // closed, and replaced, when events are published
+	done   chan struct{} // closed when the feed is closed
+}
+
+func newChangeFeed(size int) *changeFeed {
+	return &changeFeed{epoch: newToken()[:12], size: size, notify: make(chan struct{}), done: make(chan struct{})}
+}
+
+// eventID returns the ID of event seq on the change stream, which is
+// "<epoch>-<seq>".
+func (f *changeFeed) eventID(seq uint64) string {
+	return f.epoch + "-" + strconv.FormatUint(seq, 10)
+}
+
+// parseEventID returns the sequence number of an event ID. ok is false if the
+// ID is invalid, or from before a restart.
+func (f *changeFeed) parseEventID(id string) (seq uint64, ok bool) {
+	i := strings.LastIndexByte(id, '-')
+	if i < 0 || id[:i] != f.epoch {
+		return 0, false
+	}
+	seq, err := strconv.ParseUint(id[i+1:], 10, 64)
+	return seq, err == nil
+}
+
+// publish numbers the events, and wakes the clients waiting for them.
+func (f *changeFeed) publish(evs []changeEvent) {
+	if len(evs) == 0 {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := range evs {
+		f.seq++
+		evs[i].Seq = f.seq
+	}
+	f.events = append(f.events, evs...)
+	if len(f.events) > f.size {
+		f.events = append([]changeEvent(nil), f.events[len(f.events)-f.size:]...)
+	}
+	close(f.notify)
+	f.notify = make(chan struct{})
+}
+
+// since returns the events after seq, and a channel closed when there are
+// more. ok is false if the events after seq are no longer kept, or seq is
+// ahead of the feed; latest is then the last event to resume from.
+func (f *changeFeed) since(seq uint64) (evs []changeEvent, latest uint64, wait <-chan struct{}, ok bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	oldest := f.seq - uint64(len(f.events)) // the last event not kept
+	if seq > f.seq || seq < oldest {
+		return nil, f.seq, f.notify, false
+	}
+	evs = append([]changeEvent(nil), f.events[seq-oldest:]...)
+	return evs, f.seq, f.notify, true
+}
+
+// last returns the sequence number of the last event.
+func (f *changeFeed) last() uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.seq
+}
+
+// close ends the change streams, so that the server can shut down.
+func (f *changeFeed) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	select {
+	case <-f.done:
+	default:
+		close(f.done)
+	}
+}
+
+// GET /changes
+//
+// A Server-Sent Events stream of the changes to persons, with event IDs made
+// of a random epoch, which changes when the server restarts, and the sequence
+// number of the event. It starts with the changes after the one in the
+// Last-Event-ID header, if given, else with the next change. If those changes
+// are no longer kept, or the ID is from before a restart, a "reset" event is
+// sent first, and the client should reload what it shows.
+func (app *App) changesHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	last, reset := app.changes.last(), false
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		if n, ok := app.changes.parseEventID(id); ok {
+			last = n
+		} else {
+			reset = true
+		}
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	io.WriteString(w, "retry: 3000\n\n")
+
+	heartbeat := time.NewTicker(changesHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		evs, latest, wait, ok := app.changes.since(last)
+		if !ok || reset {
+			fmt.Fprintf(w, "id: %s\nevent: reset\ndata: {}\n\n", app.changes.eventID(latest))
+			last, evs, reset = latest, nil, false
+		}
+		for _, ev := range evs {
+			b, err := json.Marshal(ev)
+			if err != nil {
+				app.logError(r.Header, "GET /changes: %v", err)
+				return
+			}
+			fmt.Fprintf(w, "id: %s\ndata: %s\n\n", app.changes.eventID(ev.Seq), b)
+			last = ev.Seq
+		}
+		flusher.Flush()
+		select {
+		case <-wait:
+		case <-heartbeat.C:
+			io.WriteString(w, ": ping\n\n")
+		case <-r.Context().Done():
+			return
+		case <-app.changes.done:
+			return
+		}
+	}
+}
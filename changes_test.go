@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/knakk/specs"
+)
+
+func TestChangeFeed(t *testing.T) {
+	s := specs.New(t)
+	f := newChangeFeed(3)
+	evs, latest, wait, ok := f.since(0)
+	s.Expect(true, ok)
+	s.Expect(0, len(evs))
+	s.Expect(uint64(0), latest)
+
+	for i := 1; i <= 4; i++ {
+		f.publish([]changeEvent{{Event: eventPersonCreated, PersonID: i}})
+	}
+	select {
+	case <-wait:
+	default:
+		t.Fatal("expected wait to be closed")
+	}
+
+	var tests = []struct {
+		seq     uint64
+		wantIDs []int
+		wantOK  bool
+	}{
+		{0, nil, false}, // event 1 is no longer kept
+		{1, []int{2, 3, 4}, true},
+		{3, []int{4}, true},
+		{4, []int{}, true},
+		{5, nil, false}, // ahead of the feed
+	}
+	for _, tt := range tests {
+		evs, latest, _, ok := f.since(tt.seq)
+		s.Expect(uint64(4), latest)
+		if ok != tt.wantOK {
+			t.Errorf("since(%d) ok = %v; want %v", tt.seq, ok, tt.wantOK)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		ids := []int{}
+		for _, ev := range evs {
+			ids = append(ids, ev.PersonID)
+			s.Expect(uint64(ev.PersonID), ev.Seq)
+		}
+		s.Expect(tt.wantIDs, ids)
+	}
+
+	// event IDs are only valid for the feed which made them, as the numbers
+	// start over when the server restarts
+	seq, ok := f.parseEventID(f.eventID(3))
+	s.Expect(true, ok)
+	s.Expect(uint64(3), seq)
+	restarted := newChangeFeed(3)
+	s.ExpectNot(f.eventID(3), restarted.eventID(3))
+	for _, id := range []string{restarted.eventID(3), "3", "x-3", f.eventID(3) + "x", ""} {
+		if _, ok := f.parseEventID(id); ok {
+			t.Errorf("parseEventID(%q) ok; want not ok", id)
+		}
+	}
+}
+
+// sseEvent is an event read from a Server-Sent Events stream.
+type sseEvent struct {
+	id, event, data string
+}
+
+// readSSE sends the events read from the stream r on a channel.
+func readSSE(r *bufio.Reader) <-chan sseEvent {
+	c := make(chan sseEvent)
+	go func() {
+		defer close(c)
+		var ev sseEvent
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimSuffix(line, "\n")
+			switch {
+			case line == "":
+				if ev.data != "" {
+					c <- ev
+				}
+				ev = sseEvent{}
+			case strings.HasPrefix(line, "id: "):
+				ev.id = line[4:]
+			case strings.HasPrefix(line, "event: "):
+				ev.event = line[7:]
+			case strings.HasPrefix(line, "data: "):
+				ev.data = line[6:]
+			}
+		}
+	}()
+	return c
+}
+
+func TestChangesStream(t *testing.T) {
+	s := specs.New(t)
+	app := newTestApp(t, dept{1, "IT", 0}, dept{2, "HR", 0})
+	app.changes = newChangeFeed(2)
+	server := httptest.NewServer(app)
+	defer server.Close()
+	auth := "Bearer " + testToken(t, app, scopePersonsWrite)
+
+	connect := func(lastID string) (<-chan sseEvent, func()) {
+		req, err := http.NewRequest("GET", server.URL+"/api/changes", nil)
+		s.ExpectNilFatal(err)
+		if lastID != "" {
+			req.Header.Set("Last-Event-ID", lastID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		s.ExpectNilFatal(err)
+		s.Expect(http.StatusOK, resp.StatusCode)
+		s.Expect("text/event-stream", resp.Header.Get("Content-Type"))
+		return readSSE(bufio.NewReader(resp.Body)), func() { resp.Body.Close() }
+	}
+	next := func(c <-chan sseEvent) sseEvent {
+		select {
+		case ev := <-c:
+			return ev
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for an event")
+		}
+		return sseEvent{}
+	}
+	write := func(method, path, body string) {
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		s.ExpectNilFatal(err)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("Authorization", auth)
+		resp, err := http.DefaultClient.Do(req)
+		s.ExpectNilFatal(err)
+		resp.Body.Close()
+	}
+
+	events, stop := connect("")
+	write("POST", "/api/person", `{"Name":"Kari","Email":"kari@example.com","Department":1}`)
+	write("PATCH", "/api/person/1", `{"Name":"Kari","Email":"kari@example.com","Department":2}`)
+	write("DELETE", "/api/person/1", "")
+
+	ev := next(events)
+	s.Expect(app.changes.eventID(1), ev.id)
+	var ce changeEvent
+	s.ExpectNilFatal(json.Unmarshal([]byte(ev.data), &ce))
+	s.Expect(eventPersonCreated, ce.Event)
+	s.Expect("Kari", ce.Person.Name)
+	ev = next(events)
+	s.ExpectNilFatal(json.Unmarshal([]byte(ev.data), &ce))
+	s.Expect(uint64(2), ce.Seq)
+	s.Expect(eventPersonUpdated, ce.Event)
+	s.Expect(1, ce.Previous.Department)
+	s.Expect(2, ce.Person.Department)
+	ev = next(events)
+	s.Expect(app.changes.eventID(3), ev.id)
+	s.ExpectMatches(ev.data, `"Event":"person.deleted"`)
+	stop()
+
+	// resuming with Last-Event-ID sends the missed changes
+	events, stop = connect(app.changes.eventID(2))
+	s.Expect(app.changes.eventID(3), next(events).id)
+	stop()
+
+	// changes which are no longer kept, or from before a restart, reset
+	for i, lastID := range []string{app.changes.eventID(0), app.changes.eventID(9), "x", "2"} {
+		events, stop = connect(lastID)
+		ev = next(events)
+		s.Expect(sseEvent{app.changes.eventID(uint64(3 + i)), "reset", "{}"}, ev)
+		write("POST", "/api/person", `{"Name":"Ola","Email":"ola`+strconv.Itoa(i)+`@example.com","Department":1}`)
+		s.ExpectMatches(next(events).data, `"Name":"Ola"`)
+		stop()
+	}
+
+	// after a restart, an ID from before it resets, even though the new
+	// feed has made more events than it numbers
+	restarted := newTestApp(t, dept{1, "IT", 0})
+	restartedServer := httptest.NewServer(restarted)
+	defer restartedServer.Close()
+	for i := 1; i <= 10; i++ {
+		_, err := restarted.addPerson(person{Name: "Per", Department: 1, Email: strconv.Itoa(i) + "@example.com"})
+		s.ExpectNilFatal(err)
+	}
+	req, err := http.NewRequest("GET", restartedServer.URL+"/api/changes", nil)
+	s.ExpectNilFatal(err)
+	req.Header.Set("Last-Event-ID", app.changes.eventID(3))
+	resp, err := http.DefaultClient.Do(req)
+	s.ExpectNilFatal(err)
+	s.Expect(sseEvent{restarted.changes.eventID(10), "reset", "{}"}, next(readSSE(bufio.NewReader(resp.Body))))
+	resp.Body.Close()
+
+	// closing the feed ends the streams
+	events, _ = connect("")
+	app.changes.close()
+	select {
+	case _, ok := <-events:
+		s.Expect(false, ok)
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream not closed")
+	}
+	app.bg.Wait()
+}
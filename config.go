@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Config is the configuration of an App. It is read from a JSON file, with
+// the field names as keys, and each field can be overridden by the
+// environment variable in its env tag.
+type Config struct {
+	// DataDir holds the databases (folk.db, avd.db, folk.bolt) and the
+	// uploaded images (img/).
+	DataDir string `env:"FOLK_DATA_DIR"`
+	// AssetsDir holds the templates (html/), stylesheets (css/),
+	// robots.txt and the OpenAPI description of the API (openapi.json).
+	AssetsDir string `env:"FOLK_ASSETS_DIR"`
+	// Port is the port to serve from.
+	Port string `env:"FOLK_PORT"`
+	// Username and Password are the admin credentials.
+	Username string `env:"FOLK_USERNAME"`
+	Password string `env:"FOLK_PASSWORD" secret:"true"`
+	// Store is the kind of person database, see openPersons.
+	Store string `env:"FOLK_STORE"`
+	// SaveEvery is the number of edits between each save of folk.db.
+	SaveEvery int `env:"FOLK_SAVE_EVERY"`
+	// SaveInterval is the maximum number of seconds an edit is left unsaved.
+	SaveInterval int `env:"FOLK_SAVE_INTERVAL"`
+	// MaxUploadSize is the maximum size in bytes of uploaded images and
+	// imported CSV files.
+	MaxUploadSize int64 `env:"FOLK_MAX_UPLOAD_SIZE"`
+	// AdminPageSize is the number of persons listed on the admin page.
+	AdminPageSize int `env:"FOLK_ADMIN_PAGE_SIZE"`
+	// ShutdownTimeout is the number of seconds to wait for in-flight
+	// requests on shutdown.
+	ShutdownTimeout int `env:"FOLK_SHUTDOWN_TIMEOUT"`
+	// LoginRatePerMinute and LoginBurst limit the login attempts from each
+	// IP address, and for each username.
+	LoginRatePerMinute int `env:"FOLK_LOGIN_RATE_PER_MINUTE"`
+	LoginBurst         int `env:"FOLK_LOGIN_BURST"`
+	// After LockoutThreshold failed logins in a row from an IP address for a
+	// username, it is locked out for LockoutSeconds, doubling with each
+	// further failure, up to an hour.
+	LockoutThreshold int `env:"FOLK_LOCKOUT_THRESHOLD"`
+	LockoutSeconds   int `env:"FOLK_LOCKOUT_SECONDS"`
+	// TrustedProxies are the reverse proxies in front of folk, as comma
+	// separated IP addresses and CIDR ranges. The login limits of requests
+	// from them are by the client address they add to X-Forwarded-For.
+	TrustedProxies string `env:"FOLK_TRUSTED_PROXIES"`
+	// APIWriteRate and APIWriteBurst limit the writes to the API, from all
+	// clients together, per second. 0 disables the limit.
+	APIWriteRate  int `env:"FOLK_API_WRITE_RATE"`
+	APIWriteBurst int `env:"FOLK_API_WRITE_BURST"`
+	// OIDCIssuer is the URL of the OpenID Connect provider to log in with, or
+	// "" to only log in with Username and Password. The client must be
+	// registered with OIDCRedirectURL, which is <folk URL>/oidc/callback.
+	OIDCIssuer       string `env:"FOLK_OIDC_ISSUER"`
+	OIDCClientID     string `env:"FOLK_OIDC_CLIENT_ID"`
+	OIDCClientSecret string `env:"FOLK_OIDC_CLIENT_SECRET" secret:"true"`
+	OIDCRedirectURL  string `env:"FOLK_OIDC_REDIRECT_URL"`
+	// OIDCAdmins and OIDCEditors are the users given the admin and
+	// persons:write roles when logging in with OIDC, as comma separated
+	// email addresses and groups, given as "group:<name>". Other users can't
+	// log in.
+	OIDCAdmins  string `env:"FOLK_OIDC_ADMINS"`
+	OIDCEditors string `env:"FOLK_OIDC_EDITORS"`
+	// LDAPURL is the ldap:// or ldaps:// URL of the directory to sync
+	// persons from, or "" to not sync. The persons are searched for under
+	// LDAPBaseDN with LDAPFilter, after binding as LDAPBindDN, if set.
+	LDAPURL          string `env:"FOLK_LDAP_URL"`
+	LDAPBindDN       string `env:"FOLK_LDAP_BIND_DN"`
+	LDAPBindPassword string `env:"FOLK_LDAP_BIND_PASSWORD" secret:"true"`
+	LDAPBaseDN       string `env:"FOLK_LDAP_BASE_DN"`
+	LDAPFilter       string `env:"FOLK_LDAP_FILTER"`
+	// LDAPAttributes maps person fields to LDAP attributes, see
+	// parseLDAPAttributes. The department is the innermost OU which names
+	// one.
+	LDAPAttributes string `env:"FOLK_LDAP_ATTRIBUTES"`
+	// LDAPSyncInterval is the number of minutes between each sync while
+	// serving, or 0 to only sync with the ldap-sync command.
+	LDAPSyncInterval int `env:"FOLK_LDAP_SYNC_INTERVAL"`
+	// A webhook delivery which fails is retried after WebhookRetrySeconds,
+	// doubling with each further failure, until WebhookMaxAttempts have
+	// been made. Each attempt times out after WebhookTimeout seconds.
+	WebhookMaxAttempts  int `env:"FOLK_WEBHOOK_MAX_ATTEMPTS"`
+	WebhookRetrySeconds int `env:"FOLK_WEBHOOK_RETRY_SECONDS"`
+	WebhookTimeout      int `env:"FOLK_WEBHOOK_TIMEOUT"`
+	// WebhookLogDays is the number of days finished deliveries are kept in
+	// the delivery log, or 0 to keep them.
+	WebhookLogDays int `env:"FOLK_WEBHOOK_LOG_DAYS"`
+	// ChangeBufferSize is the number of changes kept for clients of
+	// /api/changes to resume from.
+	ChangeBufferSize int `env:"FOLK_CHANGE_BUFFER_SIZE"`
+	// TombstoneRetention is the number of changes for which at least the
+	// tombstones of deleted persons are kept, or 0 to keep them. Clients of
+	// /api/person/changes further behind are sent all persons.
+	TombstoneRetention int `env:"FOLK_TOMBSTONE_RETENTION"`
+}
+
+// defaultConfig returns the configuration used when nothing is configured.
+func defaultConfig() Config {
+	return Config{
+		DataDir:         "data",
+		AssetsDir:       "data",
+		Port:            "9999",
+		Username:        "admin",
+		Password:        "secret",
+		Store:           "memory",
+		SaveEvery:       15,
+		SaveInterval:    60,
+		MaxUploadSize:   2 * 1024 * 1024, // 2 MB
+		AdminPageSize:   150,
+		ShutdownTimeout: 30,
+
+		LoginRatePerMinute: 10,
+		LoginBurst:         5,
+		LockoutThreshold:   5,
+		LockoutSeconds:     60,
+		APIWriteRate:       20,
+		APIWriteBurst:      100,
+
+		LDAPFilter:     "(&(objectClass=person)(mail=*))",
+		LDAPAttributes: "Name=displayName,Email=mail,Phone=telephoneNumber,Role=title",
+
+		WebhookMaxAttempts:  8,
+		WebhookRetrySeconds: 30,
+		WebhookTimeout:      10,
+		WebhookLogDays:      30,
+
+		ChangeBufferSize:   1000,
+		TombstoneRetention: 10000,
+	}
+}
+
+// loadConfig returns the default configuration, overridden by the JSON config
+// file fname, if not "", and then by the FOLK_* environment variables, as
+// looked up by getenv.
+func loadConfig(fname string, getenv func(string) string) (Config, error) {
+	cfg := defaultConfig()
+	if fname != "" {
+		f, err := os.Open(fname)
+		if err != nil {
+			return cfg, err
+		}
+		defer f.Close()
+		dec := json.NewDecoder(f)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&cfg); err != nil {
+			return cfg, fmt.Errorf("config file %s: %v", fname, err)
+		}
+	}
+	if err := cfg.setEnv(getenv); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// setEnv overrides the fields of cfg which have their environment variable
+// set.
+func (cfg *Config) setEnv(getenv func(string) string) error {
+	v := reflect.ValueOf(cfg).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Tag.Get("env")
+		s := getenv(name)
+		if name == "" || s == "" {
+			continue
+		}
+		f := v.Field(i)
+		switch f.Kind() {
+		case reflect.String:
+			f.SetString(s)
+		case reflect.Int, reflect.Int64:
+			n, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				return fmt.Errorf("%s: must be an integer, got %q", name, s)
+			}
+			f.SetInt(n)
+		}
+	}
+	return nil
+}
+
+// validate checks that the configuration is usable, and returns an error
+// listing all the problems found.
+func (cfg *Config) validate() error {
+	var errs []string
+	check := func(ok bool, format string, a ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Sprintf(format, a...))
+		}
+	}
+	for _, d := range []struct{ name, dir string }{
+		{"DataDir", cfg.DataDir},
+		{"AssetsDir", cfg.AssetsDir},
+	} {
+		fi, err := os.Stat(d.dir)
+		check(err == nil && fi.IsDir(), "%s: %q is not a directory", d.name, d.dir)
+	}
+	port, err := strconv.Atoi(cfg.Port)
+	check(err == nil && port > 0 && port < 65536, "Port: must be a number from 1 to 65535, got %q", cfg.Port)
+	check(cfg.Username != "" && cfg.Password != "", "Username and Password: must not be empty")
+	check(cfg.Store == "memory" || cfg.Store == "bolt", `Store: must be "memory" or "bolt", got %q`, cfg.Store)
+	check(cfg.SaveEvery > 0, "SaveEvery: must be positive, got %d", cfg.SaveEvery)
+	check(cfg.SaveInterval > 0, "SaveInterval: must be positive, got %d", cfg.SaveInterval)
+	check(cfg.MaxUploadSize > 0, "MaxUploadSize: must be positive, got %d", cfg.MaxUploadSize)
+	check(cfg.AdminPageSize > 0, "AdminPageSize: must be positive, got %d", cfg.AdminPageSize)
+	check(cfg.ShutdownTimeout > 0, "ShutdownTimeout: must be positive, got %d", cfg.ShutdownTimeout)
+	check(cfg.LoginRatePerMinute > 0, "LoginRatePerMinute: must be positive, got %d", cfg.LoginRatePerMinute)
+	check(cfg.LoginBurst > 0, "LoginBurst: must be positive, got %d", cfg.LoginBurst)
+	check(cfg.LockoutThreshold > 0, "LockoutThreshold: must be positive, got %d", cfg.LockoutThreshold)
+	check(cfg.LockoutSeconds > 0, "LockoutSeconds: must be positive, got %d", cfg.LockoutSeconds)
+	_, err = parseTrustedProxies(cfg.TrustedProxies)
+	check(err == nil, "TrustedProxies: %v", err)
+	check(cfg.APIWriteRate >= 0, "APIWriteRate: must not be negative, got %d", cfg.APIWriteRate)
+	check(cfg.APIWriteRate == 0 || cfg.APIWriteBurst > 0, "APIWriteBurst: must be positive, got %d", cfg.APIWriteBurst)
+	if cfg.OIDCIssuer != "" {
+		u, err := url.Parse(cfg.OIDCIssuer)
+		check(err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != "",
+			"OIDCIssuer: must be an http(s) URL, got %q", cfg.OIDCIssuer)
+		check(cfg.OIDCClientID != "", "OIDCClientID: must be set with OIDCIssuer")
+		u, err = url.Parse(cfg.OIDCRedirectURL)
+		check(err == nil && u.IsAbs() && strings.HasSuffix(u.Path, "/oidc/callback"),
+			"OIDCRedirectURL: must be the absolute URL of /oidc/callback, got %q", cfg.OIDCRedirectURL)
+		check(cfg.OIDCAdmins != "" || cfg.OIDCEditors != "", "OIDCAdmins and OIDCEditors: one must be set with OIDCIssuer")
+	}
+	if cfg.LDAPURL != "" {
+		u, err := url.Parse(cfg.LDAPURL)
+		check(err == nil && (u.Scheme == "ldap" || u.Scheme == "ldaps") && u.Host != "",
+			"LDAPURL: must be an ldap:// or ldaps:// URL, got %q", cfg.LDAPURL)
+		check(cfg.LDAPBaseDN != "", "LDAPBaseDN: must be set with LDAPURL")
+		_, err = parseLDAPAttributes(cfg.LDAPAttributes)
+		check(err == nil, "LDAPAttributes: %v", err)
+		check(cfg.LDAPSyncInterval >= 0, "LDAPSyncInterval: must not be negative, got %d", cfg.LDAPSyncInterval)
+	}
+	check(cfg.WebhookMaxAttempts > 0, "WebhookMaxAttempts: must be positive, got %d", cfg.WebhookMaxAttempts)
+	check(cfg.WebhookRetrySeconds > 0, "WebhookRetrySeconds: must be positive, got %d", cfg.WebhookRetrySeconds)
+	check(cfg.WebhookTimeout > 0, "WebhookTimeout: must be positive, got %d", cfg.WebhookTimeout)
+	check(cfg.WebhookLogDays >= 0, "WebhookLogDays: must not be negative, got %d", cfg.WebhookLogDays)
+	check(cfg.ChangeBufferSize > 0, "ChangeBufferSize: must be positive, got %d", cfg.ChangeBufferSize)
+	check(cfg.TombstoneRetention >= 0, "TombstoneRetention: must not be negative, got %d", cfg.TombstoneRetention)
+	if len(errs) > 0 {
+		return errors.New("invalid config:\n\t" + strings.Join(errs, "\n\t"))
+	}
+	return nil
+}
+
+// redacted returns a copy of the configuration with the secrets masked.
+func (cfg Config) redacted() Config {
+	v := reflect.ValueOf(&cfg).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if v.Type().Field(i).Tag.Get("secret") == "true" && v.Field(i).String() != "" {
+			v.Field(i).SetString("REDACTED")
+		}
+	}
+	return cfg
+}
+
+// writeConfig writes the configuration as JSON, in the format of the config
+// file, with the secrets redacted.
+func writeConfig(w io.Writer, cfg Config) error {
+	b, err := json.MarshalIndent(cfg.redacted(), "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", b)
+	return err
+}
+
+// configCmd implements the config command:
+//
+//	folk config print
+//
+// The effective config is printed even if it is invalid, followed by the
+// validation errors on stderr.
+func configCmd(cfg Config, args []string) {
+	fs := flag.NewFlagSet("config", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.Arg(0) != "print" {
+		fmt.Fprintln(os.Stderr, "usage: folk config print")
+		os.Exit(2)
+	}
+	err := writeConfig(os.Stdout, cfg)
+	if err == nil {
+		err = cfg.validate()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
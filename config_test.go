@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/knakk/specs"
+)
+
+func TestLoadConfig(t *testing.T) {
+	s := specs.New(t)
+	dir := t.TempDir()
+	fname := filepath.Join(dir, "folk.json")
+	s.ExpectNilFatal(ioutil.WriteFile(fname, []byte(`{"Port": "8080", "Password": "hemmelig", "SaveEvery": 5}`), 0600))
+	env := map[string]string{
+		"FOLK_DATA_DIR":   dir,
+		"FOLK_SAVE_EVERY": "20",
+	}
+
+	cfg, err := loadConfig(fname, func(k string) string { return env[k] })
+	s.ExpectNilFatal(err)
+	want := defaultConfig()
+	want.DataDir = dir
+	want.Port = "8080"
+	want.Password = "hemmelig"
+	want.SaveEvery = 20
+	s.Expect(want, cfg)
+	s.ExpectNilFatal(cfg.validate())
+
+	// no config file
+	cfg, err = loadConfig("", func(string) string { return "" })
+	s.ExpectNilFatal(err)
+	s.Expect(defaultConfig(), cfg)
+
+	var tests = []struct {
+		file string
+		env  map[string]string
+		err  string
+	}{
+		{`{"Port": 8080}`, nil, `config file .*: json: cannot unmarshal number into Go struct field Config.Port of type string`},
+		{`{"Prot": "8080"}`, nil, `config file .*: json: unknown field "Prot"`},
+		{`{}`, map[string]string{"FOLK_SAVE_EVERY": "often"}, `FOLK_SAVE_EVERY: must be an integer, got "often"`},
+	}
+	for _, tt := range tests {
+		s.ExpectNilFatal(ioutil.WriteFile(fname, []byte(tt.file), 0600))
+		_, err := loadConfig(fname, func(k string) string { return tt.env[k] })
+		if err == nil {
+			t.Errorf("%s: expected error", tt.file)
+			continue
+		}
+		s.ExpectMatches(err.Error(), tt.err)
+	}
+	_, err = loadConfig(filepath.Join(dir, "missing.json"), func(string) string { return "" })
+	s.ExpectNot(nil, err)
+}
+
+func TestConfigValidate(t *testing.T) {
+	s := specs.New(t)
+	cfg := defaultConfig()
+	cfg.DataDir = filepath.Join(t.TempDir(), "missing")
+	cfg.Port = "99999"
+	cfg.Store = "mysql"
+	cfg.SaveEvery = 0
+	err := cfg.validate()
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	s.Expect(`invalid config:
+	DataDir: "`+cfg.DataDir+`" is not a directory
+	Port: must be a number from 1 to 65535, got "99999"
+	Store: must be "memory" or "bolt", got "mysql"
+	SaveEvery: must be positive, got 0`, err.Error())
+}
+
+func TestWriteConfig(t *testing.T) {
+	s := specs.New(t)
+	cfg := defaultConfig()
+	var buf bytes.Buffer
+	s.ExpectNilFatal(writeConfig(&buf, cfg))
+	s.ExpectMatches(buf.String(), `"Password": "REDACTED"`)
+	s.ExpectNotMatches(buf.String(), `secret`)
+	s.ExpectMatches(buf.String(), `"Username": "admin"`)
+	s.Expect("secret", cfg.Password)
+}
+
+func TestConfigValidateOIDC(t *testing.T) {
+	s := specs.New(t)
+	cfg := defaultConfig()
+	cfg.DataDir = t.TempDir()
+	cfg.AssetsDir = cfg.DataDir
+	cfg.OIDCIssuer = "accounts.example.com"
+	cfg.OIDCRedirectURL = "/oidc/callback"
+	err := cfg.validate()
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	s.Expect(`invalid config:
+	OIDCIssuer: must be an http(s) URL, got "accounts.example.com"
+	OIDCClientID: must be set with OIDCIssuer
+	OIDCRedirectURL: must be the absolute URL of /oidc/callback, got "/oidc/callback"
+	OIDCAdmins and OIDCEditors: one must be set with OIDCIssuer`, err.Error())
+
+	cfg.OIDCIssuer = "https://accounts.example.com"
+	cfg.OIDCClientID = "folk"
+	cfg.OIDCRedirectURL = "https://folk.example.com/oidc/callback"
+	cfg.OIDCEditors = "group:hr"
+	s.ExpectNil(cfg.validate())
+}
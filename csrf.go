@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/gorilla/sessions"
+)
+
+// csrfHeader carries the CSRF token of the session in writes made with the
+// session cookie. The admin page gets the token in its template data.
+const csrfHeader = "X-CSRF-Token"
+
+// sessionName is the name of the session cookie.
+const sessionName = "folke_sjef"
+
+// newToken returns a random token of 32 bytes, hex encoded.
+func newToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// csrfToken returns the CSRF token of session, creating one if it has none.
+// The session must be saved if it is created.
+func csrfToken(session *sessions.Session) (token string, created bool) {
+	if t, ok := session.Values["csrf"].(string); ok && t != "" {
+		return t, false
+	}
+	t := newToken()
+	session.Values["csrf"] = t
+	return t, true
+}
+
+// checkCSRF wraps h to reject writes, which are all requests except GET, HEAD
+// and OPTIONS, made without the CSRF token of the session. Requests with a
+// valid bearer token carry no credentials a forged request could borrow, and
+// are exempt if its scope allows them.
+func (app *App) checkCSRF(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET", "HEAD", "OPTIONS":
+			h.ServeHTTP(w, r)
+			return
+		}
+		if !app.validCSRF(r, requiredScope(r.Method, r.URL.Path)) {
+			http.Error(w, "invalid CSRF token", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// validCSRF reports whether r has a valid bearer token with the scope needed,
+// or the CSRF token of its session.
+func (app *App) validCSRF(r *http.Request, needed string) bool {
+	if secret, ok := bearerToken(r); ok {
+		t, err := app.checkToken(secret)
+		return err == nil && scopeAllows(t.Scope, needed)
+	}
+	// A missing session, or one which fails to decode, has no token.
+	session, _ := app.sessions.Get(r, sessionName)
+	want, _ := session.Values["csrf"].(string)
+	got := r.Header.Get(csrfHeader)
+	return want != "" && subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/knakk/specs"
+)
+
+var csrfMeta = regexp.MustCompile(`<meta name="csrf-token" content="([0-9a-f]{64})">`)
+
+func TestCSRF(t *testing.T) {
+	s := specs.New(t)
+	app := newTestApp(t, dept{1, "main", 0})
+	_, err := app.tokens.Create(apiToken{Name: "script", Scope: scopePersonsWrite, Hash: hashToken("xyz")})
+	s.ExpectNilFatal(err)
+	_, err = app.tokens.Create(apiToken{Name: "reader", Scope: scopeRead, Hash: hashToken("readonly")})
+	s.ExpectNilFatal(err)
+	_, err = app.addPerson(person{Name: "A", Department: 1, Email: "a@example.com"})
+	s.ExpectNilFatal(err)
+
+	// the admin page asks for a login, without starting a session
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/admin", nil)
+	app.ServeHTTP(w, req)
+	s.Expect(http.StatusOK, w.Code)
+	s.Expect(true, csrfMeta.FindStringSubmatch(w.Body.String()) == nil)
+	s.Expect(0, len(w.Result().Cookies()))
+
+	login := func(c *http.Cookie) *http.Cookie {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/authenticate",
+			strings.NewReader(url.Values{"username": {"admin"}, "password": {"secret"}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if c != nil {
+			req.AddCookie(c)
+		}
+		app.ServeHTTP(w, req)
+		s.Expect(http.StatusOK, w.Code)
+		cookies := w.Result().Cookies()
+		s.Expect(1, len(cookies))
+		// scripts have no use for the session cookie
+		s.Expect(true, cookies[0].HttpOnly)
+		return cookies[0]
+	}
+	adminToken := func(c *http.Cookie) string {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/admin", nil)
+		req.AddCookie(c)
+		app.ServeHTTP(w, req)
+		m := csrfMeta.FindStringSubmatch(w.Body.String())
+		if m == nil {
+			t.Fatalf("no CSRF token in admin page:\n%s", w.Body.String())
+		}
+		return m[1]
+	}
+
+	// once logged in, the admin page renders the token of the session, which
+	// stays the same
+	cookie := login(nil)
+	s.Expect("/", cookie.Path)
+	token := adminToken(cookie)
+	s.Expect(token, adminToken(cookie))
+
+	do := func(method, path, body string, h map[string]string, withCookie bool) int {
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		for k, v := range h {
+			req.Header.Set(k, v)
+		}
+		if withCookie {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	var tests = []struct {
+		method, path, body string
+		header             map[string]string
+		cookie             bool
+		want               int
+	}{
+		{"POST", "/api/person", `{"Name":"B","Department":1,"Email":"b@example.com"}`, nil, true, http.StatusForbidden},
+		{"POST", "/api/person", `{"Name":"B","Department":1,"Email":"b@example.com"}`, map[string]string{"X-CSRF-Token": "abc"}, true, http.StatusForbidden},
+		{"POST", "/api/person", `{"Name":"B","Department":1,"Email":"b@example.com"}`, map[string]string{"X-CSRF-Token": token}, true, http.StatusCreated},
+		{"PATCH", "/api/person/1", `{"Name":"B","Department":1,"Email":"a@example.com"}`, nil, true, http.StatusForbidden},
+		{"DELETE", "/api/person/1", "", nil, true, http.StatusForbidden},
+		{"POST", "/upload", "", nil, true, http.StatusForbidden},
+		{"GET", "/api/person/1", "", nil, true, http.StatusOK},
+		// GraphQL mutations are writes, but queries are not
+		{"POST", "/graphql", `{"query":"mutation { deletePerson(id: 1) }"}`, nil, true, http.StatusForbidden},
+		{"POST", "/graphql", `{"query":"{ person(id: 1) { name } }"}`, nil, true, http.StatusOK},
+		// requests without the cookie have no login, nor a token
+		{"PATCH", "/api/person/1", `{"Name":"B","Department":1,"Email":"a@example.com"}`, nil, false, http.StatusUnauthorized},
+		{"POST", "/upload", "", nil, false, http.StatusUnauthorized},
+		{"POST", "/graphql", `{"query":"{ person(id: 1) { name } }"}`, nil, false, http.StatusOK},
+		// requests with a valid bearer token, with the scope needed, are
+		// exempt
+		{"POST", "/upload", "", map[string]string{"Authorization": "Bearer nonsense"}, true, http.StatusUnauthorized},
+		{"POST", "/upload", "", map[string]string{"Authorization": "Bearer readonly"}, false, http.StatusForbidden},
+		{"PATCH", "/api/person/1", `{"Name":"B","Department":1,"Email":"a@example.com"}`, map[string]string{"Authorization": "Bearer xyz"}, true, http.StatusOK},
+		{"DELETE", "/api/person/1", "", map[string]string{"Authorization": "Bearer xyz"}, true, http.StatusOK},
+	}
+	for _, tt := range tests {
+		if got := do(tt.method, tt.path, tt.body, tt.header, tt.cookie); got != tt.want {
+			t.Errorf("%s %s (header: %v, cookie: %v) => %d; want %d", tt.method, tt.path, tt.header, tt.cookie, got, tt.want)
+		}
+	}
+
+	// logging in again gives the session a new token
+	cookie = login(cookie)
+	s.Expect(http.StatusForbidden, do("DELETE", "/api/person/2", "", map[string]string{"X-CSRF-Token": token}, true))
+	token = adminToken(cookie)
+	s.Expect(http.StatusOK, do("DELETE", "/api/person/2", "", map[string]string{"X-CSRF-Token": token}, true))
+
+	// the logged in admin may manage API tokens
+	s.Expect(http.StatusOK, do("GET", "/api/tokens", "", nil, true))
+	s.Expect(http.StatusUnauthorized, do("GET", "/api/tokens", "", nil, false))
+}
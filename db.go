@@ -4,9 +4,9 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
-	"fmt"
+	"io"
 	"io/ioutil"
-	"os"
+	"sort"
 	"sync"
 
 	"github.com/knakk/intset"
@@ -19,24 +19,44 @@ import (
 type DB struct {
 	docs map[int][]byte
 	sync.RWMutex
-	idMax int            // autoincremented ID
-	all   *intset.BitSet // keep an index of all doc IDs
+	idMax   int            // autoincremented ID
+	all     *intset.BitSet // keep an index of all doc IDs
+	indexes []*dbIndex     // secondary indexes, see AddIndex
+	seq     uint64         // of the last change
+	changed map[int]change // the last change to each document, see Changes
+	horizon uint64         // see Compact
 }
 
+// change is the last change to a document.
+type change struct {
+	seq     uint64
+	deleted bool
+}
+
+// ErrNotFound is returned when a document doesn't exist in the database.
+var ErrNotFound = errors.New("document not found")
+
+// doc is a document as dumped to file. Deleted documents are kept as
+// tombstones, without Data.
 type doc struct {
-	ID   int
-	Data json.RawMessage
+	ID      int
+	Seq     uint64          `json:",omitempty"`
+	Deleted bool            `json:",omitempty"`
+	Data    json.RawMessage `json:",omitempty"`
 }
 
 // New returns a new database.
 func New(size int) *DB {
 	return &DB{
-		docs: make(map[int][]byte, size),
-		all:  intset.NewBitSet(0),
+		docs:    make(map[int][]byte, size),
+		all:     intset.NewBitSet(0),
+		changed: make(map[int]change, size),
 	}
 }
 
 // NewFromFile loads db from file into memory and return it as a new database.
+// The sequence numbers of the changes, and the horizon, are kept, if the file
+// has them. Files without them get new ones, in the order of the documents.
 func NewFromFile(fname string) (*DB, error) {
 	b, err := ioutil.ReadFile(fname)
 	if err != nil {
@@ -53,14 +73,33 @@ func NewFromFile(fname string) (*DB, error) {
 	}
 
 	for _, d := range docs {
-		bcopy, err = d.Data.MarshalJSON()
-		if err != nil {
-			return nil, err
+		if d.ID == 0 && d.Deleted {
+			// the horizon, see dump
+			db.horizon = d.Seq
+			continue
+		}
+		if !d.Deleted {
+			bcopy, err = d.Data.MarshalJSON()
+			if err != nil {
+				return nil, err
+			}
+			if err = db.Set(d.ID, &bcopy); err != nil {
+				return nil, err
+			}
+		}
+		db.Lock()
+		if d.Seq > 0 {
+			db.changed[d.ID] = change{d.Seq, d.Deleted}
 		}
-		db.Set(d.ID, &bcopy)
+		if d.Seq > db.seq {
+			db.seq = d.Seq
+		}
+		// IDs of deleted documents are not reused
+		if d.ID > db.idMax {
+			db.idMax = d.ID
+		}
+		db.Unlock()
 	}
-	db.Lock()
-	defer db.Unlock()
 	return db, nil
 }
 
@@ -71,110 +110,231 @@ func (db *DB) Size() int {
 	return db.all.Size()
 }
 
+// IDs returns the IDs of all documents in the database, in ascending order.
+func (db *DB) IDs() []int {
+	db.RLock()
+	defer db.RUnlock()
+	return db.all.All()
+}
+
 // Create inserts a new document into the database. It returns the id of the
-// created document.
-func (db *DB) Create(data *[]byte) int {
+// created document, or an error if a unique index would be violated.
+func (db *DB) Create(data *[]byte) (int, error) {
 	db.Lock()
 	defer db.Unlock()
-	db.idMax++
-	db.docs[db.idMax] = *data
-	db.all.Add(db.idMax)
-	return db.idMax
+	return db.create(*data)
 }
 
 // Get returns a document by a given id.
 func (db *DB) Get(id int) (*[]byte, error) {
 	db.RLock()
 	defer db.RUnlock()
-	if b, ok := db.docs[id]; ok {
+	if b, ok := db.get(id); ok {
 		return &b, nil
 	}
-	return nil, errors.New("document not found")
+	return nil, ErrNotFound
 }
 
 // Set updates a document at a given id. The document does not need to exist.
-func (db *DB) Set(id int, data *[]byte) {
+// It returns an error if a unique index would be violated.
+func (db *DB) Set(id int, data *[]byte) error {
+	db.Lock()
+	defer db.Unlock()
+	return db.set(id, *data)
+}
+
+// Set removes a document. Return false if doc doesn't exist. Otherwise true.
+func (db *DB) Del(id int) bool {
+	db.Lock()
+	defer db.Unlock()
+	return db.del(id)
+}
+
+// Changes returns the last change to each document made after the change
+// numbered seq, in the order they were made, and the number of the last
+// change. Deleted documents are returned as tombstones.
+func (db *DB) Changes(seq uint64) ([]Change, uint64) {
+	db.RLock()
+	defer db.RUnlock()
+	var cs []Change
+	for id, c := range db.changed {
+		if c.seq > seq {
+			cs = append(cs, Change{Seq: c.seq, ID: id, Deleted: c.deleted, Data: db.docs[id]})
+		}
+	}
+	sort.Slice(cs, func(i, j int) bool { return cs[i].Seq < cs[j].Seq })
+	return cs, db.seq
+}
+
+// Compact removes the tombstones of the documents deleted more than keep
+// changes ago, see Store.Compact.
+func (db *DB) Compact(keep uint64) (int, error) {
 	db.Lock()
 	defer db.Unlock()
-	db.docs[id] = *data
+	if db.seq <= keep {
+		return 0, nil
+	}
+	seq, n := db.seq-keep, 0
+	for id, c := range db.changed {
+		if c.deleted && c.seq <= seq && id != db.idMax {
+			delete(db.changed, id)
+			n++
+		}
+	}
+	db.horizon = seq
+	return n, nil
+}
+
+// Horizon returns the horizon of the last Compact, or 0.
+func (db *DB) Horizon() uint64 {
+	db.RLock()
+	defer db.RUnlock()
+	return db.horizon
+}
+
+// Update runs fn in a transaction, see Tx. Readers don't see any of the
+// writes until fn returns, and if fn returns an error, all of them are rolled
+// back.
+func (db *DB) Update(fn func(tx *Tx) error) error {
+	db.Lock()
+	defer db.Unlock()
+	return runTx(db, fn)
+}
+
+// The following methods implement txOps, and must be called with the lock
+// held.
+
+func (db *DB) get(id int) ([]byte, bool) {
+	b, ok := db.docs[id]
+	return b, ok
+}
+
+func (db *DB) create(data []byte) (int, error) {
+	id := db.idMax + 1
+	if err := db.reindex(id, data); err != nil {
+		return 0, err
+	}
+	db.idMax = id
+	db.docs[id] = data
+	db.all.Add(id)
+	db.logChange(id, false)
+	return id, nil
+}
+
+func (db *DB) set(id int, data []byte) error {
+	if err := db.reindex(id, data); err != nil {
+		return err
+	}
+	db.docs[id] = data
 	// Make sure ID is in the set. Needed when a DB is loaded from file.
 	db.all.Add(id)
 	// Always update db.idMax to the highest Id number
 	if id > db.idMax {
 		db.idMax = id
 	}
+	db.logChange(id, false)
+	return nil
 }
 
-// Set removes a document. Return false if doc doesn't exist. Otherwise true.
-func (db *DB) Del(id int) bool {
-	db.Lock()
-	defer db.Unlock()
+func (db *DB) del(id int) bool {
 	if _, ok := db.docs[id]; ok {
 		delete(db.docs, id)
 		db.all.Remove(id)
+		for _, idx := range db.indexes {
+			idx.remove(id)
+		}
+		db.logChange(id, true)
 		return true
 	}
 	return false
 }
 
-// All retuns all the docs in the database as a JSON array, in the form:
-// [{"ID": 1, "Data": {jsonData}},{..},{..}]
-func (db *DB) All() []byte {
-	db.RLock()
-	defer db.RUnlock()
-	if db.Size() == 0 {
-		return []byte("null") // JSON for empty array
+func (db *DB) maxID() int {
+	return db.idMax
+}
+
+func (db *DB) setMaxID(id int) error {
+	db.idMax = id
+	return nil
+}
+
+func (db *DB) logChange(id int, deleted bool) {
+	db.seq++
+	db.changed[id] = change{db.seq, deleted}
+}
+
+func (db *DB) changeOf(id int) (change, bool) {
+	c, ok := db.changed[id]
+	return c, ok
+}
+
+func (db *DB) setChange(id int, c change, ok bool) error {
+	if ok {
+		db.changed[id] = c
+	} else {
+		delete(db.changed, id)
 	}
-	var allDocs bytes.Buffer
-	allDocs.Write([]byte("["))
-	size := db.Size()
-	i := 0
-	for _, k := range db.all.All() {
-		allDocs.Write([]byte(fmt.Sprintf("{\"ID\":%v,\"Data\":", k)))
-		allDocs.Write(db.docs[k])
-		allDocs.Write([]byte("}"))
-		i++
-		if i != size { // to avoid a trailing comma after last doc
-			allDocs.Write([]byte(","))
+	return nil
+}
+
+func (db *DB) lastSeq() uint64 {
+	return db.seq
+}
+
+func (db *DB) setLastSeq(seq uint64) error {
+	db.seq = seq
+	return nil
+}
+
+// Iterate calls fn for each of the documents with the given IDs, in order.
+// IDs not in the database are skipped. The read lock is only held while
+// looking up each document, so fn is free to do slow I/O. Iteration stops at
+// the first error returned by fn.
+func (db *DB) Iterate(ids []int, fn func(id int, data []byte) error) error {
+	for _, id := range ids {
+		db.RLock()
+		b, ok := db.docs[id]
+		db.RUnlock()
+		if !ok {
+			continue
+		}
+		if err := fn(id, b); err != nil {
+			return err
 		}
 	}
-	allDocs.Write([]byte("]"))
-	return allDocs.Bytes()
+	return nil
+}
+
+// WriteSeveral writes the documents with the given IDs to w as a JSON array,
+// in the form:
+// [{"ID": 1, "Data": {jsonData}},{..},{..}]
+// IDs not in the database are skipped.
+func (db *DB) WriteSeveral(w io.Writer, ids []int) error {
+	return writeSeveral(db, w, ids)
+}
+
+// WriteAll writes all the docs in the database to w as a JSON array, in the
+// same form as WriteSeveral.
+func (db *DB) WriteAll(w io.Writer) error {
+	return db.WriteSeveral(w, db.IDs())
+}
+
+// All retuns all the docs in the database as a JSON array, in the form:
+// [{"ID": 1, "Data": {jsonData}},{..},{..}]
+func (db *DB) All() []byte {
+	var b bytes.Buffer
+	db.WriteAll(&b) // writing to a bytes.Buffer never fails
+	return b.Bytes()
 }
 
 // Dump dumps the DB into a file.
 func (db *DB) Dump(fname string) error {
-	f, err := os.Create(fname)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	_, err = f.Write(db.All())
-	return err
+	return dump(db, fname)
 }
 
 // GetSeveral fetches several docs from db, as requested by slice of IDs.
 func (db *DB) GetSeveral(docs []int) []byte {
-	var sevDocs bytes.Buffer
-	if len(docs) == 0 {
-		return []byte("null") // JSON for empty array
-	}
-	sevDocs.Write([]byte("["))
-	db.RLock()
-	defer db.RUnlock()
-	size := len(docs)
-	i := 0
-	for _, k := range docs {
-		if b, ok := db.docs[k]; ok {
-			sevDocs.Write([]byte(fmt.Sprintf("{\"ID\":%v,\"Data\":", k)))
-			sevDocs.Write(b)
-			sevDocs.Write([]byte("}"))
-			i++
-			if i != size { // to avoid a trailing comma after last doc
-				sevDocs.Write([]byte(","))
-			}
-		}
-	}
-	sevDocs.Write([]byte("]"))
-	return sevDocs.Bytes()
+	var b bytes.Buffer
+	db.WriteSeveral(&b, docs) // writing to a bytes.Buffer never fails
+	return b.Bytes()
 }
@@ -7,6 +7,7 @@ import (
 	"io"
 	"os"
 	"testing"
+	"unicode/utf8"
 
 	"github.com/knakk/specs"
 )
@@ -30,7 +31,8 @@ func TestCRUD(t *testing.T) {
 	// create doc
 	book, err := json.Marshal(Book{"Knut Hamsun", "Sult", 1890})
 	s.ExpectNilFatal(err)
-	id := db.Create(&book)
+	id, err := db.Create(&book)
+	s.ExpectNilFatal(err)
 	s.Expect(db.Size(), 1)
 	s.ExpectNot(id, 0)
 
@@ -47,7 +49,8 @@ func TestCRUD(t *testing.T) {
 	// update (set) doc
 	book2, err := json.Marshal(Book{"Knut Hamsun", "Pan", 1994})
 	s.ExpectNilFatal(err)
-	id2 := db.Create(&book2)
+	id2, err := db.Create(&book2)
+	s.ExpectNilFatal(err)
 	book3, err := json.Marshal(Book{"Knut Hamsun", "Pan", 1894})
 	s.ExpectNilFatal(err)
 	db.Set(id2, &book3)
@@ -59,7 +62,8 @@ func TestCRUD(t *testing.T) {
 	// delete
 	book4, err := json.Marshal(Book{"abc", "xyz", 1999})
 	s.ExpectNilFatal(err)
-	id3 := db.Create(&book4)
+	id3, err := db.Create(&book4)
+	s.ExpectNilFatal(err)
 	s.Expect(db.Size(), 3)
 	db.Del(id3)
 	s.Expect(db.Size(), 2)
@@ -111,3 +115,128 @@ func TestCRUD(t *testing.T) {
 	s.ExpectNilFatal(err)
 
 }
+
+func TestGetSeveralMissing(t *testing.T) {
+	s := specs.New(t)
+	db := New(8)
+	s.Expect("[]", string(db.All()))
+	s.Expect("[]", string(db.GetSeveral(nil)))
+
+	book, err := json.Marshal(Book{"Knut Hamsun", "Sult", 1890})
+	s.ExpectNilFatal(err)
+	id, err := db.Create(&book)
+	s.ExpectNilFatal(err)
+	s.Expect("[]", string(db.GetSeveral([]int{99})))
+
+	// missing IDs must not leave a trailing comma
+	sev := db.GetSeveral([]int{id, 99})
+	s.Expect(`[{"ID":1,"Data":{"Author":"Knut Hamsun","Title":"Sult","Issued":1890}}]`, string(sev))
+}
+
+func FuzzWriteSeveral(f *testing.F) {
+	f.Add("Knut Hamsun", []byte{1, 2, 3})
+	f.Add("", []byte{})
+	f.Add(`"}],{`, []byte{0, 3, 3, 1, 7})
+	f.Fuzz(func(t *testing.T, author string, ids []byte) {
+		if !utf8.ValidString(author) {
+			t.Skip() // encoding/json replaces invalid UTF-8
+		}
+		db := New(8)
+		for i := 0; i < 5; i++ {
+			b, err := json.Marshal(Book{author, "Sult", i})
+			if err != nil {
+				t.Fatal(err)
+			}
+			db.Create(&b)
+		}
+		db.Del(3)
+
+		var (
+			req   []int
+			found int
+		)
+		for _, id := range ids {
+			req = append(req, int(id%8))
+			if _, err := db.Get(int(id % 8)); err == nil {
+				found++
+			}
+		}
+
+		for _, b := range [][]byte{db.GetSeveral(req), db.All()} {
+			if !json.Valid(b) {
+				t.Fatalf("invalid JSON: %s", b)
+			}
+		}
+		var docs []struct {
+			ID   int
+			Data Book
+		}
+		if err := json.Unmarshal(db.GetSeveral(req), &docs); err != nil {
+			t.Fatal(err)
+		}
+		if len(docs) != found {
+			t.Fatalf("got %d docs, want %d", len(docs), found)
+		}
+		for i, d := range docs {
+			if d.Data.Author != author {
+				t.Fatalf("doc %d: got author %q, want %q", i, d.Data.Author, author)
+			}
+		}
+	})
+}
+
+func TestSecondaryIndex(t *testing.T) {
+	s := specs.New(t)
+	db := New(8)
+	byAuthor := func(b []byte) (string, bool) {
+		var book Book
+		if err := json.Unmarshal(b, &book); err != nil || book.Author == "" {
+			return "", false
+		}
+		return book.Author, true
+	}
+	byTitle := func(b []byte) (string, bool) {
+		var book Book
+		if err := json.Unmarshal(b, &book); err != nil {
+			return "", false
+		}
+		return book.Title, true
+	}
+
+	sult, _ := json.Marshal(Book{"Knut Hamsun", "Sult", 1890})
+	id1, err := db.Create(&sult)
+	s.ExpectNilFatal(err)
+	s.ExpectNilFatal(db.AddIndex("author", false, byAuthor))
+	s.ExpectNilFatal(db.AddIndex("title", true, byTitle))
+	s.Expect([]int{id1}, db.Lookup("author", "Knut Hamsun"))
+
+	pan, _ := json.Marshal(Book{"Knut Hamsun", "Pan", 1894})
+	id2, err := db.Create(&pan)
+	s.ExpectNilFatal(err)
+	s.Expect([]int{id1, id2}, db.Lookup("author", "Knut Hamsun"))
+	s.Expect([]int{id2}, db.Lookup("title", "Pan"))
+
+	// unique index stops duplicates on create and set
+	pan2, _ := json.Marshal(Book{"Someone Else", "Pan", 2001})
+	_, err = db.Create(&pan2)
+	s.Expect(&UniqueError{"title", "Pan"}, err)
+	s.Expect(2, db.Size())
+	s.Expect(&UniqueError{"title", "Pan"}, db.Set(id1, &pan2))
+	s.Expect([]int{id1}, db.Lookup("title", "Sult"))
+	s.Expect(0, len(db.Lookup("author", "Someone Else")))
+
+	// setting a document to its own key is fine, and moves it in other indexes
+	s.ExpectNilFatal(db.Set(id2, &pan2))
+	s.Expect([]int{id1}, db.Lookup("author", "Knut Hamsun"))
+	s.Expect([]int{id2}, db.Lookup("author", "Someone Else"))
+
+	// delete removes from all indexes
+	s.Expect(true, db.Del(id2))
+	s.Expect(0, len(db.Lookup("title", "Pan")))
+	s.Expect(0, len(db.Lookup("author", "Someone Else")))
+	_, err = db.Create(&pan)
+	s.ExpectNilFatal(err)
+
+	// existing duplicates are reported when adding a unique index
+	s.Expect(&UniqueError{"issued", "Knut Hamsun"}, db.AddIndex("issued", true, byAuthor))
+}
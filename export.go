@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// exportPerson is a person as exported, with the department name resolved.
+type exportPerson struct {
+	ID           int
+	Name         string
+	Role         string
+	Department   string
+	DepartmentID int
+	Email        string
+	Phone        string
+	Img          string
+	Info         string
+}
+
+var exportHeader = []string{
+	"ID", "Name", "Role", "Department", "DepartmentID", "Email", "Phone", "Img", "Info"}
+
+func (p exportPerson) record() []string {
+	return []string{
+		strconv.Itoa(p.ID), p.Name, p.Role, p.Department, strconv.Itoa(p.DepartmentID),
+		p.Email, p.Phone, p.Img, p.Info}
+}
+
+// exportContentTypes maps the supported export formats to their content type.
+var exportContentTypes = map[string]string{
+	"csv":    "text/csv; charset=utf-8",
+	"json":   "application/json; charset=utf-8",
+	"ndjson": "application/x-ndjson",
+}
+
+// inDepartment returns true if the department d is, or is a subdepartment of,
+// the department with ID id.
+func (app *App) inDepartment(d, id int) bool {
+	return d == id || app.mapDepartments[d].Parent == id
+}
+
+// exportWriter writes persons in one of the export formats.
+type exportWriter interface {
+	Write(p exportPerson) error
+	Close() error
+}
+
+type csvExporter struct{ w *csv.Writer }
+
+func (e *csvExporter) Write(p exportPerson) error { return e.w.Write(p.record()) }
+
+func (e *csvExporter) Close() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+type jsonExporter struct {
+	w     io.Writer
+	first bool
+}
+
+func (e *jsonExporter) Write(p exportPerson) error {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	sep := ","
+	if e.first {
+		sep = "["
+		e.first = false
+	}
+	_, err = fmt.Fprintf(e.w, "%s\n%s", sep, b)
+	return err
+}
+
+func (e *jsonExporter) Close() error {
+	var err error
+	if e.first {
+		_, err = io.WriteString(e.w, "[]\n")
+	} else {
+		_, err = io.WriteString(e.w, "\n]\n")
+	}
+	return err
+}
+
+type ndjsonExporter struct{ enc *json.Encoder }
+
+func (e *ndjsonExporter) Write(p exportPerson) error { return e.enc.Encode(p) }
+func (e *ndjsonExporter) Close() error               { return nil }
+
+func newExportWriter(w io.Writer, format string) (exportWriter, error) {
+	switch format {
+	case "csv":
+		cw := csv.NewWriter(w)
+		return &csvExporter{cw}, cw.Write(exportHeader)
+	case "json":
+		return &jsonExporter{w: w, first: true}, nil
+	case "ndjson":
+		return &ndjsonExporter{json.NewEncoder(w)}, nil
+	}
+	return nil, fmt.Errorf("unknown export format: %q", format)
+}
+
+// exportPersons writes all persons in the given format to w, one at a time,
+// so the whole export is never held in memory. If dept is not 0, only persons
+// in that department or its subdepartments are exported.
+func (app *App) exportPersons(w io.Writer, format string, dept int) error {
+	ew, err := newExportWriter(w, format)
+	if err != nil {
+		return err
+	}
+	err = app.persons.Iterate(func(id int, p person) error {
+		if dept != 0 && !app.inDepartment(p.Department, dept) {
+			return nil
+		}
+		return ew.Write(exportPerson{
+			ID:           id,
+			Name:         p.Name,
+			Role:         p.Role,
+			Department:   app.mapDepartments[p.Department].Name,
+			DepartmentID: p.Department,
+			Email:        p.Email,
+			Phone:        p.Phone,
+			Img:          p.Img,
+			Info:         p.Info,
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return ew.Close()
+}
+
+// GET /export?format=csv|json|ndjson&dept=x
+func (app *App) exportHandler(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+	ct, ok := exportContentTypes[format]
+	if !ok {
+		http.Error(w, "format must be one of: csv, json, ndjson", http.StatusBadRequest)
+		return
+	}
+	var dept int
+	if d := r.URL.Query().Get("dept"); d != "" {
+		var err error
+		if dept, err = app.lookupDepartment(d); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", ct)
+	w.Header().Set("Content-Disposition", "attachment; filename=\"folk."+format+"\"")
+	if err := app.exportPersons(w, format, dept); err != nil {
+		// Too late to change the status code, the response is already
+		// partially written.
+		app.logError(r.Header, "export failed: %v", err)
+	}
+}
+
+// exportCmd implements the export subcommand:
+//
+//	folk export [-format csv|json|ndjson] [-dept x] [-o file]
+func (app *App) exportCmd(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	format := fs.String("format", "csv", "export format: csv, json or ndjson")
+	deptName := fs.String("dept", "", "only export this department (ID or name)")
+	out := fs.String("o", "", "write to this file instead of stdout")
+	fs.Parse(args)
+
+	var dept int
+	if *deptName != "" {
+		var err error
+		if dept, err = app.lookupDepartment(*deptName); err != nil {
+			log.Fatal(err)
+		}
+	}
+	w := os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := app.exportPersons(w, *format, dept); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/knakk/specs"
+)
+
+func setupExportTest(t *testing.T) *App {
+	app := newTestApp(t,
+		dept{1, "Hovedbiblioteket", 0},
+		dept{2, "Økonomi", 1},
+		dept{3, "Filialer", 0},
+	)
+
+	for _, p := range []person{
+		{Name: "Åse Ødegård", Department: 2, Email: "ase@example.com", Role: "Rådgiver, økonomi"},
+		{Name: "Bjørn", Department: 3, Email: "bjorn@example.com"},
+		{Name: "Carl", Department: 1, Email: "carl@example.com", Info: "line one\nline two"},
+	} {
+		app.persons.Create(p)
+	}
+	return app
+}
+
+func TestExportFormats(t *testing.T) {
+	app := setupExportTest(t)
+	s := specs.New(t)
+
+	// csv
+	var buf bytes.Buffer
+	s.ExpectNilFatal(app.exportPersons(&buf, "csv", 0))
+	records, err := csv.NewReader(&buf).ReadAll()
+	s.ExpectNilFatal(err)
+	s.Expect(4, len(records))
+	s.Expect(exportHeader, records[0])
+	s.Expect([]string{"1", "Åse Ødegård", "Rådgiver, økonomi", "Økonomi", "2", "ase@example.com", "", "", ""}, records[1])
+	s.Expect("line one\nline two", records[3][8])
+
+	// json
+	buf.Reset()
+	s.ExpectNilFatal(app.exportPersons(&buf, "json", 0))
+	var all []exportPerson
+	s.ExpectNilFatal(json.Unmarshal(buf.Bytes(), &all))
+	s.Expect(3, len(all))
+	s.Expect("Filialer", all[1].Department)
+	s.Expect(3, all[1].DepartmentID)
+
+	// ndjson
+	buf.Reset()
+	s.ExpectNilFatal(app.exportPersons(&buf, "ndjson", 0))
+	sc := bufio.NewScanner(&buf)
+	n := 0
+	for sc.Scan() {
+		var p exportPerson
+		s.ExpectNilFatal(json.Unmarshal(sc.Bytes(), &p))
+		n++
+		s.Expect(n, p.ID)
+	}
+	s.Expect(3, n)
+
+	// department filter includes subdepartments
+	buf.Reset()
+	s.ExpectNilFatal(app.exportPersons(&buf, "json", 1))
+	s.ExpectNilFatal(json.Unmarshal(buf.Bytes(), &all))
+	s.Expect(2, len(all))
+	s.Expect("Åse Ødegård", all[0].Name)
+	s.Expect("Carl", all[1].Name)
+
+	// empty export is still valid JSON
+	app.persons = newPersonStore(New(0))
+	buf.Reset()
+	s.ExpectNilFatal(app.exportPersons(&buf, "json", 0))
+	s.ExpectNilFatal(json.Unmarshal(buf.Bytes(), &all))
+	s.Expect(0, len(all))
+
+	s.ExpectNot(nil, app.exportPersons(&buf, "xml", 0))
+}
+
+func TestExportAPI(t *testing.T) {
+	app := setupExportTest(t)
+	s := specs.New(t)
+	testServer := httptest.NewServer(app.apiMux)
+	defer testServer.Close()
+
+	var tests = []struct {
+		url         string
+		respCode    int
+		contentType string
+		bodyMatch   string
+	}{
+		{"/export", 200, "application/json; charset=utf-8", `"Department":"Økonomi"`},
+		{"/export?format=csv", 200, "text/csv; charset=utf-8", `^ID,Name,Role`},
+		{"/export?format=ndjson&dept=Filialer", 200, "application/x-ndjson", `^{"ID":2,"Name":"Bjørn"[^\n]*\n$`},
+		{"/export?format=xml", 400, "text/plain; charset=utf-8", "format must be one of"},
+		{"/export?dept=99", 400, "text/plain; charset=utf-8", "department 99 doesn't exist"},
+	}
+
+	for _, tt := range tests {
+		resp, err := http.Get(testServer.URL + tt.url)
+		s.ExpectNilFatal(err)
+		body, err := ioutil.ReadAll(resp.Body)
+		s.ExpectNilFatal(err)
+		resp.Body.Close()
+		s.Expect(tt.respCode, resp.StatusCode)
+		s.Expect(tt.contentType, resp.Header.Get("Content-Type"))
+		s.ExpectMatches(string(body), tt.bodyMatch)
+	}
+}
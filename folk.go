@@ -1,50 +1,36 @@
 package main
 
 import (
-	"encoding/json"
 	"flag"
 	"fmt"
-	"html/template"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"path/filepath"
 	"regexp"
-	"sync"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
-	"github.com/gorilla/securecookie"
 	"github.com/gorilla/sessions"
-	"github.com/knakk/ftx"
 	"github.com/rcrowley/go-tigertonic"
 
 	//"github.com/davecheney/profile"
 )
 
-const MAX_MEM_SIZE = 2 * 1024 * 1024 // 2 MB
-
-var (
-	templates = template.Must(template.ParseFiles(
-		"data/html/folk.html",
-		"data/html/admin.html",
-		"data/html/login.html"))
-	mux                *tigertonic.TrieServeMux
-	persons            *DB
-	departments        []depts
-	mapDepartments     = make(map[int]dept)
-	err                error
-	store              *sessions.CookieStore
-	username, password *string
-	imageFileNames     = regexp.MustCompile(`(\.png|\.jpg|\.jpeg)$`)
-	folkSaver          *saver
-	analyzer           *ftx.Analyzer
-)
+var imageFileNames = regexp.MustCompile(`(\.png|\.jpg|\.jpeg)$`)
 
 type dept struct {
-	ID     int
+	ID     int `json:"-"`
 	Name   string
 	Parent int
 }
 
+func (d *dept) setID(id int) { d.ID = id }
+
 type depts struct {
 	ID     int
 	Name   string
@@ -52,15 +38,8 @@ type depts struct {
 	Depts  []dept
 }
 
-type dbPerson struct {
-	ID   int
-	Data person
-}
-
-type allPersons []dbPerson
-
 type person struct {
-	ID         int
+	ID         int `json:"-"`
 	Name       string
 	Role       string
 	Department int
@@ -68,47 +47,75 @@ type person struct {
 	Img        string
 	Phone      string
 	Info       string
+	// LDAPDN is the DN of the person in LDAP, if synced from it.
+	LDAPDN string `json:",omitempty"`
+	// GoneFromLDAP flags a synced person who is no longer in LDAP.
+	GoneFromLDAP bool `json:",omitempty"`
+	// Inactive flags a person deactivated by SCIM provisioning.
+	Inactive bool `json:",omitempty"`
+}
+
+func (p *person) setID(id int) { p.ID = id }
+
+// searchText returns the text to index for a person.
+func (app *App) searchText(p person) string {
+	return fmt.Sprintf("%v %v %v %v",
+		p.Name, app.mapDepartments[p.Department].Name, p.Role, p.Info)
 }
 
-// saver saves the db after X edits has ben made
-type saver struct {
-	sync.Mutex
-	db    *DB
-	file  string
-	count int
-	max   int
+// index adds a person to the search index.
+func (app *App) index(id int, p person) {
+	app.analyzer.Index(app.searchText(p), id)
+	atomic.AddInt64(&app.indexed, 1)
 }
 
-func (s *saver) Inc() {
-	s.Lock()
-	defer s.Unlock()
-	s.count++
-	if s.count == s.max {
-		log.Printf("Saving db: %s", s.file)
-		err := s.db.Dump(s.file)
-		if err != nil {
-			log.Println(err)
-		}
-		s.count = 0
+// unindex removes a person, as it was indexed, from the search index.
+func (app *App) unindex(id int, p person) {
+	app.analyzer.UnIndex(app.searchText(p), id)
+	atomic.AddInt64(&app.indexed, -1)
+}
+
+// emailKey normalises an email address for lookup in the email index.
+func emailKey(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// newPersonStore returns a store of persons backed by db, with a unique
+// index on email and an index on department.
+func newPersonStore(db Store) *TypedStore[person] {
+	s := NewTypedStore[person](db)
+	err := s.AddIndex("email", true, func(p person) string {
+		return emailKey(p.Email)
+	})
+	if err != nil {
+		log.Printf("duplicate emails in person database: %v", err)
 	}
+	s.AddIndex("department", false, func(p person) string {
+		return strconv.Itoa(p.Department)
+	})
+	return s
 }
 
-func deptHierarchy(db *DB) []depts {
-	var (
-		r   []depts
-		d   dept
-		max = db.Size()
-	)
-	for i := 0; i <= max; i++ {
-		data, err := db.Get(i)
-		if err != nil {
-			continue
+// departmentByName returns the department with the given name, ignoring case.
+// If several departments have the name, the first in the hierarchy is
+// returned.
+func (app *App) departmentByName(name string) (int, bool) {
+	for _, d := range app.departments {
+		if strings.EqualFold(d.Name, name) {
+			return d.ID, true
 		}
-		err = json.Unmarshal(*data, &d)
-		if err != nil {
-			continue
+		for _, dd := range d.Depts {
+			if strings.EqualFold(dd.Name, name) {
+				return dd.ID, true
+			}
 		}
-		d.ID = i
+	}
+	return 0, false
+}
+
+func deptHierarchy(s *TypedStore[dept]) []depts {
+	var r []depts
+	s.Iterate(func(id int, d dept) error {
 		if d.Parent == 0 {
 			r = append(r, depts{d.ID, d.Name, d.Parent, make([]dept, 0)})
 		} else {
@@ -119,36 +126,32 @@ func deptHierarchy(db *DB) []depts {
 				}
 			}
 		}
-	}
+		return nil
+	})
 	return r
 }
 
 // Handlers:
 
-func mainHandler(w http.ResponseWriter, r *http.Request) {
+func (app *App) mainHandler(w http.ResponseWriter, r *http.Request) {
 	data := struct {
 		Departments []depts
 	}{
-		departments,
+		app.departments,
 	}
-	err := templates.ExecuteTemplate(w, "folk.html", data)
+	err := app.templates.ExecuteTemplate(w, "folk.html", data)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
-func adminHandler(w http.ResponseWriter, r *http.Request) {
-	// session, err := store.Get(r, "folke_sjef")
-	// if err != nil {
-	// 	// cookie found, but couldn't decode it
-	// 	log.Printf("%v", err)
-	// }
-	// if session.IsNew {
-	// 	loginHandler(w, r)
-	// 	return
-	// }
+func (app *App) adminHandler(w http.ResponseWriter, r *http.Request) {
+	if app.sessionUser(r) == "" {
+		app.loginHandler(w, r)
+		return
+	}
 	var imageFiles []string
-	files, err := ioutil.ReadDir("./data/img/")
+	files, err := ioutil.ReadDir(app.dataPath("img"))
 	if err == nil {
 		for _, f := range files {
 			if imageFileNames.MatchString(f.Name()) {
@@ -157,70 +160,158 @@ func adminHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	session := app.createSession(r)
+	token, created := csrfToken(session)
+	if created {
+		if err := session.Save(r, w); err != nil {
+			app.logError(r.Header, "failed to save session: %v", err)
+		}
+	}
+
 	data := struct {
 		Departments []depts
 		Images      []string
 		NumFolks    int
+		CSRFToken   string
 	}{
-		departments,
+		app.departments,
 		imageFiles,
-		persons.Size(),
+		app.persons.Size(),
+		token,
 	}
-	err = templates.ExecuteTemplate(w, "admin.html", data)
+	err = app.templates.ExecuteTemplate(w, "admin.html", data)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
-func loginHandler(w http.ResponseWriter, r *http.Request) {
-	err = templates.ExecuteTemplate(w, "login.html", nil)
+func (app *App) loginHandler(w http.ResponseWriter, r *http.Request) {
+	data := struct {
+		OIDC bool
+	}{
+		app.oidc != nil,
+	}
+	err := app.templates.ExecuteTemplate(w, "login.html", data)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
-func authHandler(w http.ResponseWriter, r *http.Request) {
+func (app *App) authHandler(w http.ResponseWriter, r *http.Request) {
 	u := r.FormValue("username")
 	p := r.FormValue("password")
-	if u == *username && p == *password {
-		session := createSession(r)
+	ip := clientIP(r, app.trustedProxies)
+	if wait := app.authLimits.check(ip, u); wait > 0 {
+		tooManyRequests(w, wait, "for mange forsøk, prøv igjen senere")
+		return
+	}
+	if credentialsMatch(u, p, app.cfg.Username, app.cfg.Password) {
+		app.authLimits.succeeded(ip, u)
+		session := app.createSession(r)
+		session.Values["user"] = u
+		session.Values["role"] = scopeAdmin
+		// a new CSRF token for the new login
+		session.Values["csrf"] = newToken()
 		err := session.Save(r, w)
 		if err != nil {
-			log.Printf("%v", err)
+			app.logError(r.Header, "failed to save session: %v", err)
+		}
+		if info := requestInfoFrom(r); info != nil {
+			info.user = u
 		}
 		fmt.Fprint(w, "OK")
 		return
 	}
+	app.authLimits.failed(ip, u)
 	http.Error(w, "feil brukernavn eller passord", http.StatusUnauthorized)
 }
 
-func createSession(r *http.Request) *sessions.Session {
-	session, err := store.Get(r, "folke_sjef")
+func (app *App) createSession(r *http.Request) *sessions.Session {
+	session, err := app.sessions.Get(r, sessionName)
 	if err != nil {
-		log.Printf("%v", err)
-	}
-	if session.IsNew {
-		session.Options.Path = "/admin"
-		session.Options.MaxAge = 0
-		session.Options.HttpOnly = false
-		session.Options.Secure = true
+		app.logError(r.Header, "failed to decode session: %v", err)
 	}
+	// set every time, as a decoded session gets the default options. The
+	// cookie is sent to /api and /upload too, so writes made with it are
+	// checked for the CSRF token.
+	session.Options = &sessions.Options{Path: "/", MaxAge: 0, HttpOnly: true, Secure: true}
 	return session
 }
 
-// uploadHandler upload image files to the folder /data/img/
-func uploadHandler(w http.ResponseWriter, r *http.Request) {
-	if err := r.ParseMultipartForm(MAX_MEM_SIZE); err != nil {
-		log.Println(err)
+// sessionUser returns the user logged in with the session cookie, if any.
+func (app *App) sessionUser(r *http.Request) string {
+	session, err := app.sessions.Get(r, sessionName)
+	if err != nil {
+		return ""
+	}
+	u, _ := session.Values["user"].(string)
+	return u
+}
+
+// sessionRole returns the role of the user logged in with the session cookie,
+// named as the token scopes, or "".
+func (app *App) sessionRole(r *http.Request) string {
+	session, err := app.sessions.Get(r, sessionName)
+	if err != nil {
+		return ""
+	}
+	role, _ := session.Values["role"].(string)
+	return role
+}
+
+// uploadImageTypes maps the extensions of the images which can be uploaded
+// to their content type, which the content must have too.
+var uploadImageTypes = map[string]string{
+	".png":  "image/png",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".gif":  "image/gif",
+}
+
+// uploadHandler upload image files to the folder img/ in the data directory.
+// Only PNG, JPEG and GIF images are accepted, as the files are served from
+// the same origin.
+func (app *App) uploadHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseMultipartForm(app.cfg.MaxUploadSize); err != nil {
+		app.logError(r.Header, "POST /upload: %v", err)
 		http.Error(w, err.Error(), http.StatusForbidden)
+		return
 	}
 
+	type upload struct {
+		name string
+		data []byte
+	}
+	var uploads []upload
 	for _, fileHeaders := range r.MultipartForm.File {
 		for _, fileHeader := range fileHeaders {
-			file, _ := fileHeader.Open()
-			path := fmt.Sprintf("data/img/%s", fileHeader.Filename)
-			buf, _ := ioutil.ReadAll(file)
-			ioutil.WriteFile(path, buf, os.ModePerm)
+			name := filepath.Base(fileHeader.Filename)
+			file, err := fileHeader.Open()
+			if err != nil {
+				app.logError(r.Header, "POST /upload: %v", err)
+				http.Error(w, "kunne ikke lese filen", http.StatusBadRequest)
+				return
+			}
+			buf, err := ioutil.ReadAll(file)
+			file.Close()
+			if err != nil {
+				app.logError(r.Header, "POST /upload: %v", err)
+				http.Error(w, "kunne ikke lese filen", http.StatusBadRequest)
+				return
+			}
+			ct, ok := uploadImageTypes[strings.ToLower(filepath.Ext(name))]
+			if !ok || http.DetectContentType(buf) != ct {
+				http.Error(w, "bare bilder i PNG, JPEG eller GIF kan lastes opp", http.StatusBadRequest)
+				return
+			}
+			uploads = append(uploads, upload{name, buf})
+		}
+	}
+	for _, u := range uploads {
+		if err := ioutil.WriteFile(filepath.Join(app.dataPath("img"), u.name), u.data, 0644); err != nil {
+			app.logError(r.Header, "POST /upload: %v", err)
+			http.Error(w, "kunne ikke lagre filen", http.StatusInternalServerError)
+			return
 		}
 	}
 }
@@ -233,93 +324,254 @@ func serveFile(filename string) func(w http.ResponseWriter, r *http.Request) {
 }
 
 // indexDB indexes all searchable fields in the person database.
-func indexDB(db *DB, a *ftx.Analyzer) {
-	all := db.All()
-	var allp allPersons
-	err = json.Unmarshal(all, &allp)
+func (app *App) indexDB() {
+	err := app.persons.Iterate(func(id int, p person) error {
+		app.index(id, p)
+		return nil
+	})
 	if err != nil {
 		log.Println(err)
-		return
-	}
-	for _, p := range allp {
-		//fmt.Printf("%v: %v %v\n", p.ID, p.Data.Name, mapDepartments[p.Data.Department].Name)
-		a.Index(fmt.Sprintf("%v %v %v %v",
-			p.Data.Name, mapDepartments[p.Data.Department].Name, p.Data.Role, p.Data.Info), p.ID)
 	}
 }
 
-func init() {
-	// Search Analyzer & index
-	analyzer = ftx.NewNGramAnalyzer(1, 20)
+// openPersons opens the person database in dir. kind is either "memory", for
+// the in-memory DB saved as JSON in folk.db, or "bolt", for a BoltDB in
+// folk.bolt. A new bolt database is populated from folk.db, if it exists.
+//
+// If folk.db exists but can't be loaded into the in-memory DB, an empty DB is
+// returned, and the reason is returned as loadErr.
+func openPersons(dir, kind string) (db Store, loadErr error, err error) {
+	jsonFile := filepath.Join(dir, "folk.db")
+	boltFile := filepath.Join(dir, "folk.bolt")
+	switch kind {
+	case "memory":
+		db, err := NewFromFile(jsonFile)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				loadErr = err
+			}
+			log.Println(err)
+			db = New(256)
+		}
+		return db, loadErr, nil
+	case "bolt":
+		db, err := OpenBolt(boltFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		if db.Size() == 0 {
+			if old, err := NewFromFile(jsonFile); err == nil {
+				log.Printf("Importing %s into %s", jsonFile, boltFile)
+				if err := copyStore(db, old); err != nil {
+					db.Close()
+					return nil, nil, err
+				}
+			}
+		}
+		return db, nil, nil
+	}
+	return nil, nil, fmt.Errorf("unknown store: %q", kind)
+}
 
+// loadData loads the department, person and API token databases, and indexes
+// the persons for search. Databases which exist but fail to load are recorded in
+// app.loadErrs, and reported by /readyz.
+func (app *App) loadData() error {
 	// load department db
-	deptsdb, err := NewFromFile("data/avd.db")
+	deptsdb, err := NewFromFile(app.dataPath("avd.db"))
 	if err == nil {
-		departments = deptHierarchy(deptsdb)
-		for _, d := range departments {
-			mapDepartments[d.ID] = dept{d.ID, d.Name, d.Parent}
+		app.departments = deptHierarchy(NewTypedStore[dept](deptsdb))
+		for _, d := range app.departments {
+			app.mapDepartments[d.ID] = dept{d.ID, d.Name, d.Parent}
 			for _, dd := range d.Depts {
-				mapDepartments[dd.ID] = dept{dd.ID, dd.Name, dd.Parent}
+				app.mapDepartments[dd.ID] = dept{dd.ID, dd.Name, dd.Parent}
 			}
 		}
+	} else if !os.IsNotExist(err) {
+		log.Println(err)
+		app.loadErrs = append(app.loadErrs, err)
 	}
 
 	// Load person DB or create new if it doesn't exist
-	persons, err = NewFromFile("data/folk.db")
+	personsdb, loadErr, err := openPersons(app.cfg.DataDir, app.cfg.Store)
 	if err != nil {
-		log.Println(err)
-		persons = New(256)
+		return err
 	}
-	indexDB(persons, analyzer)
+	if loadErr != nil {
+		app.loadErrs = append(app.loadErrs, loadErr)
+	}
+	app.persons = newPersonStore(personsdb)
+	app.indexDB()
+
+	// Save DB to disk every SaveEvery edits, or SaveInterval seconds after an
+	// edit. With the bolt store every edit is already persisted, and this is
+	// a JSON backup.
+	app.saver = newSaver(personsdb, app.dataPath("folk.db"), app.cfg.SaveEvery,
+		time.Duration(app.cfg.SaveInterval)*time.Second)
+
+	// load API tokens, webhooks and the webhook delivery log
+	var tokensdb, webhooksdb, deliveriesdb Store
+	tokensdb, app.tokenSaver = app.loadAux("tokens.db")
+	app.tokens = newTokenStore(tokensdb)
+	webhooksdb, app.webhookSaver = app.loadAux("webhooks.db")
+	app.webhooks = newWebhookStore(webhooksdb)
+	deliveriesdb, app.deliverySaver = app.loadAux("deliveries.db")
+	app.deliveries = newDeliveryStore(deliveriesdb)
+	app.dispatcher = newWebhookDispatcher(app.cfg)
+	app.changes = newChangeFeed(app.cfg.ChangeBufferSize)
+	return nil
+}
 
-	// Save DB to disk every 15 edits
-	folkSaver = &saver{db: persons, file: "./data/folk.db", max: 15}
+// loadAux loads the database file name in the data directory, or starts an
+// empty one if there is none, and returns it with its saver.
+func (app *App) loadAux(name string) (Store, *saver) {
+	db, err := NewFromFile(app.dataPath(name))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println(err)
+			app.loadErrs = append(app.loadErrs, err)
+		}
+		db = New(16)
+	}
+	return db, newSaver(db, app.dataPath(name), app.cfg.SaveEvery,
+		time.Duration(app.cfg.SaveInterval)*time.Second)
+}
 
-	// HTTP routing
-	mux = tigertonic.NewTrieServeMux()
-	mux.HandleFunc(
+// setupRouting sets up the HTTP routing of the web interface, with the API
+// under /api and SCIM provisioning under /scim/v2.
+func (app *App) setupRouting() {
+	app.mux = tigertonic.NewTrieServeMux()
+	web := router{app, app.mux, ""}
+	web.Handle(
 		"POST",
 		"/upload",
-		uploadHandler)
-	mux.HandleFunc(
+		app.limitWrites(app.requireScope(scopePersonsWrite, app.checkCSRF(http.HandlerFunc(app.uploadHandler)))))
+	web.HandleFunc(
 		"GET",
 		"/",
-		mainHandler)
-	mux.HandleFunc(
+		app.mainHandler)
+	web.HandleFunc(
 		"POST",
 		"/authenticate",
-		authHandler)
-	mux.HandleFunc(
+		app.authHandler)
+	web.HandleFunc(
 		"GET",
 		"/admin",
-		adminHandler)
-	mux.HandleFunc(
+		app.adminHandler)
+	web.HandleFunc(
 		"GET",
 		"/robots.txt",
-		serveFile("data/robots.txt"))
-	mux.HandleFunc(
+		serveFile(app.assetPath("robots.txt")))
+	web.HandleFunc(
 		"GET",
 		"/css/styles.css",
-		serveFile("data/css/styles.css"))
+		serveFile(app.assetPath("css/styles.css")))
+
+	web.HandleFunc(
+		"GET",
+		"/healthz",
+		app.healthzHandler)
+	web.HandleFunc(
+		"GET",
+		"/readyz",
+		app.readyzHandler)
+	web.HandleFunc(
+		"GET",
+		"/metrics",
+		app.metricsHandler)
+
+	if app.oidc != nil {
+		web.HandleFunc(
+			"GET",
+			"/oidc/login",
+			app.oidcLoginHandler)
+		web.HandleFunc(
+			"GET",
+			"/oidc/callback",
+			app.oidcCallbackHandler)
+	}
+
+	app.mux.HandleNamespace("/data/img", app.instrument("GET", "/data/img",
+		http.FileServer(http.Dir(app.dataPath("img")))))
 
-	mux.HandleNamespace("/data/img", http.FileServer(http.Dir("data/img/")))
+	app.setupAPIRouting()
+	app.mux.HandleNamespace("/api", app.limitWrites(app.authenticate(app.checkCSRF(app.apiMux))))
 
-	setupAPIRouting() // apiMux
-	mux.HandleNamespace("/api", apiMux)
+	app.setupSCIMRouting()
+	app.mux.HandleNamespace("/scim/v2", app.limitWrites(app.scimAuth(app.scimMux)))
 
+	web.HandleFunc(
+		"GET",
+		"/graphql",
+		app.graphqlHandler)
+	web.HandleFunc(
+		"POST",
+		"/graphql",
+		app.graphqlHandler)
+}
+
+func init() {
 	tigertonic.SnakeCaseHTTPEquivErrors = true
 }
 
 func main() {
 	//defer profile.Start(profile.CPUProfile).Stop()
-	port := flag.String("port", "9999", "serve from this port")
-	username = flag.String("u", "admin", "admin username")
-	password = flag.String("p", "secret", "admin password")
+	configFile := flag.String("config", os.Getenv("FOLK_CONFIG"), "JSON config file")
+	port := flag.String("port", "", "serve from this port")
+	username := flag.String("u", "", "admin username")
+	password := flag.String("p", "", "admin password")
+	storeKind := flag.String("store", "", "person database: memory (data/folk.db) or bolt (data/folk.bolt)")
 
 	flag.Parse()
 
-	store = sessions.NewCookieStore(securecookie.GenerateRandomKey(32), securecookie.GenerateRandomKey(32))
+	cfg, err := loadConfig(*configFile, os.Getenv)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// flags given on the command line override the config
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "port":
+			cfg.Port = *port
+		case "u":
+			cfg.Username = *username
+		case "p":
+			cfg.Password = *password
+		case "store":
+			cfg.Store = *storeKind
+		}
+	})
+
+	if flag.Arg(0) == "config" {
+		configCmd(cfg, flag.Args()[1:])
+		return
+	}
 
-	server := tigertonic.NewServer(":"+*port, mux)
-	log.Fatal(server.ListenAndServe())
+	app, err := NewApp(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	switch flag.Arg(0) {
+	case "":
+	case "import":
+		app.importCmd(flag.Args()[1:])
+		return
+	case "export":
+		app.exportCmd(flag.Args()[1:])
+		return
+	case "ldap-sync":
+		app.ldapSyncCmd(flag.Args()[1:])
+		return
+	default:
+		log.Fatalf("unknown command: %s", flag.Arg(0))
+	}
+
+	l, err := net.Listen("tcp", ":"+app.cfg.Port)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := app.serve(l); err != nil {
+		log.Fatal(err)
+	}
 }
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+)
+
+// graphqlHeaderKey is the context key of the request headers, for logging
+// errors from the resolvers.
+const graphqlHeaderKey ctxKey = 1
+
+// graphqlRequest is a GraphQL request, as a POST body, or as the query
+// parameters of a GET request.
+type graphqlRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// newGraphQLSchema returns the schema of /graphql:
+//
+//	type Query {
+//	  person(id: Int!): Person
+//	  persons(search: String, dept: Int): [Person!]!
+//	  department(id: Int!): Department
+//	  departments: [Department!]!
+//	}
+//	type Mutation {
+//	  createPerson(input: PersonInput!): Person
+//	  updatePerson(id: Int!, input: PersonInput!, full: Boolean): Person
+//	  deletePerson(id: Int!): Boolean!
+//	}
+//
+// A Department has a parent, and members, which are the persons in it and its
+// subdepartments, as listed by GET /api/department/{id}/persons.
+func (app *App) newGraphQLSchema() (graphql.Schema, error) {
+	departmentType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Department",
+		Fields: graphql.Fields{
+			"id":   &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"name": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+		},
+	})
+	personType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Person",
+		Fields: graphql.Fields{
+			"id":    &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"name":  &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"role":  &graphql.Field{Type: graphql.String},
+			"email": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"img":   &graphql.Field{Type: graphql.String},
+			"phone": &graphql.Field{Type: graphql.String},
+			"info":  &graphql.Field{Type: graphql.String},
+			"department": &graphql.Field{
+				Type: departmentType,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return app.graphqlDepartment(p.Source.(person).Department), nil
+				},
+			},
+		},
+	})
+	personList := graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(personType)))
+	departmentType.AddFieldConfig("parent", &graphql.Field{
+		Type: departmentType,
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return app.graphqlDepartment(p.Source.(dept).Parent), nil
+		},
+	})
+	departmentType.AddFieldConfig("members", &graphql.Field{
+		Type: personList,
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return app.graphqlPersons(p.Context, app.departmentMembers(p.Source.(dept).ID))
+		},
+	})
+
+	personInput := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "PersonInput",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"name":       &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"department": &graphql.InputObjectFieldConfig{Type: graphql.Int},
+			"email":      &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"img":        &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"role":       &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"info":       &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"phone":      &graphql.InputObjectFieldConfig{Type: graphql.String},
+		},
+	})
+	idArg := graphql.FieldConfigArgument{
+		"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.Int)},
+	}
+
+	query := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"person": &graphql.Field{
+				Type: personType,
+				Args: idArg,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					ps, err := app.graphqlPersons(p.Context, []int{p.Args["id"].(int)})
+					if err != nil || len(ps) == 0 {
+						return nil, err
+					}
+					return ps[0], nil
+				},
+			},
+			"persons": &graphql.Field{
+				Type: personList,
+				Args: graphql.FieldConfigArgument{
+					"search": &graphql.ArgumentConfig{Type: graphql.String},
+					"dept":   &graphql.ArgumentConfig{Type: graphql.Int},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					ids := app.persons.IDs()
+					if q, _ := p.Args["search"].(string); q != "" {
+						ids = app.search(q)
+					}
+					if id, ok := p.Args["dept"].(int); ok {
+						if _, ok := app.mapDepartments[id]; !ok {
+							return nil, errors.New("department not found")
+						}
+						ids = intersectIDs(ids, app.departmentMembers(id))
+					}
+					return app.graphqlPersons(p.Context, ids)
+				},
+			},
+			"department": &graphql.Field{
+				Type: departmentType,
+				Args: idArg,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return app.graphqlDepartment(p.Args["id"].(int)), nil
+				},
+			},
+			"departments": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(departmentType))),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					ds := make([]dept, 0, len(app.mapDepartments))
+					for _, d := range app.mapDepartments {
+						ds = append(ds, d)
+					}
+					sort.Slice(ds, func(i, j int) bool { return ds[i].ID < ds[j].ID })
+					return ds, nil
+				},
+			},
+		},
+	})
+
+	mutation := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Mutation",
+		Fields: graphql.Fields{
+			"createPerson": &graphql.Field{
+				Type: personType,
+				Args: graphql.FieldConfigArgument{
+					"input": &graphql.ArgumentConfig{Type: graphql.NewNonNull(personInput)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					rq := personRequestFromInput(p.Args["input"])
+					np, _, err := app.createPersonFromRequest(graphqlHeader(p.Context), rq)
+					if err != nil {
+						return nil, err
+					}
+					return np, nil
+				},
+			},
+			"updatePerson": &graphql.Field{
+				Type: personType,
+				Args: graphql.FieldConfigArgument{
+					"id":    &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.Int)},
+					"input": &graphql.ArgumentConfig{Type: graphql.NewNonNull(personInput)},
+					"full":  &graphql.ArgumentConfig{Type: graphql.Boolean, DefaultValue: false},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					rq := personRequestFromInput(p.Args["input"])
+					full, _ := p.Args["full"].(bool)
+					np, _, err := app.updatePersonFromRequest(graphqlHeader(p.Context), p.Args["id"].(int), rq, full)
+					if err != nil {
+						return nil, err
+					}
+					return np, nil
+				},
+			},
+			"deletePerson": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.Boolean),
+				Args: idArg,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if _, err := app.deletePersonByID(graphqlHeader(p.Context), p.Args["id"].(int)); err != nil {
+						return nil, err
+					}
+					return true, nil
+				},
+			},
+		},
+	})
+
+	return graphql.NewSchema(graphql.SchemaConfig{Query: query, Mutation: mutation})
+}
+
+// graphqlDepartment returns the department id, or nil if there is none.
+func (app *App) graphqlDepartment(id int) interface{} {
+	if d, ok := app.mapDepartments[id]; ok {
+		return d
+	}
+	return nil
+}
+
+// graphqlPersons returns the persons with the given IDs, skipping IDs which
+// don't exist.
+func (app *App) graphqlPersons(ctx context.Context, ids []int) ([]person, error) {
+	ps := []person{}
+	err := app.persons.IterateSeveral(ids, func(id int, p person) error {
+		ps = append(ps, p)
+		return nil
+	})
+	if err != nil {
+		app.logError(graphqlHeader(ctx), "POST /graphql: %v", err)
+		return nil, errors.New("failed to read persons from database")
+	}
+	return ps, nil
+}
+
+// intersectIDs returns the IDs in both a and b, which must be in ascending
+// order.
+func intersectIDs(a, b []int) []int {
+	res := []int{}
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			res = append(res, a[i])
+			i++
+			j++
+		}
+	}
+	return res
+}
+
+// personRequestFromInput returns the PersonRequest of a PersonInput argument.
+func personRequestFromInput(v interface{}) *PersonRequest {
+	in, _ := v.(map[string]interface{})
+	str := func(name string) string {
+		s, _ := in[name].(string)
+		return s
+	}
+	dept, _ := in["department"].(int)
+	return &PersonRequest{
+		Name:       str("name"),
+		Department: dept,
+		Email:      str("email"),
+		Img:        str("img"),
+		Role:       str("role"),
+		Info:       str("info"),
+		Phone:      str("phone"),
+	}
+}
+
+// graphqlHeader returns the headers of the request a resolver runs for.
+func graphqlHeader(ctx context.Context) http.Header {
+	h, _ := ctx.Value(graphqlHeaderKey).(http.Header)
+	return h
+}
+
+// graphqlOperation returns the type of the operation of a request to be run:
+// "query", "mutation" or "subscription". It is "" if the request is invalid,
+// which graphql.Do reports.
+func graphqlOperation(rq *graphqlRequest) string {
+	doc, err := parser.Parse(parser.ParseParams{Source: rq.Query})
+	if err != nil {
+		return ""
+	}
+	var ops []*ast.OperationDefinition
+	for _, def := range doc.Definitions {
+		op, ok := def.(*ast.OperationDefinition)
+		if !ok {
+			continue
+		}
+		if rq.OperationName == "" || (op.Name != nil && op.Name.Value == rq.OperationName) {
+			ops = append(ops, op)
+		}
+	}
+	if len(ops) != 1 {
+		return ""
+	}
+	return ops[0].Operation
+}
+
+// GET /graphql?query=..
+// POST /graphql
+//
+// Runs a GraphQL query or mutation, see newGraphQLSchema. Mutations must be
+// POSTed, and are authorized, checked for the CSRF token and rate limited
+// like writes to /api/person. A bearer token must have the scope of the
+// operation.
+func (app *App) graphqlHandler(w http.ResponseWriter, r *http.Request) {
+	var rq graphqlRequest
+	if r.Method == "GET" {
+		q := r.URL.Query()
+		rq.Query = q.Get("query")
+		rq.OperationName = q.Get("operationName")
+		if v := q.Get("variables"); v != "" {
+			if err := json.Unmarshal([]byte(v), &rq.Variables); err != nil {
+				http.Error(w, "invalid variables: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+	} else if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&rq); err != nil {
+		http.Error(w, "invalid GraphQL request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	needed := scopeRead
+	mutation := graphqlOperation(&rq) == ast.OperationTypeMutation
+	if mutation {
+		if r.Method == "GET" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "mutations must be sent with POST", http.StatusMethodNotAllowed)
+			return
+		}
+		needed = scopePersonsWrite
+	}
+	if !app.authorize(w, r, needed) {
+		return
+	}
+	if mutation && !app.validCSRF(r, scopePersonsWrite) {
+		http.Error(w, "invalid CSRF token", http.StatusForbidden)
+		return
+	}
+	if mutation && !app.allowWrite(w) {
+		return
+	}
+
+	res := graphql.Do(graphql.Params{
+		Schema:         app.graphql,
+		RequestString:  rq.Query,
+		OperationName:  rq.OperationName,
+		VariableValues: rq.Variables,
+		Context:        context.WithValue(r.Context(), graphqlHeaderKey, r.Header),
+	})
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		app.logError(r.Header, "%s /graphql: %v", r.Method, err)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/knakk/specs"
+)
+
+func TestGraphQL(t *testing.T) {
+	s := specs.New(t)
+	app := newTestApp(t, dept{1, "IT", 0}, dept{2, "Drift", 1}, dept{3, "HR", 0})
+	_, err := app.tokens.Create(apiToken{Name: "reader", Scope: scopeRead, Hash: hashToken("readsecret"), Created: time.Now()})
+	s.ExpectNilFatal(err)
+	_, err = app.tokens.Create(apiToken{Name: "writer", Scope: scopePersonsWrite, Hash: hashToken("writesecret"), Created: time.Now()})
+	s.ExpectNilFatal(err)
+
+	do := func(method, token, query string, vars map[string]interface{}) (int, string) {
+		var req *http.Request
+		if method == "GET" {
+			req = httptest.NewRequest("GET", "/graphql?query="+url.QueryEscape(query), nil)
+		} else {
+			b, _ := json.Marshal(graphqlRequest{Query: query, Variables: vars})
+			req = httptest.NewRequest("POST", "/graphql", strings.NewReader(string(b)))
+			req.Header.Set("Content-Type", "application/json")
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, req)
+		return w.Code, w.Body.String()
+	}
+
+	create := `mutation($in: PersonInput!) { createPerson(input: $in) { id name department { name } } }`
+	for _, in := range []map[string]interface{}{
+		{"name": "Kari", "email": "kari@example.com", "department": 1},
+		{"name": "Ola", "email": "ola@example.com", "department": 2},
+		{"name": "Per", "email": "per@example.com", "department": 3},
+	} {
+		code, body := do("POST", "writesecret", create, map[string]interface{}{"in": in})
+		s.Expect(http.StatusOK, code)
+		s.ExpectNotMatches(body, `"errors"`)
+	}
+	app.bg.Wait()
+
+	var tests = []struct {
+		method, token, query string
+		wantCode             int
+		wantBody             string
+	}{
+		{"GET", "", `{ person(id: 2) { name department { name parent { name } } } }`, 200,
+			`{"data":{"person":{"department":{"name":"Drift","parent":{"name":"IT"}},"name":"Ola"}}}`},
+		{"GET", "", `{ person(id: 9) { name } }`, 200, `{"data":{"person":null}}`},
+		{"GET", "", `{ department(id: 1) { name parent { id } members { name } } }`, 200,
+			`{"data":{"department":{"members":[{"name":"Kari"},{"name":"Ola"}],"name":"IT","parent":null}}}`},
+		{"GET", "", `{ departments { id } }`, 200, `{"data":{"departments":[{"id":1},{"id":2},{"id":3}]}}`},
+		{"GET", "", `{ persons { id } }`, 200, `{"data":{"persons":[{"id":1},{"id":2},{"id":3}]}}`},
+		{"GET", "", `{ persons(search: "ola") { name } }`, 200, `{"data":{"persons":[{"name":"Ola"}]}}`},
+		{"GET", "", `{ persons(dept: 1) { name } }`, 200, `{"data":{"persons":[{"name":"Kari"},{"name":"Ola"}]}}`},
+		{"GET", "", `{ persons(search: "ola", dept: 1) { name } }`, 200, `{"data":{"persons":[{"name":"Ola"}]}}`},
+		{"GET", "", `{ persons(search: "ola", dept: 3) { name } }`, 200, `{"data":{"persons":[]}}`},
+		{"GET", "", `{ persons(dept: 9) { name } }`, 200, `"message":"department not found"`},
+		{"GET", "", `{ nosuchfield }`, 200, `"errors":[{"message":"Cannot query field`},
+		{"GET", "", `mutation { deletePerson(id: 1) }`, 405, "mutations must be sent with POST"},
+		{"POST", "readsecret", `{ person(id: 1) { name } }`, 200, `"name":"Kari"`},
+		{"POST", "readsecret", `mutation { deletePerson(id: 1) }`, 403, `token scope "read" does not allow this request`},
+		{"POST", "nosecret", `{ person(id: 1) { name } }`, 401, "invalid, expired or revoked token"},
+		{"POST", "", `{ person(id: 1) { name } }`, 200, `"name":"Kari"`},
+		{"POST", "", `mutation { deletePerson(id: 1) }`, 401, "login or a token is required"},
+		{"POST", "writesecret", `mutation { createPerson(input: {name: "Kari", email: "KARI@example.com", department: 1}) { id } }`, 200,
+			`"message":"a person with this email already exists"`},
+		{"POST", "writesecret", `mutation { createPerson(input: {name: "Kari"}) { id } }`, 200,
+			`"message":"required parameters: name, department, email"`},
+		{"POST", "writesecret", `mutation { updatePerson(id: 9, input: {name: "x", email: "x@example.com", department: 1}) { id } }`, 200,
+			`"message":"person not found"`},
+	}
+	for _, tt := range tests {
+		code, body := do(tt.method, tt.token, tt.query, nil)
+		if code != tt.wantCode {
+			t.Errorf("%s %s => %d %s; want %d", tt.method, tt.query, code, body, tt.wantCode)
+			continue
+		}
+		if !strings.Contains(body, tt.wantBody) {
+			t.Errorf("%s %s => %s; want %s", tt.method, tt.query, body, tt.wantBody)
+		}
+	}
+
+	// mutations are the REST writes: a partial update keeps the role
+	p, _ := app.persons.Get(3)
+	p.Role = "Leder"
+	s.ExpectNilFatal(app.persons.Put(3, p))
+	update := `mutation($full: Boolean) { updatePerson(id: 3, input: {name: "Per P", email: "per@example.com", department: 1}, full: $full) { name role department { id } } }`
+	_, body := do("POST", "writesecret", update, nil)
+	s.Expect(`{"data":{"updatePerson":{"department":{"id":1},"name":"Per P","role":"Leder"}}}`+"\n", body)
+	_, body = do("POST", "writesecret", update, map[string]interface{}{"full": true})
+	s.Expect(`{"data":{"updatePerson":{"department":{"id":1},"name":"Per P","role":""}}}`+"\n", body)
+	_, body = do("POST", "writesecret", `mutation { deletePerson(id: 3) }`, nil)
+	s.Expect(`{"data":{"deletePerson":true}}`+"\n", body)
+	_, err = app.persons.Get(3)
+	s.Expect(ErrNotFound, err)
+	_, body = do("POST", "writesecret", `mutation { deletePerson(id: 3) }`, nil)
+	s.Expect(true, strings.Contains(body, `"message":"person not found"`))
+	app.bg.Wait()
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ImportResponse reports the outcome of a bulk import. When DryRun is true,
+// Created and Updated are the number of persons that would have been created
+// or updated.
+type ImportResponse struct {
+	DryRun  bool
+	Created int
+	Updated int
+	Errors  []ImportError
+}
+
+// ImportError is a validation error for a single row in an import file.
+type ImportError struct {
+	Line  int
+	Error string
+}
+
+// importColumns maps lower-cased CSV header names, which are the same as the
+// PersonRequest fields, to setters of the corresponding person fields.
+var importColumns = map[string]func(*App, *person, string) error{
+	"name":  func(_ *App, p *person, v string) error { p.Name = v; return nil },
+	"email": func(_ *App, p *person, v string) error { p.Email = v; return nil },
+	"img":   func(_ *App, p *person, v string) error { p.Img = v; return nil },
+	"role":  func(_ *App, p *person, v string) error { p.Role = v; return nil },
+	"info":  func(_ *App, p *person, v string) error { p.Info = v; return nil },
+	"phone": func(_ *App, p *person, v string) error { p.Phone = v; return nil },
+	"department": func(app *App, p *person, v string) (err error) {
+		p.Department, err = app.lookupDepartment(v)
+		return err
+	},
+}
+
+// lookupDepartment resolves a department given by ID or by name.
+func (app *App) lookupDepartment(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	if id, err := strconv.Atoi(s); err == nil {
+		if _, ok := app.mapDepartments[id]; !ok {
+			return 0, fmt.Errorf("department %d doesn't exist", id)
+		}
+		return id, nil
+	}
+	found := 0
+	for id, d := range app.mapDepartments {
+		if strings.EqualFold(d.Name, s) {
+			if found != 0 {
+				return 0, fmt.Errorf("department name %q is ambiguous, use the ID", s)
+			}
+			found = id
+		}
+	}
+	if found == 0 {
+		return 0, fmt.Errorf("department %q doesn't exist", s)
+	}
+	return found, nil
+}
+
+// newCSVReader returns a csv.Reader which accepts both comma and semicolon
+// separated files, as exported from most spreadsheet applications.
+func newCSVReader(r io.Reader) *csv.Reader {
+	br := bufio.NewReader(r)
+	first, _ := br.Peek(4096)
+	if i := bytes.IndexByte(first, '\n'); i != -1 {
+		first = first[:i]
+	}
+	cr := csv.NewReader(br)
+	if bytes.Count(first, []byte(";")) > bytes.Count(first, []byte(",")) {
+		cr.Comma = ';'
+	}
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	return cr
+}
+
+// importRows is a source of the rows of an import file.
+type importRows interface {
+	// Read returns the next row, and its line number in the file. The error
+	// is io.EOF after the last row, or a *csv.ParseError for a row which
+	// can't be read, which is reported and skipped.
+	Read() (record []string, line int, err error)
+}
+
+// csvRows reads the rows of a CSV file.
+type csvRows struct {
+	*csv.Reader
+}
+
+func (r csvRows) Read() ([]string, int, error) {
+	record, err := r.Reader.Read()
+	if err != nil {
+		return nil, 0, err
+	}
+	line, _ := r.FieldPos(0)
+	return record, line, nil
+}
+
+// importCSV imports persons from a CSV file, as importPersonRows.
+func (app *App) importCSV(r io.Reader, dryRun bool) (*ImportResponse, error) {
+	return app.importPersonRows("CSV", csvRows{newCSVReader(r)}, dryRun)
+}
+
+// importXLSX imports persons from the first sheet of an XLSX file, as
+// importPersonRows.
+func (app *App) importXLSX(r io.Reader, dryRun bool) (*ImportResponse, error) {
+	rows, err := newXLSXRows(r)
+	if err != nil {
+		return nil, err
+	}
+	return app.importPersonRows("XLSX", rows, dryRun)
+}
+
+// importPersonRows creates or updates persons from the rows of a file in
+// format, with a header row naming PersonRequest fields. Persons are matched
+// on email, so importing the same file twice updates rather than duplicates.
+// Blank cells are left out, so that they keep the fields of existing persons.
+// Rows failing validation are reported and skipped. If dryRun is true,
+// nothing is stored.
+func (app *App) importPersonRows(format string, rows importRows, dryRun bool) (*ImportResponse, error) {
+	header, _, err := rows.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s header: %v", format, err)
+	}
+	setters := make([]func(*App, *person, string) error, len(header))
+	hasEmail := false
+	for i, h := range header {
+		// strip byte order mark written by some spreadsheet applications
+		h = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(h, "\ufeff")))
+		f, ok := importColumns[h]
+		if !ok {
+			return nil, fmt.Errorf("unknown column in %s header: %q", format, header[i])
+		}
+		setters[i] = f
+		hasEmail = hasEmail || h == "email"
+	}
+	if !hasEmail {
+		return nil, fmt.Errorf("%s header must contain an email column", format)
+	}
+
+	// emails of persons which would have been created by a dry run
+	dryRunEmails := make(map[string]bool)
+
+	res := &ImportResponse{DryRun: dryRun}
+	for {
+		record, line, err := rows.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if perr, ok := err.(*csv.ParseError); ok {
+				res.Errors = append(res.Errors, ImportError{perr.StartLine, perr.Err.Error()})
+				continue
+			}
+			return nil, err
+		}
+		if len(record) != len(header) {
+			res.Errors = append(res.Errors, ImportError{line,
+				fmt.Sprintf("expected %d fields, got %d", len(header), len(record))})
+			continue
+		}
+
+		var rq person
+		var rowErrs []string
+		apply := func(p *person) {
+			for i, v := range record {
+				if v = strings.TrimSpace(v); v == "" {
+					continue
+				}
+				if err := setters[i](app, p, v); err != nil {
+					rowErrs = append(rowErrs, err.Error())
+				}
+			}
+		}
+		apply(&rq)
+		if rq.Email == "" {
+			rowErrs = append(rowErrs, "email is required")
+		}
+		var id int
+		ids := app.persons.Lookup("email", emailKey(rq.Email))
+		if len(ids) > 0 {
+			id = ids[0]
+		}
+		exists := len(ids) > 0 || dryRunEmails[emailKey(rq.Email)]
+		if !exists && (rq.Name == "" || rq.Department == 0) {
+			rowErrs = append(rowErrs, "required parameters for new person: name, department, email")
+		}
+		if len(rowErrs) > 0 {
+			res.Errors = append(res.Errors, ImportError{line, strings.Join(rowErrs, "; ")})
+			continue
+		}
+
+		switch {
+		case dryRun && len(ids) > 0:
+			var oldp person
+			if oldp, err = app.persons.Get(id); err == nil {
+				_, err = app.importMerge(oldp, apply)
+			}
+		case dryRun:
+		case exists:
+			err = app.importUpdate(id, apply)
+		default:
+			err = app.importCreate(rq)
+		}
+		if rerr, ok := err.(importRowError); ok {
+			res.Errors = append(res.Errors, ImportError{line, string(rerr)})
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			res.Updated++
+		} else {
+			res.Created++
+		}
+		if dryRun {
+			// so that later rows with the same email count as updates
+			dryRunEmails[emailKey(rq.Email)] = true
+		}
+	}
+	return res, nil
+}
+
+// importRowError is a validation error of a row, found when storing it.
+type importRowError string
+
+func (e importRowError) Error() string { return string(e) }
+
+// importCreate stores and indexes a new person.
+func (app *App) importCreate(p person) error {
+	if p.Img == "" {
+		p.Img = "dummy.png"
+	}
+	id, err := app.persons.Create(p)
+	if err != nil {
+		return err
+	}
+	p.ID = id
+	app.personChanged(id, nil, &p)
+	return nil
+}
+
+// importMerge returns oldp with the fields set by apply, validated as by
+// PATCH /person/{id}.
+func (app *App) importMerge(oldp person, apply func(*person)) (person, error) {
+	p := oldp
+	apply(&p)
+	p.Email = oldp.Email
+	if p.Name == "" || p.Department == 0 {
+		return p, importRowError("required parameters: name, department, email")
+	}
+	if _, ok := app.mapDepartments[p.Department]; !ok {
+		return p, importRowError("department doesn't exist")
+	}
+	return p, nil
+}
+
+// importUpdate updates an existing person with the fields set by apply, and
+// reindexes it.
+func (app *App) importUpdate(id int, apply func(*person)) error {
+	var oldp, p person
+	err := app.persons.Update(func(tx *TypedTx[person]) (err error) {
+		if oldp, err = tx.Get(id); err != nil {
+			return err
+		}
+		if p, err = app.importMerge(oldp, apply); err != nil {
+			return err
+		}
+		return tx.Put(id, p)
+	})
+	if err != nil {
+		return err
+	}
+	app.personChanged(id, &oldp, &p)
+	return nil
+}
+
+// POST /import?dryrun=yes
+//
+// The file is CSV, or XLSX if sent as such.
+func (app *App) importPersons(w http.ResponseWriter, r *http.Request) {
+	dryRun := r.URL.Query().Get("dryrun") == "yes"
+	importFile := app.importCSV
+	if ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); ct == xlsxContentType {
+		importFile = app.importXLSX
+	}
+	res, err := importFile(http.MaxBytesReader(w, r.Body, app.cfg.MaxUploadSize), dryRun)
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"description": err.Error(),
+			"error":       "bad_request",
+		})
+		return
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+// importCmd implements the import subcommand, which takes a CSV file, or an
+// XLSX file if named .xlsx:
+//
+//	folk import [-dry-run] file.csv|file.xlsx
+func (app *App) importCmd(args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "validate the file without storing anything")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: folk import [-dry-run] file.csv|file.xlsx")
+		os.Exit(2)
+	}
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	importFile := app.importCSV
+	if strings.EqualFold(filepath.Ext(fs.Arg(0)), ".xlsx") {
+		importFile = app.importXLSX
+	}
+	res, err := importFile(f, *dryRun)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, e := range res.Errors {
+		fmt.Printf("line %d: %s\n", e.Line, e.Error)
+	}
+	verb := ""
+	if res.DryRun {
+		verb = "would be "
+	}
+	fmt.Printf("%d persons %screated, %d %supdated, %d rows with errors\n",
+		res.Created, verb, res.Updated, verb, len(res.Errors))
+	if err := app.Close(); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/knakk/specs"
+)
+
+func setupImportTest(t *testing.T) *App {
+	app := newTestApp(t,
+		dept{1, "Hovedbiblioteket", 0},
+		dept{2, "Økonomi", 1},
+		dept{3, "Filialer", 0},
+		dept{4, "Økonomi", 3},
+	)
+	return app
+}
+
+func TestImportCSV(t *testing.T) {
+	app := setupImportTest(t)
+	s := specs.New(t)
+
+	csv := "Name;Email;Department;Role\n" +
+		"Åse Ødegård;ase@example.com;2;Rådgiver\n" +
+		"Bjørn;bjorn@example.com;Filialer;\n" +
+		"Carl;carl@example.com;Økonomi;\n" +
+		"Dina;;1;\n" +
+		"Erik;erik@example.com;Nowhere;\n" +
+		";fred@example.com;1;\n"
+
+	// dry run stores nothing
+	res, err := app.importCSV(strings.NewReader(csv), true)
+	s.ExpectNilFatal(err)
+	s.Expect(true, res.DryRun)
+	s.Expect(2, res.Created)
+	s.Expect(0, res.Updated)
+	s.Expect(4, len(res.Errors))
+	s.Expect(0, app.persons.Size())
+
+	s.Expect(4, res.Errors[0].Line)
+	s.ExpectMatches(res.Errors[0].Error, "ambiguous")
+	s.Expect(5, res.Errors[1].Line)
+	s.ExpectMatches(res.Errors[1].Error, "email is required")
+	s.Expect(6, res.Errors[2].Line)
+	s.ExpectMatches(res.Errors[2].Error, `department "Nowhere" doesn't exist`)
+	s.Expect(7, res.Errors[3].Line)
+	s.ExpectMatches(res.Errors[3].Error, "required parameters")
+
+	res, err = app.importCSV(strings.NewReader(csv), false)
+	s.ExpectNilFatal(err)
+	s.Expect(2, res.Created)
+	s.Expect(2, app.persons.Size())
+
+	// re-import updates by email, only touching the given columns
+	res, err = app.importCSV(strings.NewReader("email,role\nASE@example.com,Direktør\n"), false)
+	s.ExpectNilFatal(err)
+	s.Expect(0, res.Created)
+	s.Expect(1, res.Updated)
+	s.Expect(2, app.persons.Size())
+
+	p, err := app.persons.Get(1)
+	s.ExpectNilFatal(err)
+	s.Expect("Åse Ødegård", p.Name)
+	s.Expect("ase@example.com", p.Email)
+	s.Expect("Direktør", p.Role)
+	s.Expect(2, p.Department)
+	s.Expect("dummy.png", p.Img)
+
+	// blank cells keep the fields of existing persons
+	res, err = app.importCSV(strings.NewReader("email,name,department,role\nase@example.com,,,Sjef\nbjorn@example.com, ,Hovedbiblioteket,\n"), false)
+	s.ExpectNilFatal(err)
+	s.Expect(2, res.Updated)
+	s.Expect(0, len(res.Errors))
+	p, err = app.persons.Get(1)
+	s.ExpectNilFatal(err)
+	s.Expect("Åse Ødegård", p.Name)
+	s.Expect(2, p.Department)
+	s.Expect("Sjef", p.Role)
+	p, err = app.persons.Get(2)
+	s.ExpectNilFatal(err)
+	s.Expect("Bjørn", p.Name)
+	s.Expect(1, p.Department)
+
+	// updated persons are validated as by PATCH, also in a dry run
+	id, err := app.persons.Create(person{Name: "Gro", Email: "gro@example.com", Department: 9})
+	s.ExpectNilFatal(err)
+	for _, dryRun := range []bool{true, false} {
+		res, err = app.importCSV(strings.NewReader("email,role\ngro@example.com,Leder\n"), dryRun)
+		s.ExpectNilFatal(err)
+		s.Expect(0, res.Updated)
+		s.Expect([]ImportError{{2, "department doesn't exist"}}, res.Errors)
+	}
+	p, err = app.persons.Get(id)
+	s.ExpectNilFatal(err)
+	s.Expect("", p.Role)
+}
+
+func TestImportHeaderErrors(t *testing.T) {
+	app := setupImportTest(t)
+	s := specs.New(t)
+
+	var tests = []struct {
+		csv string
+		err string
+	}{
+		{"", "failed to read CSV header"},
+		{"name,department\nA,1\n", "must contain an email column"},
+		{"name,email,shoesize\nA,a@b,44\n", `unknown column in CSV header: "shoesize"`},
+	}
+
+	for _, tt := range tests {
+		_, err := app.importCSV(strings.NewReader(tt.csv), false)
+		if err == nil {
+			t.Errorf("expected error for %q", tt.csv)
+			continue
+		}
+		s.ExpectMatches(err.Error(), tt.err)
+	}
+}
+
+func TestImportAPI(t *testing.T) {
+	app := setupImportTest(t)
+	s := specs.New(t)
+	testServer := httptest.NewServer(app.apiMux)
+	defer testServer.Close()
+
+	var tests = []struct {
+		url       string
+		body      string
+		respCode  int
+		bodyMatch string
+	}{
+		{"/import", "name,email\nA,a@b\n", 200, `"Line":2,"Error":"required parameters`},
+		{"/import?dryrun=yes", "name,email,department\nA,a@b,1\n", 200, `"DryRun":true,"Created":1`},
+		{"/import", "name,email,department\nA,a@b,1\n", 200, `"DryRun":false,"Created":1`},
+		{"/import", "name,email,department\nB,a@b,1\n", 200, `"Created":0,"Updated":1`},
+		{"/import", "name,department\nB,1\n", 400, "must contain an email column"},
+	}
+
+	for _, tt := range tests {
+		resp, err := http.Post(testServer.URL+tt.url, "text/csv", strings.NewReader(tt.body))
+		s.ExpectNilFatal(err)
+		body, err := ioutil.ReadAll(resp.Body)
+		s.ExpectNilFatal(err)
+		resp.Body.Close()
+		if tt.respCode != resp.StatusCode {
+			t.Errorf("POST %s: expected status %d, got %d", tt.url, tt.respCode, resp.StatusCode)
+		}
+		s.ExpectMatches(string(body), tt.bodyMatch)
+	}
+	s.Expect(1, app.persons.Size())
+
+	// XLSX files are sent as such
+	xlsx := testXLSX(t, [][]string{{"Name", "Email", "Department"}, {"C", "c@b", "1"}})
+	resp, err := http.Post(testServer.URL+"/import", xlsxContentType, bytes.NewReader(xlsx))
+	s.ExpectNilFatal(err)
+	body, err := ioutil.ReadAll(resp.Body)
+	s.ExpectNilFatal(err)
+	resp.Body.Close()
+	s.Expect(http.StatusOK, resp.StatusCode)
+	s.ExpectMatches(string(body), `"Created":1`)
+	s.Expect(2, app.persons.Size())
+}
+
+// testXLSX returns an XLSX file with rows as its first sheet. The cells of
+// the first row are shared strings, the others inline strings, and rows are
+// numbered from 2, as if the first row of the sheet were empty.
+func testXLSX(t *testing.T, rows [][]string) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	add := func(name, content string) {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n" + content))
+	}
+	add("xl/workbook.xml", `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets><sheet name="Ark1" sheetId="1" r:id="rId1"/><sheet name="Ark2" sheetId="2" r:id="rId2"/></sheets></workbook>`)
+	add("xl/_rels/workbook.xml.rels", `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId2" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet2.xml"/><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="/xl/worksheets/sheet1.xml"/></Relationships>`)
+	var sst, data strings.Builder
+	for i, row := range rows {
+		fmt.Fprintf(&data, `<row r="%d">`, i+2)
+		for j, v := range row {
+			ref := fmt.Sprintf("%c%d", 'A'+j, i+2)
+			switch {
+			case v == "":
+			case i == 0:
+				fmt.Fprintf(&data, `<c r="%s" t="s"><v>%d</v></c>`, ref, j)
+				fmt.Fprintf(&sst, `<si><r><t>%s</t></r><r><t>%s</t></r></si>`, v[:1], v[1:])
+			default:
+				fmt.Fprintf(&data, `<c r="%s" t="inlineStr"><is><t>%s</t></is></c>`, ref, v)
+			}
+		}
+		data.WriteString(`</row>`)
+	}
+	add("xl/sharedStrings.xml", `<sst xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">`+sst.String()+`</sst>`)
+	add("xl/worksheets/sheet1.xml", `<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`+data.String()+`</sheetData></worksheet>`)
+	add("xl/worksheets/sheet2.xml", `<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData/></worksheet>`)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestImportXLSX(t *testing.T) {
+	app := setupImportTest(t)
+	s := specs.New(t)
+
+	xlsx := testXLSX(t, [][]string{
+		{"Name", "Email", "Department", "Phone"},
+		{"Åse", "ase@example.com", "2", "12345678"},
+		{"Bjørn", "bjorn@example.com", "Filialer"},
+		{},
+		{"Carl", "", "1"},
+	})
+	res, err := app.importXLSX(bytes.NewReader(xlsx), false)
+	s.ExpectNilFatal(err)
+	s.Expect(2, res.Created)
+	s.Expect([]ImportError{{6, "email is required"}}, res.Errors)
+	p, err := app.persons.Get(1)
+	s.ExpectNilFatal(err)
+	s.Expect(person{ID: 1, Name: "Åse", Email: "ase@example.com", Department: 2, Phone: "12345678", Img: "dummy.png"}, p)
+	p, err = app.persons.Get(2)
+	s.ExpectNilFatal(err)
+	s.Expect(3, p.Department)
+	s.Expect("", p.Phone)
+
+	var tests = []struct {
+		xlsx []byte
+		err  string
+	}{
+		{[]byte("Name,Email\n"), "not an XLSX file"},
+		{testXLSX(t, nil), "failed to read XLSX header: EOF"},
+		{testXLSX(t, [][]string{{"Name", "Shoesize"}}), `unknown column in XLSX header: "Shoesize"`},
+	}
+	for _, tt := range tests {
+		_, err := app.importXLSX(bytes.NewReader(tt.xlsx), false)
+		if err == nil {
+			t.Errorf("expected error %q", tt.err)
+			continue
+		}
+		s.ExpectMatches(err.Error(), tt.err)
+	}
+}
+
+func TestXLSXColumn(t *testing.T) {
+	var tests = []struct {
+		ref  string
+		want int
+		ok   bool
+	}{
+		{"A1", 0, true},
+		{"B7", 1, true},
+		{"Z10", 25, true},
+		{"AA3", 26, true},
+		{"XFD1", 16383, true},
+		{"A", 0, false},
+		{"12", 0, false},
+		{"a1", 0, false},
+		{"ABCD1", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := xlsxColumn(tt.ref)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("xlsxColumn(%q) => %d, %v; want %d, ok: %v", tt.ref, got, err, tt.want, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/knakk/intset"
+)
+
+// IndexFunc extracts the key a document is indexed under in a secondary
+// index. Documents for which ok is false are left out of the index.
+type IndexFunc func(data []byte) (key string, ok bool)
+
+// UniqueError is returned when a write would give two documents the same key
+// in a unique index.
+type UniqueError struct {
+	Index string
+	Key   string
+}
+
+func (e *UniqueError) Error() string {
+	return fmt.Sprintf("%s %q already exists", e.Index, e.Key)
+}
+
+// dbIndex is a secondary index on a DB. It is only accessed with the DB lock
+// held.
+type dbIndex struct {
+	name    string
+	unique  bool
+	fn      IndexFunc
+	entries map[string]*intset.BitSet
+	keys    map[int]string // the key each document is indexed under
+}
+
+func newIndex(name string, unique bool, fn IndexFunc) *dbIndex {
+	return &dbIndex{
+		name:    name,
+		unique:  unique,
+		fn:      fn,
+		entries: make(map[string]*intset.BitSet),
+		keys:    make(map[int]string),
+	}
+}
+
+// conflict returns an error if indexing the document id under key would
+// violate the uniqueness of the index.
+func (idx *dbIndex) conflict(id int, key string) error {
+	if !idx.unique {
+		return nil
+	}
+	if e, ok := idx.entries[key]; ok && (e.Size() > 1 || !e.Contains(id)) {
+		return &UniqueError{idx.name, key}
+	}
+	return nil
+}
+
+func (idx *dbIndex) add(id int, key string) {
+	e, ok := idx.entries[key]
+	if !ok {
+		e = intset.NewBitSet(0)
+		idx.entries[key] = e
+	}
+	e.Add(id)
+	idx.keys[id] = key
+}
+
+// build adds a document to a new index. Duplicate keys in unique indexes are
+// added anyway, but reported as an error.
+func (idx *dbIndex) build(id int, data []byte) error {
+	key, ok := idx.fn(data)
+	if !ok {
+		return nil
+	}
+	err := idx.conflict(id, key)
+	idx.add(id, key)
+	return err
+}
+
+func (idx *dbIndex) remove(id int) {
+	key, ok := idx.keys[id]
+	if !ok {
+		return
+	}
+	delete(idx.keys, id)
+	if e := idx.entries[key]; e != nil {
+		e.Remove(id)
+		if e.Size() == 0 {
+			delete(idx.entries, key)
+		}
+	}
+}
+
+// AddIndex declares a secondary index on the database, and indexes all
+// existing documents. The index is kept up to date on every write. If unique
+// is true, writes which would give two documents the same key fail with a
+// *UniqueError. If the existing documents already have duplicate keys, the
+// index is added anyway, and the first duplicate is returned as an error.
+func (db *DB) AddIndex(name string, unique bool, fn IndexFunc) error {
+	db.Lock()
+	defer db.Unlock()
+	idx := newIndex(name, unique, fn)
+	var err error
+	for _, id := range db.all.All() {
+		if berr := idx.build(id, db.docs[id]); err == nil {
+			err = berr
+		}
+	}
+	db.indexes = append(db.indexes, idx)
+	return err
+}
+
+// Lookup returns the IDs of the documents with the given key in the named
+// index, in ascending order.
+func (db *DB) Lookup(name, key string) []int {
+	db.RLock()
+	defer db.RUnlock()
+	return lookup(db.indexes, name, key)
+}
+
+// indexKeys returns the keys of a document in each of the indexes, after
+// checking that the unique indexes are not violated. A key is "" if the
+// document is left out of the index.
+func indexKeys(indexes []*dbIndex, id int, data []byte) ([]string, error) {
+	keys := make([]string, len(indexes))
+	for i, idx := range indexes {
+		key, ok := idx.fn(data)
+		if !ok {
+			continue
+		}
+		if err := idx.conflict(id, key); err != nil {
+			return nil, err
+		}
+		keys[i] = key
+	}
+	return keys, nil
+}
+
+// setIndexKeys indexes the document id under keys, as returned by indexKeys.
+func setIndexKeys(indexes []*dbIndex, id int, keys []string) {
+	for i, idx := range indexes {
+		idx.remove(id)
+		if keys[i] != "" {
+			idx.add(id, keys[i])
+		}
+	}
+}
+
+// lookup implements Lookup for a set of indexes.
+func lookup(indexes []*dbIndex, name, key string) []int {
+	for _, idx := range indexes {
+		if idx.name != name {
+			continue
+		}
+		if e, ok := idx.entries[key]; ok {
+			return e.All()
+		}
+		return nil
+	}
+	return nil
+}
+
+// reindex updates all secondary indexes for the document id, after checking
+// that the unique indexes are not violated. It must be called with the write
+// lock held.
+func (db *DB) reindex(id int, data []byte) error {
+	keys, err := indexKeys(db.indexes, id, data)
+	if err != nil {
+		return err
+	}
+	setIndexKeys(db.indexes, id, keys)
+	return nil
+}
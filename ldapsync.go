@@ -0,0 +1,389 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// ldapFields are the person fields which can be mapped to LDAP attributes.
+var ldapFields = []string{"Name", "Email", "Phone", "Role"}
+
+// parseLDAPAttributes parses the LDAPAttributes config, which maps person
+// fields to LDAP attributes as "Name=displayName,Email=mail". Email must be
+// mapped, as persons are matched by email.
+func parseLDAPAttributes(s string) (map[string]string, error) {
+	attrs := make(map[string]string)
+	for _, kv := range splitList(s) {
+		i := strings.Index(kv, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("expected Field=attribute, got %q", kv)
+		}
+		field, attr := strings.TrimSpace(kv[:i]), strings.TrimSpace(kv[i+1:])
+		known := false
+		for _, f := range ldapFields {
+			known = known || f == field
+		}
+		if !known || attr == "" {
+			return nil, fmt.Errorf("expected one of %s mapped to an attribute, got %q",
+				strings.Join(ldapFields, ", "), kv)
+		}
+		attrs[field] = attr
+	}
+	if attrs["Email"] == "" {
+		return nil, errors.New("Email must be mapped")
+	}
+	return attrs, nil
+}
+
+// fetchLDAP returns the entries in the directory matching LDAPFilter.
+func (app *App) fetchLDAP(attrs map[string]string) ([]*ldap.Entry, error) {
+	l, err := ldap.DialURL(app.cfg.LDAPURL,
+		ldap.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}))
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close()
+	if app.cfg.LDAPBindDN != "" {
+		if err := l.Bind(app.cfg.LDAPBindDN, app.cfg.LDAPBindPassword); err != nil {
+			return nil, err
+		}
+	}
+	var names []string
+	for _, f := range ldapFields {
+		if a, ok := attrs[f]; ok {
+			names = append(names, a)
+		}
+	}
+	req := ldap.NewSearchRequest(app.cfg.LDAPBaseDN, ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases, 0, 0, false, app.cfg.LDAPFilter, names, nil)
+	// Active Directory returns at most 1000 entries per page
+	res, err := l.SearchWithPaging(req, 500)
+	if err != nil {
+		return nil, err
+	}
+	return res.Entries, nil
+}
+
+// ouDepartment returns the department named as the innermost OU of dn which
+// names a department, ignoring case.
+func (app *App) ouDepartment(dn string) (int, bool) {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil {
+		return 0, false
+	}
+	for _, rdn := range parsed.RDNs {
+		for _, a := range rdn.Attributes {
+			if strings.EqualFold(a.Type, "ou") {
+				if id, ok := app.departmentByName(a.Value); ok {
+					return id, true
+				}
+			}
+		}
+	}
+	return 0, false
+}
+
+// ldapPerson maps an LDAP entry to the synced fields of a person.
+func (app *App) ldapPerson(e *ldap.Entry, attrs map[string]string) (person, error) {
+	p := person{LDAPDN: e.DN}
+	for field, attr := range attrs {
+		v := strings.TrimSpace(e.GetAttributeValue(attr))
+		switch field {
+		case "Name":
+			p.Name = v
+		case "Email":
+			p.Email = v
+		case "Phone":
+			p.Phone = v
+		case "Role":
+			p.Role = v
+		}
+	}
+	if p.Email == "" {
+		return p, fmt.Errorf("no %s", attrs["Email"])
+	}
+	dept, ok := app.ouDepartment(e.DN)
+	if !ok {
+		return p, errors.New("no OU names a department")
+	}
+	p.Department = dept
+	return p, nil
+}
+
+// syncLDAPFields sets the fields of dst which are synced from LDAP to those of
+// src, and marks dst as present in LDAP. A person always keeps a name.
+func syncLDAPFields(dst *person, src person, attrs map[string]string) {
+	for field := range attrs {
+		switch field {
+		case "Name":
+			if src.Name != "" {
+				dst.Name = src.Name
+			}
+		case "Email":
+			dst.Email = src.Email
+		case "Phone":
+			dst.Phone = src.Phone
+		case "Role":
+			dst.Role = src.Role
+		}
+	}
+	dst.Department = src.Department
+	dst.LDAPDN = src.LDAPDN
+	dst.GoneFromLDAP = false
+}
+
+// ldapChange is a change to a person made by an LDAP sync.
+type ldapChange struct {
+	ID    int // 0 for new persons
+	Name  string
+	Email string
+	Diff  []string // changed fields, as `Field: "old" -> "new"`
+}
+
+// ldapSyncReport describes the changes made, or which would be made in a dry
+// run, by an LDAP sync.
+type ldapSyncReport struct {
+	DryRun  bool
+	Created []ldapChange
+	Updated []ldapChange
+	Gone    []ldapChange // flagged as gone from LDAP
+	Skipped []string     // entries which couldn't be mapped to a person
+}
+
+// write writes the report as a diff, one line per change.
+func (r *ldapSyncReport) write(w io.Writer) {
+	for _, c := range r.Created {
+		fmt.Fprintf(w, "+ %s <%s>\n", c.Name, c.Email)
+	}
+	for _, c := range r.Updated {
+		fmt.Fprintf(w, "~ %d %s <%s>: %s\n", c.ID, c.Name, c.Email, strings.Join(c.Diff, ", "))
+	}
+	for _, c := range r.Gone {
+		fmt.Fprintf(w, "- %d %s <%s>: gone from LDAP\n", c.ID, c.Name, c.Email)
+	}
+	for _, s := range r.Skipped {
+		fmt.Fprintf(w, "! %s\n", s)
+	}
+	verb := ""
+	if r.DryRun {
+		verb = "would be "
+	}
+	fmt.Fprintf(w, "%d persons %screated, %d %supdated, %d %sflagged as gone, %d entries skipped\n",
+		len(r.Created), verb, len(r.Updated), verb, len(r.Gone), verb, len(r.Skipped))
+}
+
+// diffPersons lists the fields synced from LDAP which differ between a and b.
+func (app *App) diffPersons(a, b person) []string {
+	var diff []string
+	field := func(name, x, y string) {
+		if x != y {
+			diff = append(diff, fmt.Sprintf("%s: %q -> %q", name, x, y))
+		}
+	}
+	field("Name", a.Name, b.Name)
+	field("Email", a.Email, b.Email)
+	field("Phone", a.Phone, b.Phone)
+	field("Role", a.Role, b.Role)
+	field("Department", app.mapDepartments[a.Department].Name, app.mapDepartments[b.Department].Name)
+	field("LDAPDN", a.LDAPDN, b.LDAPDN)
+	if a.GoneFromLDAP && !b.GoneFromLDAP {
+		diff = append(diff, "back in LDAP")
+	}
+	return diff
+}
+
+// syncLDAP upserts the persons in entries by email, and flags the persons
+// which were synced before, but are no longer in entries, as gone. A person
+// whose entry is skipped is not gone. Nothing is stored in a dry run. The
+// changes are applied in one transaction.
+//
+// An empty search result is more likely a wrong LDAPBaseDN or LDAPFilter than
+// an empty directory, so unless forced, a sync which finds no entries fails
+// rather than flagging every synced person as gone.
+func (app *App) syncLDAP(entries []*ldap.Entry, attrs map[string]string, dryRun, force bool) (*ldapSyncReport, error) {
+	rep := &ldapSyncReport{DryRun: dryRun}
+	inLDAP := make(map[string]bool) // emails of all entries
+	seen := make(map[string]bool)   // emails of the entries synced
+	var creates []person
+	var updates []int
+	synced := make(map[int]person)
+	for _, e := range entries {
+		if email := strings.TrimSpace(e.GetAttributeValue(attrs["Email"])); email != "" {
+			inLDAP[emailKey(email)] = true
+		}
+		p, err := app.ldapPerson(e, attrs)
+		if err != nil {
+			rep.Skipped = append(rep.Skipped, fmt.Sprintf("%s: %v", e.DN, err))
+			continue
+		}
+		k := emailKey(p.Email)
+		if seen[k] {
+			rep.Skipped = append(rep.Skipped, fmt.Sprintf("%s: duplicate email %s", e.DN, p.Email))
+			continue
+		}
+		seen[k] = true
+		ids := app.persons.Lookup("email", k)
+		if len(ids) == 0 {
+			if p.Name == "" {
+				rep.Skipped = append(rep.Skipped, fmt.Sprintf("%s: no name", e.DN))
+				continue
+			}
+			p.Img = "dummy.png"
+			creates = append(creates, p)
+			rep.Created = append(rep.Created, ldapChange{Name: p.Name, Email: p.Email})
+			continue
+		}
+		old, err := app.persons.Get(ids[0])
+		if err != nil {
+			return nil, err
+		}
+		next := old
+		syncLDAPFields(&next, p, attrs)
+		if diff := app.diffPersons(old, next); len(diff) > 0 {
+			updates = append(updates, ids[0])
+			synced[ids[0]] = p
+			rep.Updated = append(rep.Updated, ldapChange{ids[0], next.Name, next.Email, diff})
+		}
+	}
+	var gone []int
+	err := app.persons.Iterate(func(id int, p person) error {
+		if p.LDAPDN != "" && !p.GoneFromLDAP && !inLDAP[emailKey(p.Email)] {
+			gone = append(gone, id)
+			rep.Gone = append(rep.Gone, ldapChange{ID: id, Name: p.Name, Email: p.Email})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 && len(gone) > 0 && !dryRun && !force {
+		return nil, fmt.Errorf("found no entries in LDAP, which would flag all %d synced persons as gone; "+
+			"check LDAPBaseDN and LDAPFilter, or force the sync", len(gone))
+	}
+	if dryRun || len(creates)+len(updates)+len(gone) == 0 {
+		return rep, nil
+	}
+
+	c := newBatchChanges()
+	err = app.persons.Update(func(tx *TypedTx[person]) error {
+		for _, p := range creates {
+			id, err := tx.Create(p)
+			if err != nil {
+				return fmt.Errorf("%s: %v", p.LDAPDN, err)
+			}
+			p := p
+			p.ID = id
+			c.record(id, nil, &p)
+		}
+		change := func(id int, fn func(*person)) error {
+			old, err := tx.Get(id)
+			if err != nil {
+				return err
+			}
+			p := old
+			fn(&p)
+			if err := tx.Put(id, p); err != nil {
+				return err
+			}
+			c.record(id, &old, &p)
+			return nil
+		}
+		for _, id := range updates {
+			if err := change(id, func(p *person) { syncLDAPFields(p, synced[id], attrs) }); err != nil {
+				return err
+			}
+		}
+		for _, id := range gone {
+			if err := change(id, func(p *person) { p.GoneFromLDAP = true }); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	app.personsChanged(c)
+	return rep, nil
+}
+
+// runLDAPSync reads the directory and syncs the persons with it, see syncLDAP.
+func (app *App) runLDAPSync(dryRun, force bool) (*ldapSyncReport, error) {
+	attrs, err := parseLDAPAttributes(app.cfg.LDAPAttributes)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := app.fetchLDAP(attrs)
+	if err != nil {
+		return nil, fmt.Errorf("LDAP: %v", err)
+	}
+	return app.syncLDAP(entries, attrs, dryRun, force)
+}
+
+// scheduleLDAPSync syncs with LDAP every LDAPSyncInterval minutes, if LDAP
+// sync is configured. The returned function stops the schedule, and waits for
+// a running sync to finish.
+func (app *App) scheduleLDAPSync() (stop func()) {
+	if app.cfg.LDAPURL == "" || app.cfg.LDAPSyncInterval == 0 {
+		return func() {}
+	}
+	ticker := time.NewTicker(time.Duration(app.cfg.LDAPSyncInterval) * time.Minute)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			rep, err := app.runLDAPSync(false, false)
+			if err != nil {
+				log.Printf("LDAP sync failed: %v", err)
+				continue
+			}
+			var b strings.Builder
+			rep.write(&b)
+			log.Printf("LDAP sync:\n%s", b.String())
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		close(done)
+		wg.Wait()
+	}
+}
+
+// ldapSyncCmd implements the ldap-sync subcommand:
+//
+//	folk ldap-sync [-dry-run] [-force]
+func (app *App) ldapSyncCmd(args []string) {
+	fs := flag.NewFlagSet("ldap-sync", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "report the changes without storing anything")
+	force := fs.Bool("force", false, "flag all synced persons as gone if LDAP has no entries")
+	fs.Parse(args)
+	if app.cfg.LDAPURL == "" {
+		fmt.Fprintln(os.Stderr, "LDAPURL is not configured")
+		os.Exit(2)
+	}
+	rep, err := app.runLDAPSync(*dryRun, *force)
+	if err != nil {
+		log.Fatal(err)
+	}
+	rep.write(os.Stdout)
+	if err := app.Close(); err != nil {
+		log.Fatal(err)
+	}
+}
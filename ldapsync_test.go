@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/knakk/specs"
+)
+
+// ldapTestServer is an in-process LDAP server, which answers simple binds,
+// and searches with all its entries, whatever the filter.
+type ldapTestServer struct {
+	net.Listener
+	bindDN, password string
+
+	sync.Mutex
+	entries  []*ldap.Entry
+	searches []string // base DN and filter of each search
+}
+
+func newLDAPTestServer(t *testing.T, bindDN, password string) *ldapTestServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &ldapTestServer{Listener: l, bindDN: bindDN, password: password}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go srv.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+	return srv
+}
+
+func (srv *ldapTestServer) URL() string {
+	return "ldap://" + srv.Addr().String()
+}
+
+func (srv *ldapTestServer) setEntries(entries ...*ldap.Entry) {
+	srv.Lock()
+	defer srv.Unlock()
+	srv.entries = entries
+}
+
+func ldapMessage(id int64, op *ber.Packet) []byte {
+	p := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+	p.AppendChild(op)
+	return p.Bytes()
+}
+
+func ldapResult(tag ber.Tag, code int) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	return op
+}
+
+func ldapEntry(e *ldap.Entry) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.DN, ""))
+	attrs := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	for _, a := range e.Attributes {
+		attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+		attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, a.Name, ""))
+		vals := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+		for _, v := range a.Values {
+			vals.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, ""))
+		}
+		attr.AppendChild(vals)
+		attrs.AppendChild(attr)
+	}
+	op.AppendChild(attrs)
+	return op
+}
+
+func (srv *ldapTestServer) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		p, err := ber.ReadPacket(conn)
+		if err != nil || len(p.Children) < 2 {
+			return
+		}
+		id, _ := p.Children[0].Value.(int64)
+		op := p.Children[1]
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			code := ldap.LDAPResultSuccess
+			if op.Children[1].Value.(string) != srv.bindDN || op.Children[2].Data.String() != srv.password {
+				code = ldap.LDAPResultInvalidCredentials
+			}
+			conn.Write(ldapMessage(id, ldapResult(ldap.ApplicationBindResponse, code)))
+		case ldap.ApplicationSearchRequest:
+			filter, _ := ldap.DecompileFilter(op.Children[6])
+			srv.Lock()
+			srv.searches = append(srv.searches, op.Children[0].Value.(string)+" "+filter)
+			entries := srv.entries
+			srv.Unlock()
+			for _, e := range entries {
+				conn.Write(ldapMessage(id, ldapEntry(e)))
+			}
+			conn.Write(ldapMessage(id, ldapResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)))
+		default: // unbind
+			return
+		}
+	}
+}
+
+func newLDAPEntry(dn string, attrs map[string]string) *ldap.Entry {
+	m := make(map[string][]string)
+	for k, v := range attrs {
+		m[k] = []string{v}
+	}
+	return ldap.NewEntry(dn, m)
+}
+
+func TestLDAPSync(t *testing.T) {
+	s := specs.New(t)
+	srv := newLDAPTestServer(t, "cn=folk,dc=example,dc=com", "hemmelig")
+	app := newTestApp(t, dept{1, "IT", 0}, dept{2, "Drift", 1}, dept{3, "HR", 0})
+	app.cfg.LDAPURL = srv.URL()
+	app.cfg.LDAPBindDN = "cn=folk,dc=example,dc=com"
+	app.cfg.LDAPBindPassword = "hemmelig"
+	app.cfg.LDAPBaseDN = "dc=example,dc=com"
+
+	// a person entered by hand, who is also in LDAP, and one who isn't
+	_, err := app.persons.Create(person{Name: "Kari", Email: "KARI@example.com", Department: 1, Img: "kari.png", Info: "sjef"})
+	s.ExpectNilFatal(err)
+	_, err = app.persons.Create(person{Name: "Manuell", Email: "manuell@example.com", Department: 1})
+	s.ExpectNilFatal(err)
+
+	srv.setEntries(
+		newLDAPEntry("cn=Kari,ou=HR,dc=example,dc=com",
+			map[string]string{"displayName": "Kari Nordmann", "mail": "kari@example.com", "title": "Leder"}),
+		newLDAPEntry("cn=Ola,ou=Drift,ou=IT,dc=example,dc=com",
+			map[string]string{"displayName": "Ola Nordmann", "mail": "ola@example.com", "telephoneNumber": "123"}),
+		newLDAPEntry("cn=Per,ou=Brukere,ou=HR,dc=example,dc=com",
+			map[string]string{"displayName": "Per", "mail": "per@example.com"}),
+		newLDAPEntry("cn=Ukjent,ou=Salg,dc=example,dc=com",
+			map[string]string{"displayName": "Ukjent", "mail": "ukjent@example.com"}),
+		newLDAPEntry("cn=Uten,ou=IT,dc=example,dc=com",
+			map[string]string{"displayName": "Uten e-post"}),
+	)
+
+	// a dry run only reports
+	rep, err := app.runLDAPSync(true, false)
+	s.ExpectNilFatal(err)
+	var buf bytes.Buffer
+	rep.write(&buf)
+	s.Expect(`+ Ola Nordmann <ola@example.com>
++ Per <per@example.com>
+~ 1 Kari Nordmann <kari@example.com>: Name: "Kari" -> "Kari Nordmann", Email: "KARI@example.com" -> "kari@example.com", Role: "" -> "Leder", Department: "IT" -> "HR", LDAPDN: "" -> "cn=Kari,ou=HR,dc=example,dc=com"
+! cn=Ukjent,ou=Salg,dc=example,dc=com: no OU names a department
+! cn=Uten,ou=IT,dc=example,dc=com: no mail
+2 persons would be created, 1 would be updated, 0 would be flagged as gone, 2 entries skipped
+`, buf.String())
+	s.Expect(2, app.persons.Size())
+	s.Expect([]string{"dc=example,dc=com (&(objectClass=person)(mail=*))"}, srv.searches)
+
+	rep, err = app.runLDAPSync(false, false)
+	s.ExpectNilFatal(err)
+	s.Expect(2, len(rep.Created))
+	app.bg.Wait()
+	s.Expect(4, app.persons.Size())
+	kari, err := app.persons.Get(1)
+	s.ExpectNilFatal(err)
+	s.Expect(person{ID: 1, Name: "Kari Nordmann", Email: "kari@example.com", Department: 3, Role: "Leder",
+		Img: "kari.png", Info: "sjef", LDAPDN: "cn=Kari,ou=HR,dc=example,dc=com"}, kari)
+	ola, err := app.persons.Get(app.persons.Lookup("email", "ola@example.com")[0])
+	s.ExpectNilFatal(err)
+	s.Expect(2, ola.Department)
+	s.Expect("123", ola.Phone)
+	s.Expect("dummy.png", ola.Img)
+
+	// nothing changed
+	rep, err = app.runLDAPSync(false, false)
+	s.ExpectNilFatal(err)
+	s.Expect(0, len(rep.Created)+len(rep.Updated)+len(rep.Gone))
+
+	// people gone from LDAP are flagged, not deleted, and unflagged if
+	// they come back
+	srv.setEntries(
+		newLDAPEntry("cn=Kari,ou=HR,dc=example,dc=com",
+			map[string]string{"displayName": "Kari Nordmann", "mail": "kari@example.com", "title": "Leder"}),
+		newLDAPEntry("cn=Per,ou=HR,dc=example,dc=com",
+			map[string]string{"displayName": "Per", "mail": "per@example.com"}),
+	)
+	rep, err = app.runLDAPSync(false, false)
+	s.ExpectNilFatal(err)
+	buf.Reset()
+	rep.write(&buf)
+	s.Expect(`~ 4 Per <per@example.com>: LDAPDN: "cn=Per,ou=Brukere,ou=HR,dc=example,dc=com" -> "cn=Per,ou=HR,dc=example,dc=com"
+- 3 Ola Nordmann <ola@example.com>: gone from LDAP
+0 persons created, 1 updated, 1 flagged as gone, 0 entries skipped
+`, buf.String())
+	s.Expect(4, app.persons.Size())
+	ola, _ = app.persons.Get(3)
+	s.Expect(true, ola.GoneFromLDAP)
+	manual, _ := app.persons.Get(2)
+	s.Expect(false, manual.GoneFromLDAP)
+
+	srv.setEntries(
+		newLDAPEntry("cn=Ola,ou=IT,dc=example,dc=com",
+			map[string]string{"displayName": "Ola Nordmann", "mail": "ola@example.com"}),
+	)
+	rep, err = app.runLDAPSync(true, false)
+	s.ExpectNilFatal(err)
+	s.Expect(1, len(rep.Updated))
+	s.ExpectMatches(strings.Join(rep.Updated[0].Diff, ", "), `Phone: "123" -> "", Department: "Drift" -> "IT", .*back in LDAP$`)
+
+	// a person whose entry can't be mapped is skipped, but not gone
+	srv.setEntries(
+		newLDAPEntry("cn=Kari,ou=Ledelse,dc=example,dc=com",
+			map[string]string{"displayName": "Kari Nordmann", "mail": "kari@example.com", "title": "Leder"}),
+		newLDAPEntry("cn=Per,ou=HR,dc=example,dc=com",
+			map[string]string{"displayName": "Per", "mail": "per@example.com"}),
+	)
+	rep, err = app.runLDAPSync(false, false)
+	s.ExpectNilFatal(err)
+	s.Expect(0, len(rep.Gone))
+	s.Expect(1, len(rep.Skipped))
+	kari, _ = app.persons.Get(1)
+	s.Expect(false, kari.GoneFromLDAP)
+	s.Expect(3, kari.Department)
+
+	// finding no entries fails, unless in a dry run, or forced
+	srv.setEntries()
+	_, err = app.runLDAPSync(false, false)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	s.ExpectMatches(err.Error(), "^found no entries in LDAP, which would flag all 2 synced persons as gone")
+	kari, _ = app.persons.Get(1)
+	s.Expect(false, kari.GoneFromLDAP)
+	rep, err = app.runLDAPSync(true, false)
+	s.ExpectNilFatal(err)
+	s.Expect(2, len(rep.Gone))
+	rep, err = app.runLDAPSync(false, true)
+	s.ExpectNilFatal(err)
+	s.Expect(2, len(rep.Gone))
+	kari, _ = app.persons.Get(1)
+	s.Expect(true, kari.GoneFromLDAP)
+	app.bg.Wait()
+}
+
+func TestLDAPSyncBindFails(t *testing.T) {
+	s := specs.New(t)
+	srv := newLDAPTestServer(t, "cn=folk,dc=example,dc=com", "hemmelig")
+	app := newTestApp(t, dept{1, "IT", 0})
+	app.cfg.LDAPURL = srv.URL()
+	app.cfg.LDAPBindDN = "cn=folk,dc=example,dc=com"
+	app.cfg.LDAPBindPassword = "feil"
+	app.cfg.LDAPBaseDN = "dc=example,dc=com"
+	_, err := app.runLDAPSync(false, false)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	s.ExpectMatches(err.Error(), "^LDAP: .*Invalid Credentials")
+}
+
+func TestParseLDAPAttributes(t *testing.T) {
+	s := specs.New(t)
+	attrs, err := parseLDAPAttributes(defaultConfig().LDAPAttributes)
+	s.ExpectNilFatal(err)
+	s.Expect(map[string]string{"Name": "displayName", "Email": "mail", "Phone": "telephoneNumber", "Role": "title"}, attrs)
+
+	for _, bad := range []string{"Name=cn", "Email", "Email=mail,Img=photo", "Email="} {
+		if _, err := parseLDAPAttributes(bad); err == nil {
+			t.Errorf("parseLDAPAttributes(%q): expected error", bad)
+		}
+	}
+}
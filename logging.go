@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// requestIDHeader carries the ID of a request, which is taken from the
+// request if it has a valid one, and otherwise generated. It is returned in
+// the response, and included in all log lines about the request.
+const requestIDHeader = "X-Request-ID"
+
+// requestInfo is what the access log knows about a request. It is filled in
+// by the handlers as the request is served.
+type requestInfo struct {
+	id    string
+	route string
+	user  string
+	token string // name of the API token used
+}
+
+type ctxKey int
+
+const requestInfoKey ctxKey = 0
+
+// requestInfoFrom returns the requestInfo of a request, or nil if it wasn't
+// served through logRequests.
+func requestInfoFrom(r *http.Request) *requestInfo {
+	info, _ := r.Context().Value(requestInfoKey).(*requestInfo)
+	return info
+}
+
+// validRequestID reports whether a request ID given by a client can be used:
+// it must be short and printable ASCII, so it can't forge log lines.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// accessLogEntry is a line in the access log.
+type accessLogEntry struct {
+	Time       string  `json:"time"`
+	RequestID  string  `json:"request_id"`
+	Method     string  `json:"method"`
+	Route      string  `json:"route,omitempty"` // empty if no route matched
+	Path       string  `json:"path"`
+	Status     int     `json:"status"`
+	DurationMs float64 `json:"duration_ms"`
+	User       string  `json:"user,omitempty"`
+	Token      string  `json:"token,omitempty"`
+}
+
+// errorLogEntry is a line in the log about an internal error in a handler.
+type errorLogEntry struct {
+	Time      string `json:"time"`
+	Level     string `json:"level"`
+	RequestID string `json:"request_id,omitempty"`
+	Msg       string `json:"msg"`
+}
+
+// logJSON writes v as a line of JSON to the app's log.
+func (app *App) logJSON(v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	app.logMu.Lock()
+	defer app.logMu.Unlock()
+	app.logOut.Write(append(b, '\n'))
+}
+
+// logError logs an internal error in a handler, with the request ID from the
+// request header h.
+func (app *App) logError(h http.Header, format string, args ...interface{}) {
+	app.logJSON(errorLogEntry{
+		Time:      time.Now().UTC().Format(time.RFC3339Nano),
+		Level:     "error",
+		RequestID: h.Get(requestIDHeader),
+		Msg:       fmt.Sprintf(format, args...),
+	})
+}
+
+// logRequests wraps h with access logging. It sets the request ID header on
+// the request, so handlers which only get the request header can log it, and
+// on the response.
+func (app *App) logRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t0 := time.Now()
+		path := r.URL.Path // before namespaces strip their prefix
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		r.Header.Set(requestIDHeader, id)
+		w.Header().Set(requestIDHeader, id)
+
+		info := &requestInfo{id: id, user: app.sessionUser(r)}
+		sw := &statusWriter{ResponseWriter: w}
+		h.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), requestInfoKey, info)))
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		app.logJSON(accessLogEntry{
+			Time:       t0.UTC().Format(time.RFC3339Nano),
+			RequestID:  id,
+			Method:     r.Method,
+			Route:      info.route,
+			Path:       path,
+			Status:     sw.status,
+			DurationMs: float64(time.Since(t0)) / float64(time.Millisecond),
+			User:       info.user,
+			Token:      info.token,
+		})
+	})
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/knakk/specs"
+)
+
+// logLines decodes the JSON lines written to the app log.
+func logLines(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+	var lines []map[string]interface{}
+	for _, l := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var m map[string]interface{}
+		if err := json.Unmarshal([]byte(l), &m); err != nil {
+			t.Fatalf("invalid log line %q: %v", l, err)
+		}
+		lines = append(lines, m)
+	}
+	buf.Reset()
+	return lines
+}
+
+func TestAccessLog(t *testing.T) {
+	s := specs.New(t)
+	app := newTestApp(t, dept{1, "main", 0})
+	var buf bytes.Buffer
+	app.logOut = &buf
+	testServer := httptest.NewServer(app)
+	defer testServer.Close()
+
+	// a request ID is generated
+	resp, err := http.Get(testServer.URL + "/api/person/1")
+	s.ExpectNilFatal(err)
+	resp.Body.Close()
+	id := resp.Header.Get("X-Request-ID")
+	s.ExpectMatches(id, "^[0-9a-f]{32}$")
+	lines := logLines(t, &buf)
+	s.Expect(1, len(lines))
+	s.Expect(id, lines[0]["request_id"])
+	s.Expect("GET", lines[0]["method"])
+	s.Expect("/api/person/{id}", lines[0]["route"])
+	s.Expect("/api/person/1", lines[0]["path"])
+	s.Expect(float64(404), lines[0]["status"])
+	s.Expect(nil, lines[0]["user"])
+	if _, ok := lines[0]["duration_ms"].(float64); !ok {
+		t.Errorf("duration_ms missing: %v", lines[0])
+	}
+
+	// a valid request ID is kept, an invalid one replaced
+	for _, tt := range []struct{ sent, want string }{
+		{"abc-123", "^abc-123$"},
+		{"bad id", "^[0-9a-f]{32}$"},
+		{strings.Repeat("x", 129), "^[0-9a-f]{32}$"},
+	} {
+		req, _ := http.NewRequest("GET", testServer.URL+"/nosuchpage", nil)
+		req.Header.Set("X-Request-ID", tt.sent)
+		resp, err := http.DefaultClient.Do(req)
+		s.ExpectNilFatal(err)
+		resp.Body.Close()
+		s.ExpectMatches(resp.Header.Get("X-Request-ID"), tt.want)
+		lines := logLines(t, &buf)
+		s.Expect(resp.Header.Get("X-Request-ID"), lines[0]["request_id"])
+		s.Expect(nil, lines[0]["route"])
+	}
+
+	// internal errors are logged with the request ID
+	bad := []byte(`{"Name": `)
+	s.ExpectNilFatal(app.persons.DB().Set(1, &bad))
+	resp, err = http.Get(testServer.URL + "/api/person/1")
+	s.ExpectNilFatal(err)
+	resp.Body.Close()
+	s.Expect(500, resp.StatusCode)
+	lines = logLines(t, &buf)
+	s.Expect(2, len(lines))
+	s.Expect("error", lines[0]["level"])
+	s.ExpectMatches(lines[0]["msg"].(string), regexp.QuoteMeta("GET /person/1: failed to decode document 1"))
+	s.Expect(resp.Header.Get("X-Request-ID"), lines[0]["request_id"])
+	s.Expect(resp.Header.Get("X-Request-ID"), lines[1]["request_id"])
+	s.Expect(float64(500), lines[1]["status"])
+}
+
+func TestAccessLogUser(t *testing.T) {
+	s := specs.New(t)
+	app := newTestApp(t)
+	var buf bytes.Buffer
+	app.logOut = &buf
+	testServer := httptest.NewServer(app)
+	defer testServer.Close()
+
+	resp, err := http.PostForm(testServer.URL+"/authenticate",
+		map[string][]string{"username": {"admin"}, "password": {"secret"}})
+	s.ExpectNilFatal(err)
+	resp.Body.Close()
+	s.Expect(200, resp.StatusCode)
+	lines := logLines(t, &buf)
+	s.Expect("admin", lines[0]["user"])
+	s.Expect("/authenticate", lines[0]["route"])
+}
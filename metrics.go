@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rcrowley/go-tigertonic"
+)
+
+// durationBuckets are the upper bounds, in seconds, of the latency
+// histograms.
+var durationBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// histogram counts observations in buckets, as a Prometheus histogram.
+type histogram struct {
+	counts []uint64 // per bucket in durationBuckets, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(v float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(durationBuckets))
+	}
+	for i, le := range durationBuckets {
+		if v <= le {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// write writes the histogram samples, with labels being the formatted labels
+// of the series, without braces.
+func (h *histogram) write(w io.Writer, name, labels string) {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	var cum uint64
+	for i, le := range durationBuckets {
+		if h.counts != nil {
+			cum += h.counts[i]
+		}
+		fmt.Fprintf(w, "%s_bucket{%s%sle=\"%s\"} %d\n", name, labels, sep, formatFloat(le), cum)
+	}
+	fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, sep, h.count)
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, labels, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, h.count)
+}
+
+type routeKey struct {
+	method, route string
+}
+
+type requestKey struct {
+	routeKey
+	code int
+}
+
+// metrics collects the metrics of an App which aren't read from its state
+// when they are written.
+type metrics struct {
+	sync.Mutex
+	requests  map[requestKey]uint64
+	durations map[routeKey]*histogram
+	search    histogram
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests:  make(map[requestKey]uint64),
+		durations: make(map[routeKey]*histogram),
+	}
+}
+
+func (m *metrics) observeRequest(method, route string, code int, d time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+	k := routeKey{method, route}
+	m.requests[requestKey{k, code}]++
+	h, ok := m.durations[k]
+	if !ok {
+		h = &histogram{}
+		m.durations[k] = h
+	}
+	h.observe(d.Seconds())
+}
+
+func (m *metrics) observeSearch(d time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+	m.search.observe(d.Seconds())
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labels formats label pairs, given as name, value, name, value...
+func labels(pairs ...string) string {
+	var b strings.Builder
+	for i := 0; i < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=\"%s\"", pairs[i], labelEscaper.Replace(pairs[i+1]))
+	}
+	return b.String()
+}
+
+// statusWriter records the status code written to a ResponseWriter.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush lets streaming handlers flush through the statusWriter.
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// instrument wraps h to record request counts and latencies for route, and
+// the route in the access log.
+func (app *App) instrument(method, route string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t0 := time.Now()
+		if info := requestInfoFrom(r); info != nil {
+			info.route = route
+		}
+		sw := &statusWriter{ResponseWriter: w}
+		h.ServeHTTP(sw, r)
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		app.metrics.observeRequest(method, route, sw.status, time.Since(t0))
+	})
+}
+
+// router registers handlers on a mux mounted at prefix, wrapped with the
+// per-route middleware.
+type router struct {
+	app    *App
+	mux    *tigertonic.TrieServeMux
+	prefix string
+}
+
+func (rt router) Handle(method, pattern string, h http.Handler) {
+	rt.mux.Handle(method, pattern, rt.app.instrument(method, rt.prefix+pattern, h))
+}
+
+func (rt router) HandleFunc(method, pattern string, h http.HandlerFunc) {
+	rt.Handle(method, pattern, h)
+}
+
+// writeMetrics writes the metrics in the Prometheus text format.
+func (app *App) writeMetrics(w io.Writer) {
+	gauge := func(name, help string, v float64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", name, help, name, name, formatFloat(v))
+	}
+	st := app.saver.Status()
+	gauge("folk_persons", "Number of persons in the database.", float64(app.persons.Size()))
+	gauge("folk_departments", "Number of departments.", float64(len(app.mapDepartments)))
+	gauge("folk_index_persons", "Number of persons in the search index.", float64(atomic.LoadInt64(&app.indexed)))
+	gauge("folk_unsaved_edits", "Number of edits not yet saved to disk.", float64(st.Dirty))
+	var lastSave float64
+	if !st.LastSave.IsZero() {
+		lastSave = float64(st.LastSave.UnixNano()) / 1e9
+	}
+	gauge("folk_last_save_timestamp_seconds", "Time of the last successful save, or 0.", lastSave)
+	fmt.Fprintf(w, "# HELP folk_save_failures_total Number of failed saves.\n# TYPE folk_save_failures_total counter\nfolk_save_failures_total %d\n", st.Failures)
+
+	m := app.metrics
+	m.Lock()
+	defer m.Unlock()
+
+	fmt.Fprint(w, "# HELP folk_http_requests_total Number of HTTP requests, by route and status code.\n# TYPE folk_http_requests_total counter\n")
+	reqs := make([]requestKey, 0, len(m.requests))
+	for k := range m.requests {
+		reqs = append(reqs, k)
+	}
+	sort.Slice(reqs, func(i, j int) bool {
+		a, b := reqs[i], reqs[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.code < b.code
+	})
+	for _, k := range reqs {
+		fmt.Fprintf(w, "folk_http_requests_total{%s} %d\n",
+			labels("method", k.method, "route", k.route, "code", strconv.Itoa(k.code)), m.requests[k])
+	}
+
+	fmt.Fprint(w, "# HELP folk_http_request_duration_seconds Latency of HTTP requests, by route.\n# TYPE folk_http_request_duration_seconds histogram\n")
+	routes := make([]routeKey, 0, len(m.durations))
+	for k := range m.durations {
+		routes = append(routes, k)
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].route != routes[j].route {
+			return routes[i].route < routes[j].route
+		}
+		return routes[i].method < routes[j].method
+	})
+	for _, k := range routes {
+		m.durations[k].write(w, "folk_http_request_duration_seconds", labels("method", k.method, "route", k.route))
+	}
+
+	fmt.Fprint(w, "# HELP folk_search_duration_seconds Latency of full text searches.\n# TYPE folk_search_duration_seconds histogram\n")
+	m.search.write(w, "folk_search_duration_seconds", "")
+}
+
+// GET /metrics
+func (app *App) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	app.writeMetrics(w)
+}
+
+// GET /healthz
+func (app *App) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprint(w, "OK")
+}
+
+// GET /readyz
+//
+// Responds with 503 and the list of problems if a database failed to load, or
+// the last save failed. The search index is built before the app starts
+// serving, so it is always loaded.
+func (app *App) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	var problems []string
+	for _, err := range app.loadErrs {
+		problems = append(problems, fmt.Sprintf("failed to load database: %v", err))
+	}
+	if st := app.saver.Status(); st.LastError != "" {
+		problems = append(problems, fmt.Sprintf("failed to save %s: %s", st.File, st.LastError))
+	}
+	if len(problems) > 0 {
+		http.Error(w, strings.Join(problems, "\n"), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprint(w, "OK")
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/knakk/specs"
+)
+
+func get(t *testing.T, url string) (int, string) {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+// sampleLine matches a sample in the Prometheus text format.
+var sampleLine = regexp.MustCompile(`^[a-z_]+(\{([a-z_]+="([^"\\]|\\.)*",?)*\})? [0-9.e+-]+$`)
+
+func TestMetrics(t *testing.T) {
+	s := specs.New(t)
+	app := newTestApp(t, dept{1, "main", 0})
+	app.persons.Create(person{Name: "Åse", Department: 1, Email: "a@b"})
+	app.index(1, person{Name: "Åse", Department: 1})
+	testServer := httptest.NewServer(app)
+	defer testServer.Close()
+
+	get(t, testServer.URL+"/api/person?q=åse")
+	get(t, testServer.URL+"/api/person/1")
+	get(t, testServer.URL+"/api/person/2")
+	code, body := get(t, testServer.URL+"/metrics")
+	s.Expect(200, code)
+
+	for _, l := range strings.Split(strings.TrimSuffix(body, "\n"), "\n") {
+		if !strings.HasPrefix(l, "# ") && !sampleLine.MatchString(l) {
+			t.Errorf("invalid sample: %q", l)
+		}
+	}
+	for _, want := range []string{
+		"\nfolk_persons 1\n",
+		"\nfolk_departments 1\n",
+		"\nfolk_index_persons 1\n",
+		"\nfolk_unsaved_edits 0\n",
+		`folk_http_requests_total{method="GET",route="/api/person",code="200"} 1`,
+		`folk_http_requests_total{method="GET",route="/api/person/{id}",code="200"} 1`,
+		`folk_http_requests_total{method="GET",route="/api/person/{id}",code="404"} 1`,
+		`folk_http_request_duration_seconds_count{method="GET",route="/api/person/{id}"} 2`,
+		`folk_http_request_duration_seconds_bucket{method="GET",route="/api/person",le="+Inf"} 1`,
+		"\nfolk_search_duration_seconds_count 1\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics don't contain %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestHealth(t *testing.T) {
+	s := specs.New(t)
+	app := newTestApp(t)
+	testServer := httptest.NewServer(app)
+	defer testServer.Close()
+
+	code, _ := get(t, testServer.URL+"/healthz")
+	s.Expect(200, code)
+	code, _ = get(t, testServer.URL+"/readyz")
+	s.Expect(200, code)
+
+	// a failed save
+	app.saver.file = filepath.Join(t.TempDir(), "missing", "folk.db")
+	app.saver.Inc()
+	app.saver.Flush()
+	code, body := get(t, testServer.URL+"/readyz")
+	s.Expect(503, code)
+	s.ExpectMatches(body, "failed to save .*folk.db")
+	code, _ = get(t, testServer.URL+"/healthz")
+	s.Expect(200, code)
+}
+
+func TestReadyzLoadError(t *testing.T) {
+	s := specs.New(t)
+	dir := t.TempDir()
+	writeTestData(t, dir)
+	s.ExpectNilFatal(ioutil.WriteFile(filepath.Join(dir, "folk.db"), []byte("[{"), 0644))
+	cfg := defaultConfig()
+	cfg.DataDir = dir
+	app, err := NewApp(cfg)
+	s.ExpectNilFatal(err)
+	testServer := httptest.NewServer(app)
+	defer testServer.Close()
+
+	code, body := get(t, testServer.URL+"/readyz")
+	s.Expect(503, code)
+	s.ExpectMatches(body, "failed to load database")
+
+	// a missing database is not an error
+	s.ExpectNilFatal(os.Remove(filepath.Join(dir, "folk.db")))
+	app, err = NewApp(cfg)
+	s.ExpectNilFatal(err)
+	s.Expect(0, len(app.loadErrs))
+}
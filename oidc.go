@@ -0,0 +1,425 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// oidcMetadata is the part of the OpenID provider metadata, from
+// <issuer>/.well-known/openid-configuration, which folk uses.
+type oidcMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+func (k jwk) rsaKey() (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, err
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+}
+
+// audience is the aud claim, which is either a string or a list of strings.
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*a = audience{s}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(a))
+}
+
+func (a audience) contains(s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// idTokenClaims are the claims of an ID token which folk uses.
+type idTokenClaims struct {
+	Issuer        string   `json:"iss"`
+	Subject       string   `json:"sub"`
+	Audience      audience `json:"aud"`
+	Expiry        int64    `json:"exp"`
+	Nonce         string   `json:"nonce"`
+	Email         string   `json:"email"`
+	EmailVerified *bool    `json:"email_verified"`
+	Groups        []string `json:"groups"`
+}
+
+// oidcClockSkew is how much the clocks of folk and the provider may differ.
+const oidcClockSkew = time.Minute
+
+// oidcProvider logs users in with an OpenID Connect provider, using the
+// authorization code flow with PKCE. The provider metadata and keys are
+// fetched on first use, so folk starts even if the provider is down.
+type oidcProvider struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	redirectURL  string
+	client       *http.Client
+	now          func() time.Time
+
+	sync.Mutex
+	meta *oidcMetadata
+	keys map[string]*rsa.PublicKey
+}
+
+func newOIDCProvider(cfg Config) *oidcProvider {
+	return &oidcProvider{
+		issuer:       strings.TrimSuffix(cfg.OIDCIssuer, "/"),
+		clientID:     cfg.OIDCClientID,
+		clientSecret: cfg.OIDCClientSecret,
+		redirectURL:  cfg.OIDCRedirectURL,
+		client:       &http.Client{Timeout: 10 * time.Second},
+		now:          time.Now,
+	}
+}
+
+// getJSON gets url and decodes the JSON response into v.
+func (p *oidcProvider) getJSON(url string, v interface{}) error {
+	resp, err := p.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// metadata returns the provider metadata, discovering it if needed.
+func (p *oidcProvider) metadata() (*oidcMetadata, error) {
+	p.Lock()
+	defer p.Unlock()
+	if p.meta != nil {
+		return p.meta, nil
+	}
+	var meta oidcMetadata
+	if err := p.getJSON(p.issuer+"/.well-known/openid-configuration", &meta); err != nil {
+		return nil, err
+	}
+	if meta.Issuer != p.issuer {
+		return nil, fmt.Errorf("provider metadata has issuer %q, want %q", meta.Issuer, p.issuer)
+	}
+	p.meta = &meta
+	return p.meta, nil
+}
+
+// key returns the signing key with the given ID. The keys are fetched again
+// if it is unknown, as the provider may have rotated them.
+func (p *oidcProvider) key(kid string) (*rsa.PublicKey, error) {
+	meta, err := p.metadata()
+	if err != nil {
+		return nil, err
+	}
+	p.Lock()
+	defer p.Unlock()
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := p.getJSON(meta.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	p.keys = make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		if pk, err := k.rsaKey(); err == nil {
+			p.keys[k.Kid] = pk
+		}
+	}
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// authURL returns the URL to send the user to for logging in.
+func (p *oidcProvider) authURL(state, nonce, verifier string) (string, error) {
+	meta, err := p.metadata()
+	if err != nil {
+		return "", err
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.clientID},
+		"redirect_uri":          {p.redirectURL},
+		"scope":                 {"openid email profile"},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(meta.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return meta.AuthorizationEndpoint + sep + q.Encode(), nil
+}
+
+// exchange exchanges an authorization code for an ID token.
+func (p *oidcProvider) exchange(code, verifier string) (string, error) {
+	meta, err := p.metadata()
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.redirectURL},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequest("POST", meta.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(p.clientID), url.QueryEscape(p.clientSecret))
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var res struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return "", fmt.Errorf("token response: %v", err)
+	}
+	if res.Error != "" {
+		return "", fmt.Errorf("token request failed: %s %s", res.Error, res.ErrorDescription)
+	}
+	if resp.StatusCode != http.StatusOK || res.IDToken == "" {
+		return "", fmt.Errorf("token request failed: %s", resp.Status)
+	}
+	return res.IDToken, nil
+}
+
+// verify checks the signature and claims of an RS256 signed ID token, and
+// returns its claims.
+func (p *oidcProvider) verify(token, nonce string) (*idTokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed ID token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(b, &header) != nil {
+		return nil, errors.New("malformed ID token header")
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("unsupported ID token algorithm %q", header.Alg)
+	}
+	key, err := p.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed ID token signature")
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+		return nil, errors.New("invalid ID token signature")
+	}
+
+	var claims idTokenClaims
+	b, err = base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(b, &claims) != nil {
+		return nil, errors.New("malformed ID token claims")
+	}
+	switch {
+	case claims.Issuer != p.issuer:
+		return nil, fmt.Errorf("ID token has issuer %q, want %q", claims.Issuer, p.issuer)
+	case !claims.Audience.contains(p.clientID):
+		return nil, errors.New("ID token is not for this client")
+	case p.now().Add(-oidcClockSkew).After(time.Unix(claims.Expiry, 0)):
+		return nil, errors.New("ID token has expired")
+	case nonce == "" || claims.Nonce != nonce:
+		return nil, errors.New("ID token has the wrong nonce")
+	}
+	return &claims, nil
+}
+
+// oidcRoles maps the claims of users logging in with OIDC to folk roles,
+// which are named as the token scopes. Each entry of the config is an email
+// address, or a group as "group:<name>".
+type oidcRoles struct {
+	admins  []string
+	editors []string
+}
+
+func newOIDCRoles(cfg Config) oidcRoles {
+	return oidcRoles{
+		admins:  splitList(cfg.OIDCAdmins),
+		editors: splitList(cfg.OIDCEditors),
+	}
+}
+
+// splitList splits a comma separated list, dropping empty entries.
+func splitList(s string) []string {
+	var l []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			l = append(l, v)
+		}
+	}
+	return l
+}
+
+// role returns the role of a user, or "" if the user has none. Unverified
+// email addresses are ignored.
+func (r oidcRoles) role(c *idTokenClaims) string {
+	matches := func(entries []string) bool {
+		for _, e := range entries {
+			if g := strings.TrimPrefix(e, "group:"); g != e {
+				for _, cg := range c.Groups {
+					if cg == g {
+						return true
+					}
+				}
+			} else if c.Email != "" && (c.EmailVerified == nil || *c.EmailVerified) &&
+				strings.EqualFold(e, c.Email) {
+				return true
+			}
+		}
+		return false
+	}
+	switch {
+	case matches(r.admins):
+		return scopeAdmin
+	case matches(r.editors):
+		return scopePersonsWrite
+	}
+	return ""
+}
+
+// GET /oidc/login
+//
+// Redirects to the provider, with the state, nonce and PKCE verifier kept in
+// the session for the callback.
+func (app *App) oidcLoginHandler(w http.ResponseWriter, r *http.Request) {
+	session := app.createSession(r)
+	state, nonce, verifier := newToken(), newToken(), newToken()
+	u, err := app.oidc.authURL(state, nonce, verifier)
+	if err != nil {
+		app.logError(r.Header, "OIDC discovery: %v", err)
+		http.Error(w, "innlogging er ikke tilgjengelig", http.StatusBadGateway)
+		return
+	}
+	session.Values["oidc_state"] = state
+	session.Values["oidc_nonce"] = nonce
+	session.Values["oidc_verifier"] = verifier
+	if err := session.Save(r, w); err != nil {
+		app.logError(r.Header, "failed to save session: %v", err)
+	}
+	http.Redirect(w, r, u, http.StatusFound)
+}
+
+// GET /oidc/callback
+//
+// Logs the user in, if the provider authenticated them and they have a role,
+// and redirects to the admin page.
+func (app *App) oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	session := app.createSession(r)
+	state, _ := session.Values["oidc_state"].(string)
+	nonce, _ := session.Values["oidc_nonce"].(string)
+	verifier, _ := session.Values["oidc_verifier"].(string)
+	// the state is only good for one callback
+	delete(session.Values, "oidc_state")
+	delete(session.Values, "oidc_nonce")
+	delete(session.Values, "oidc_verifier")
+	save := func() {
+		if err := session.Save(r, w); err != nil {
+			app.logError(r.Header, "failed to save session: %v", err)
+		}
+	}
+
+	q := r.URL.Query()
+	if state == "" || q.Get("state") != state {
+		save()
+		http.Error(w, "ugyldig innlogging, prøv igjen", http.StatusBadRequest)
+		return
+	}
+	if e := q.Get("error"); e != "" {
+		save()
+		http.Error(w, "innlogging avvist: "+e, http.StatusUnauthorized)
+		return
+	}
+	idToken, err := app.oidc.exchange(q.Get("code"), verifier)
+	if err != nil {
+		save()
+		app.logError(r.Header, "OIDC: %v", err)
+		http.Error(w, "innlogging feilet", http.StatusBadGateway)
+		return
+	}
+	claims, err := app.oidc.verify(idToken, nonce)
+	if err != nil {
+		save()
+		app.logError(r.Header, "OIDC: %v", err)
+		http.Error(w, "innlogging feilet", http.StatusUnauthorized)
+		return
+	}
+	role := app.oidcRoles.role(claims)
+	if role == "" {
+		save()
+		http.Error(w, "du har ikke tilgang til folk", http.StatusForbidden)
+		return
+	}
+
+	user := claims.Email
+	if user == "" {
+		user = claims.Subject
+	}
+	session.Values["user"] = user
+	session.Values["role"] = role
+	session.Values["csrf"] = newToken()
+	save()
+	if info := requestInfoFrom(r); info != nil {
+		info.user = user
+	}
+	http.Redirect(w, r, "/admin", http.StatusFound)
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/knakk/specs"
+)
+
+// mockOIDC is an OpenID provider, which logs in whoever is set in claims.
+type mockOIDC struct {
+	*httptest.Server
+	t   *testing.T
+	key *rsa.PrivateKey
+
+	sync.Mutex
+	claims map[string]interface{} // added to the claims of the ID token
+	codes  map[string]url.Values  // the authorization request of each code
+}
+
+func newMockOIDC(t *testing.T) *mockOIDC {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockOIDC{t: t, key: key, codes: make(map[string]url.Values)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcMetadata{
+			Issuer:                m.URL,
+			AuthorizationEndpoint: m.URL + "/authorize",
+			TokenEndpoint:         m.URL + "/token",
+			JWKSURI:               m.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string][]jwk{"keys": {{
+			Kty: "RSA",
+			Kid: "k1",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("client_id") != "folk" || q.Get("response_type") != "code" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		code := newToken()
+		m.Lock()
+		m.codes[code] = q
+		m.Unlock()
+		http.Redirect(w, r, q.Get("redirect_uri")+"?"+url.Values{
+			"code":  {code},
+			"state": {q.Get("state")},
+		}.Encode(), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		m.Lock()
+		q, ok := m.codes[r.FormValue("code")]
+		delete(m.codes, r.FormValue("code"))
+		m.Unlock()
+		challenge := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if id != "folk" || secret != "hemmelig" || !ok ||
+			base64.RawURLEncoding.EncodeToString(challenge[:]) != q.Get("code_challenge") ||
+			r.FormValue("redirect_uri") != q.Get("redirect_uri") {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		claims := map[string]interface{}{
+			"iss":   m.URL,
+			"sub":   "1234",
+			"aud":   "folk",
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"nonce": q.Get("nonce"),
+		}
+		m.Lock()
+		for k, v := range m.claims {
+			claims[k] = v
+		}
+		m.Unlock()
+		json.NewEncoder(w).Encode(map[string]string{"id_token": m.sign(claims)})
+	})
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+// sign returns an RS256 signed JWT of claims.
+func (m *mockOIDC) sign(claims map[string]interface{}) string {
+	enc := func(v interface{}) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			m.t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signed := enc(map[string]string{"alg": "RS256", "kid": "k1", "typ": "JWT"}) + "." + enc(claims)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, m.key, crypto.SHA256, digest[:])
+	if err != nil {
+		m.t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestOIDCLogin(t *testing.T) {
+	s := specs.New(t)
+	provider := newMockOIDC(t)
+	dir := t.TempDir()
+	writeTestData(t, dir)
+	cfg := defaultConfig()
+	cfg.DataDir = dir
+	cfg.OIDCIssuer = provider.URL
+	cfg.OIDCClientID = "folk"
+	cfg.OIDCClientSecret = "hemmelig"
+	cfg.OIDCRedirectURL = "https://folk.example.com/oidc/callback"
+	cfg.OIDCAdmins = "boss@example.com, group:folk-admins"
+	cfg.OIDCEditors = "group:hr"
+	app, err := NewApp(cfg)
+	s.ExpectNilFatal(err)
+	app.logOut = testLogWriter{t}
+
+	noRedirect := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	serve := func(target string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, req)
+		return w
+	}
+	// login goes through the login flow, with the provider logging in the
+	// user in claims, and returns the response to the callback, and the
+	// callback URL.
+	login := func(claims map[string]interface{}) (*httptest.ResponseRecorder, string) {
+		provider.Lock()
+		provider.claims = claims
+		provider.Unlock()
+		w := serve("/oidc/login", nil)
+		s.Expect(http.StatusFound, w.Code)
+		cookies := w.Result().Cookies()
+		resp, err := noRedirect.Get(w.Header().Get("Location"))
+		s.ExpectNilFatal(err)
+		resp.Body.Close()
+		s.Expect(http.StatusFound, resp.StatusCode)
+		callback, err := url.Parse(resp.Header.Get("Location"))
+		s.ExpectNilFatal(err)
+		s.Expect("folk.example.com", callback.Host)
+		return serve(callback.RequestURI(), cookies), callback.RequestURI()
+	}
+
+	var tests = []struct {
+		claims   map[string]interface{}
+		wantCode int
+		wantUser string
+		canAdmin bool
+	}{
+		{map[string]interface{}{"email": "boss@example.com"}, http.StatusFound, "boss@example.com", true},
+		{map[string]interface{}{"email": "it@example.com", "groups": []string{"folk-admins"}}, http.StatusFound, "it@example.com", true},
+		{map[string]interface{}{"email": "hr@example.com", "groups": []string{"staff", "hr"}}, http.StatusFound, "hr@example.com", false},
+		{map[string]interface{}{"email": "staff@example.com", "groups": []string{"staff"}}, http.StatusForbidden, "", false},
+		{map[string]interface{}{"email": "boss@example.com", "email_verified": false}, http.StatusForbidden, "", false},
+		{map[string]interface{}{"email": "boss@example.com", "aud": "other"}, http.StatusUnauthorized, "", false},
+		{map[string]interface{}{"email": "boss@example.com", "iss": "https://evil.example.com"}, http.StatusUnauthorized, "", false},
+		{map[string]interface{}{"email": "boss@example.com", "nonce": "replayed"}, http.StatusUnauthorized, "", false},
+		{map[string]interface{}{"email": "boss@example.com", "exp": time.Now().Add(-time.Hour).Unix()}, http.StatusUnauthorized, "", false},
+	}
+	for _, tt := range tests {
+		w, _ := login(tt.claims)
+		if w.Code != tt.wantCode {
+			t.Errorf("login with %v => %d %s; want %d", tt.claims, w.Code, w.Body.String(), tt.wantCode)
+			continue
+		}
+		if tt.wantCode != http.StatusFound {
+			continue
+		}
+		s.Expect("/admin", w.Header().Get("Location"))
+		cookies := w.Result().Cookies()
+		req := httptest.NewRequest("GET", "/", nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		s.Expect(tt.wantUser, app.sessionUser(req))
+		code := serve("/api/tokens", cookies).Code
+		if tt.canAdmin {
+			s.Expect(http.StatusOK, code)
+		} else {
+			s.Expect(http.StatusForbidden, code)
+		}
+	}
+
+	// the callback needs the state from the login
+	w, callback := login(map[string]interface{}{"email": "boss@example.com"})
+	s.Expect(http.StatusFound, w.Code)
+	s.Expect(http.StatusBadRequest, serve(callback, nil).Code)
+	s.Expect(http.StatusBadRequest, serve(callback, w.Result().Cookies()).Code)
+}
+
+func TestOIDCVerify(t *testing.T) {
+	s := specs.New(t)
+	provider := newMockOIDC(t)
+	p := newOIDCProvider(Config{OIDCIssuer: provider.URL, OIDCClientID: "folk"})
+	claims := map[string]interface{}{
+		"iss":   provider.URL,
+		"aud":   []string{"other", "folk"},
+		"exp":   time.Now().Add(time.Minute).Unix(),
+		"nonce": "n",
+		"email": "a@example.com",
+	}
+	token := provider.sign(claims)
+	c, err := p.verify(token, "n")
+	s.ExpectNilFatal(err)
+	s.Expect("a@example.com", c.Email)
+
+	_, err = p.verify(token, "")
+	s.ExpectNot(nil, err)
+	parts := strings.Split(token, ".")
+	_, err = p.verify(parts[0]+"."+parts[1]+"x."+parts[2], "n")
+	s.Expect("invalid ID token signature", err.Error())
+	_, err = p.verify(base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))+"."+parts[1]+".", "n")
+	s.Expect(`unsupported ID token algorithm "none"`, err.Error())
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers/legacy"
+	"github.com/knakk/specs"
+)
+
+func loadOpenAPI(t *testing.T) *openapi3.T {
+	t.Helper()
+	doc, err := openapi3.NewLoader().LoadFromFile("data/openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := doc.Validate(context.Background()); err != nil {
+		t.Fatalf("invalid OpenAPI document: %v", err)
+	}
+	return doc
+}
+
+// apiRoutes returns the method and path of every route registered in
+// setupAPIRouting.
+func apiRoutes(t *testing.T) [][2]string {
+	t.Helper()
+	f, err := parser.ParseFile(token.NewFileSet(), "api.go", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var routes [][2]string
+	for _, d := range f.Decls {
+		fn, ok := d.(*ast.FuncDecl)
+		if !ok || fn.Name.Name != "setupAPIRouting" {
+			continue
+		}
+		ast.Inspect(fn.Body, func(n ast.Node) bool {
+			call, ok := n.(*ast.CallExpr)
+			if !ok || len(call.Args) < 2 {
+				return true
+			}
+			sel, ok := call.Fun.(*ast.SelectorExpr)
+			if !ok || (sel.Sel.Name != "Handle" && sel.Sel.Name != "HandleFunc") {
+				return true
+			}
+			method, ok1 := call.Args[0].(*ast.BasicLit)
+			path, ok2 := call.Args[1].(*ast.BasicLit)
+			if !ok1 || !ok2 {
+				t.Fatalf("route with non-literal method or path at %v", call.Pos())
+			}
+			m, _ := strconv.Unquote(method.Value)
+			p, _ := strconv.Unquote(path.Value)
+			routes = append(routes, [2]string{m, p})
+			return true
+		})
+	}
+	if len(routes) == 0 {
+		t.Fatal("no routes found in setupAPIRouting")
+	}
+	return routes
+}
+
+func TestOpenAPIRoutes(t *testing.T) {
+	doc := loadOpenAPI(t)
+	described := make(map[[2]string]bool)
+	for path, item := range doc.Paths.Map() {
+		for method := range item.Operations() {
+			described[[2]string{method, path}] = true
+		}
+	}
+	for _, r := range apiRoutes(t) {
+		if !described[r] {
+			t.Errorf("%s %s is not described in data/openapi.json", r[0], r[1])
+		}
+		delete(described, r)
+	}
+	for r := range described {
+		t.Errorf("%s %s is described in data/openapi.json, but not routed", r[0], r[1])
+	}
+}
+
+func TestOpenAPIResponses(t *testing.T) {
+	s := specs.New(t)
+	for _, ct := range []string{"text/vcard", "text/event-stream", "application/x-ndjson"} {
+		openapi3filter.RegisterBodyDecoder(ct, openapi3filter.FileBodyDecoder)
+	}
+	defer func() {
+		for _, ct := range []string{"text/vcard", "text/event-stream", "application/x-ndjson"} {
+			openapi3filter.UnregisterBodyDecoder(ct)
+		}
+	}()
+
+	app := newTestApp(t, dept{1, "IT", 0}, dept{2, "Drift", 1})
+	for name, scope := range map[string]string{"adminsecret": scopeAdmin, "writesecret": scopePersonsWrite, "readsecret": scopeRead} {
+		_, err := app.tokens.Create(apiToken{Name: name, Scope: scope, Hash: hashToken(name), Created: time.Now()})
+		s.ExpectNilFatal(err)
+	}
+	srv := httptest.NewServer(app)
+	defer srv.Close()
+
+	// the document's server URL is relative, which the router doesn't match
+	doc := loadOpenAPI(t)
+	doc.Servers = openapi3.Servers{{URL: srv.URL + "/api"}}
+	router, err := legacy.NewRouter(doc)
+	s.ExpectNilFatal(err)
+
+	const (
+		jsonType = "application/json"
+		csvType  = "text/csv"
+	)
+	var tests = []struct {
+		method, path, token, contentType, body string
+		wantCode                               int
+	}{
+		{"POST", "/api/person", "writesecret", jsonType, `{"Name":"Kari","Email":"kari@example.com","Department":1}`, 201},
+		{"POST", "/api/person", "writesecret", jsonType, `{"Name":"Ola","Email":"ola@example.com","Department":2}`, 201},
+		{"POST", "/api/person", "writesecret", jsonType, `{"Name":"Kari","Email":"kari@example.com","Department":1}`, 409},
+		{"POST", "/api/person", "writesecret", jsonType, `{"Name":"Kari"}`, 400},
+		{"POST", "/api/person", "", jsonType, `{"Name":"Per","Email":"per@example.com","Department":1}`, 401},
+		{"POST", "/api/person", "readsecret", jsonType, `{"Name":"Per","Email":"per@example.com","Department":1}`, 403},
+		{"GET", "/api/person", "", "", "", 200},
+		{"GET", "/api/person?q=kari", "", "", "", 200},
+		{"GET", "/api/person?email=ola@example.com", "", "", "", 200},
+		{"GET", "/api/person/1", "readsecret", "", "", 200},
+		{"GET", "/api/person/1.vcf", "", "", "", 200},
+		{"GET", "/api/person/9", "", "", "", 404},
+		{"PATCH", "/api/person/1?full=yes", "writesecret", jsonType, `{"Name":"Kari N","Email":"kari@example.com","Department":1,"Role":"Leder"}`, 200},
+		{"PATCH", "/api/person/9", "writesecret", jsonType, `{"Name":"x","Email":"x@example.com","Department":1}`, 404},
+		{"GET", "/api/person/changes", "", "", "", 200},
+		{"GET", "/api/person/changes?since=99", "", "", "", 200},
+		{"POST", "/api/batch", "writesecret", jsonType, `{"Operations":[{"Op":"create","Person":{"Name":"Per","Email":"per@example.com","Department":2}},{"Op":"update","ID":2,"Person":{"Role":"Sjef"}}]}`, 200},
+		{"POST", "/api/batch", "writesecret", jsonType, `{"Operations":[{"Op":"delete","ID":9}]}`, 404},
+		{"POST", "/api/import?dryrun=yes", "writesecret", csvType, "Name,Email,Department\nLise,lise@example.com,1\n", 200},
+		{"POST", "/api/import", "writesecret", csvType, "Name,Email,Department\nLise,lise@example.com,9\n", 200},
+		{"POST", "/api/import", "writesecret", csvType, "", 400},
+		{"GET", "/api/export", "", "", "", 200},
+		{"GET", "/api/export?format=csv&dept=IT", "", "", "", 200},
+		{"GET", "/api/export?format=ndjson", "", "", "", 200},
+		{"GET", "/api/export?format=xml", "", "", "", 400},
+		{"GET", "/api/status", "", "", "", 200},
+		{"GET", "/api/changes", "", "", "", 200},
+		{"GET", "/api/department/1/persons", "", "", "", 200},
+		{"GET", "/api/department/9/persons", "", "", "", 404},
+		{"GET", "/api/department/1.vcf", "", "", "", 200},
+		{"DELETE", "/api/person/3", "writesecret", "", "", 200},
+		{"DELETE", "/api/person/3", "writesecret", "", "", 404},
+		{"GET", "/api/tokens", "", "", "", 401},
+		{"GET", "/api/tokens", "nosecret", "", "", 401},
+		{"GET", "/api/tokens", "adminsecret", "", "", 200},
+		{"POST", "/api/tokens", "adminsecret", jsonType, `{"Name":"sync","Scope":"persons:write"}`, 201},
+		{"POST", "/api/tokens", "adminsecret", jsonType, `{"Name":"sync","Scope":"root"}`, 400},
+		{"DELETE", "/api/tokens/4", "adminsecret", "", "", 200},
+		{"DELETE", "/api/tokens/9", "adminsecret", "", "", 404},
+		{"GET", "/api/webhooks", "adminsecret", "", "", 200},
+		{"POST", "/api/webhooks", "adminsecret", jsonType, `{"URL":"http://127.0.0.1:1/hook","Events":["person.deleted"]}`, 201},
+		{"POST", "/api/webhooks", "adminsecret", jsonType, `{"URL":"ftp://example.com"}`, 400},
+		{"GET", "/api/webhooks/1/deliveries", "adminsecret", "", "", 200},
+		{"GET", "/api/webhooks/9/deliveries", "adminsecret", "", "", 404},
+		{"POST", "/api/deliveries/9/redeliver", "adminsecret", "", "", 404},
+		{"DELETE", "/api/webhooks/1", "adminsecret", "", "", 200},
+		{"GET", "/api/openapi.json", "", "", "", 200},
+	}
+	for _, tt := range tests {
+		ctx, cancel := context.WithCancel(context.Background())
+		req, err := http.NewRequest(tt.method, srv.URL+tt.path, strings.NewReader(tt.body))
+		s.ExpectNilFatal(err)
+		req = req.WithContext(ctx)
+		if tt.contentType != "" {
+			req.Header.Set("Content-Type", tt.contentType)
+		}
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		route, params, err := router.FindRoute(req)
+		if err != nil {
+			t.Errorf("%s %s: %v", tt.method, tt.path, err)
+			cancel()
+			continue
+		}
+		in := &openapi3filter.RequestValidationInput{
+			Request:    req,
+			PathParams: params,
+			Route:      route,
+			Options:    &openapi3filter.Options{AuthenticationFunc: openapi3filter.NoopAuthenticationFunc},
+		}
+		// requests made to get an error may well be invalid
+		if err := openapi3filter.ValidateRequest(ctx, in); err != nil && tt.wantCode < 400 {
+			t.Errorf("%s %s: invalid request: %v", tt.method, tt.path, err)
+		}
+		req.Body = ioutil.NopCloser(strings.NewReader(tt.body))
+
+		resp, err := http.DefaultClient.Do(req)
+		s.ExpectNilFatal(err)
+		var body []byte
+		if resp.Header.Get("Content-Type") != "text/event-stream" {
+			body, err = ioutil.ReadAll(resp.Body)
+			s.ExpectNil(err)
+		}
+		resp.Body.Close()
+		cancel()
+		if resp.StatusCode != tt.wantCode {
+			t.Errorf("%s %s => %d %s; want %d", tt.method, tt.path, resp.StatusCode, body, tt.wantCode)
+			continue
+		}
+		err = openapi3filter.ValidateResponse(context.Background(), &openapi3filter.ResponseValidationInput{
+			RequestValidationInput: in,
+			Status:                 resp.StatusCode,
+			Header:                 resp.Header,
+			Body:                   ioutil.NopCloser(bytes.NewReader(body)),
+			Options:                &openapi3filter.Options{IncludeResponseStatus: true},
+		})
+		if err != nil {
+			t.Errorf("%s %s => %d %s: invalid response: %v", tt.method, tt.path, resp.StatusCode, body, err)
+		}
+	}
+	app.bg.Wait()
+}
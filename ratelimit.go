@@ -0,0 +1,320 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxBuckets is the number of keys a limiter tracks before it forgets the
+// ones which have refilled.
+const maxBuckets = 10000
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// limiter is a token bucket rate limiter per key. Each key may make burst
+// requests at once, and rate requests per second on average.
+type limiter struct {
+	sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*bucket
+	now     func() time.Time
+}
+
+func newLimiter(rate float64, burst int) *limiter {
+	return &limiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+// allow takes a token for key. If there are none, it returns false and how
+// long to wait for the next one.
+func (l *limiter) allow(key string) (bool, time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+	now := l.now()
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxBuckets {
+			l.prune(now)
+		}
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// prune forgets the buckets which are full by now, as they are the same as
+// new buckets.
+func (l *limiter) prune(now time.Time) {
+	for k, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+// lockout locks a key out after threshold failures in a row. The first
+// lockout lasts base, and each further failure doubles it, up to max.
+type lockout struct {
+	sync.Mutex
+	threshold int
+	base, max time.Duration
+	failures  map[string]*failures
+	now       func() time.Time
+}
+
+type failures struct {
+	count int
+	until time.Time
+}
+
+func newLockout(threshold int, base, max time.Duration) *lockout {
+	return &lockout{
+		threshold: threshold,
+		base:      base,
+		max:       max,
+		failures:  make(map[string]*failures),
+		now:       time.Now,
+	}
+}
+
+// locked returns how long key is still locked out, or 0.
+func (l *lockout) locked(key string) time.Duration {
+	l.Lock()
+	defer l.Unlock()
+	if f, ok := l.failures[key]; ok {
+		if d := f.until.Sub(l.now()); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// fail records a failure for key.
+func (l *lockout) fail(key string) {
+	l.Lock()
+	defer l.Unlock()
+	f, ok := l.failures[key]
+	if !ok {
+		if len(l.failures) >= maxBuckets {
+			l.prune()
+		}
+		f = &failures{}
+		l.failures[key] = f
+	}
+	f.count++
+	if n := f.count - l.threshold; n >= 0 {
+		f.until = l.now().Add(l.backoff(n))
+	}
+}
+
+// backoff returns base doubled n times, up to max. It doubles step by step,
+// as shifting base by n overflows long before n is large enough to reach max.
+func (l *lockout) backoff(n int) time.Duration {
+	d := l.base
+	for i := 0; i < n && d > 0 && d < l.max; i++ {
+		if d > l.max/2 {
+			d = l.max
+		} else {
+			d *= 2
+		}
+	}
+	if d > l.max {
+		d = l.max
+	}
+	return d
+}
+
+// succeed forgets the failures of key.
+func (l *lockout) succeed(key string) {
+	l.Lock()
+	defer l.Unlock()
+	delete(l.failures, key)
+}
+
+// prune forgets the keys which aren't locked out.
+func (l *lockout) prune() {
+	now := l.now()
+	for k, f := range l.failures {
+		if f.until.Before(now) {
+			delete(l.failures, k)
+		}
+	}
+}
+
+// authLimits protects /authenticate against password guessing.
+type authLimits struct {
+	byIP    *limiter
+	byUser  *limiter
+	lockout *lockout // per IP and username
+}
+
+func newAuthLimits(cfg Config) *authLimits {
+	rate := float64(cfg.LoginRatePerMinute) / 60
+	return &authLimits{
+		byIP:   newLimiter(rate, cfg.LoginBurst),
+		byUser: newLimiter(rate, cfg.LoginBurst),
+		lockout: newLockout(cfg.LockoutThreshold,
+			time.Duration(cfg.LockoutSeconds)*time.Second, time.Hour),
+	}
+}
+
+// check returns how long the client must wait before trying to log in as
+// user, or 0 if it may try now.
+func (a *authLimits) check(ip, user string) time.Duration {
+	if d := a.lockout.locked(lockoutKey(ip, user)); d > 0 {
+		return d
+	}
+	if ok, d := a.byIP.allow(ip); !ok {
+		return d
+	}
+	if ok, d := a.byUser.allow(user); !ok {
+		return d
+	}
+	return 0
+}
+
+// failed records a failed login from ip as user.
+func (a *authLimits) failed(ip, user string) {
+	a.lockout.fail(lockoutKey(ip, user))
+}
+
+// succeeded records a successful login from ip as user.
+func (a *authLimits) succeeded(ip, user string) {
+	a.lockout.succeed(lockoutKey(ip, user))
+}
+
+func lockoutKey(ip, user string) string {
+	return ip + "|" + user
+}
+
+// credentialsMatch compares credentials in constant time. The values are
+// hashed first, so that the time doesn't depend on their lengths either.
+func credentialsMatch(user, pass, wantUser, wantPass string) bool {
+	u, wu := sha256.Sum256([]byte(user)), sha256.Sum256([]byte(wantUser))
+	p, wp := sha256.Sum256([]byte(pass)), sha256.Sum256([]byte(wantPass))
+	return subtle.ConstantTimeCompare(u[:], wu[:])&subtle.ConstantTimeCompare(p[:], wp[:]) == 1
+}
+
+// clientIP returns the IP address of the client. A request from one of the
+// trusted proxies is for the rightmost address in X-Forwarded-For which isn't
+// a trusted proxy, as the addresses left of it are set by the client.
+// Without trusted proxies, X-Forwarded-For is ignored, as folk may be
+// reached directly.
+func clientIP(r *http.Request, trusted []*net.IPNet) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !isTrustedProxy(host, trusted) {
+		return host
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		host = hop
+		if !isTrustedProxy(hop, trusted) {
+			break
+		}
+	}
+	return host
+}
+
+func isTrustedProxy(ip string, trusted []*net.IPNet) bool {
+	addr := net.ParseIP(ip)
+	for _, n := range trusted {
+		if addr != nil && n.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTrustedProxies parses a comma separated list of IP addresses and CIDR
+// ranges.
+func parseTrustedProxies(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		if !strings.Contains(f, "/") {
+			ip := net.ParseIP(f)
+			if ip == nil {
+				return nil, fmt.Errorf("%q is not an IP address or CIDR range", f)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(f)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an IP address or CIDR range", f)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// tooManyRequests responds with 429, and a Retry-After header of wait
+// rounded up to whole seconds.
+func tooManyRequests(w http.ResponseWriter, wait time.Duration, msg string) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, msg, http.StatusTooManyRequests)
+}
+
+// limitWrites wraps h with the global rate limit on writes, which are all
+// requests except GET, HEAD and OPTIONS.
+func (app *App) limitWrites(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET", "HEAD", "OPTIONS":
+		default:
+			if !app.allowWrite(w) {
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// allowWrite reports whether a write is within the global rate limit on
+// writes, and responds with 429 if it isn't.
+func (app *App) allowWrite(w http.ResponseWriter) bool {
+	if app.writeLimit == nil {
+		return true
+	}
+	if ok, wait := app.writeLimit.allow(""); !ok {
+		tooManyRequests(w, wait, fmt.Sprintf("too many writes, retry in %v", wait.Round(time.Millisecond)))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/knakk/specs"
+)
+
+// fakeClock is a clock for limiters, which only moves when told to.
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time      { return c.t }
+func (c *fakeClock) add(d time.Duration) { c.t = c.t.Add(d) }
+func newFakeClock() *fakeClock           { return &fakeClock{time.Unix(1500000000, 0)} }
+
+func TestLimiter(t *testing.T) {
+	s := specs.New(t)
+	clock := newFakeClock()
+	l := newLimiter(2, 3) // 2 per second, burst 3
+	l.now = clock.now
+
+	for i := 0; i < 3; i++ {
+		ok, _ := l.allow("a")
+		s.Expect(true, ok)
+	}
+	ok, wait := l.allow("a")
+	s.Expect(false, ok)
+	s.Expect(500*time.Millisecond, wait)
+
+	// other keys have their own buckets
+	ok, _ = l.allow("b")
+	s.Expect(true, ok)
+
+	clock.add(250 * time.Millisecond)
+	ok, wait = l.allow("a")
+	s.Expect(false, ok)
+	s.Expect(250*time.Millisecond, wait)
+	clock.add(250 * time.Millisecond)
+	ok, _ = l.allow("a")
+	s.Expect(true, ok)
+
+	// the bucket doesn't fill beyond burst
+	clock.add(time.Hour)
+	for i := 0; i < 3; i++ {
+		ok, _ := l.allow("a")
+		s.Expect(true, ok)
+	}
+	ok, _ = l.allow("a")
+	s.Expect(false, ok)
+}
+
+func TestLockout(t *testing.T) {
+	s := specs.New(t)
+	clock := newFakeClock()
+	l := newLockout(3, time.Minute, 5*time.Minute)
+	l.now = clock.now
+
+	l.fail("a")
+	l.fail("a")
+	s.Expect(time.Duration(0), l.locked("a"))
+	l.fail("a")
+	s.Expect(time.Minute, l.locked("a"))
+	s.Expect(time.Duration(0), l.locked("b"))
+
+	clock.add(time.Minute)
+	s.Expect(time.Duration(0), l.locked("a"))
+	l.fail("a")
+	s.Expect(2*time.Minute, l.locked("a"))
+	l.fail("a")
+	s.Expect(4*time.Minute, l.locked("a"))
+	l.fail("a")
+	s.Expect(5*time.Minute, l.locked("a"))
+
+	l.succeed("a")
+	s.Expect(time.Duration(0), l.locked("a"))
+	l.fail("a")
+	s.Expect(time.Duration(0), l.locked("a"))
+
+	// shifting the base by this many failures overflows, and the lockout
+	// must stay at max instead
+	l = newLockout(1, time.Minute, time.Hour)
+	l.now = clock.now
+	for i := 0; i < 40; i++ {
+		l.fail("a")
+		if i >= 6 {
+			s.Expect(time.Hour, l.locked("a"))
+		}
+	}
+	s.Expect(time.Hour, l.backoff(28))
+	s.Expect(time.Hour, l.backoff(1<<20))
+}
+
+func TestClientIP(t *testing.T) {
+	s := specs.New(t)
+	trusted, err := parseTrustedProxies("10.0.0.1, 192.168.0.0/16,::1")
+	s.ExpectNilFatal(err)
+	_, err = parseTrustedProxies("10.0.0.1,proxy")
+	s.Expect(`"proxy" is not an IP address or CIDR range`, err.Error())
+
+	var tests = []struct {
+		remote, xff string
+		trusted     []*net.IPNet
+		want        string
+	}{
+		{"10.0.0.1:1234", "1.2.3.4", nil, "10.0.0.1"},
+		{"10.0.0.2:1234", "1.2.3.4", trusted, "10.0.0.2"},
+		{"10.0.0.1:1234", "", trusted, "10.0.0.1"},
+		{"10.0.0.1:1234", "1.2.3.4", trusted, "1.2.3.4"},
+		{"[::1]:1234", "1.2.3.4", trusted, "1.2.3.4"},
+		// the client may send its own X-Forwarded-For, which is left of the
+		// address the proxy adds
+		{"10.0.0.1:1234", "6.6.6.6, 1.2.3.4", trusted, "1.2.3.4"},
+		{"10.0.0.1:1234", "6.6.6.6, 1.2.3.4, 192.168.1.1", trusted, "1.2.3.4"},
+		{"10.0.0.1:1234", "garbage, 192.168.1.1", trusted, "192.168.1.1"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/authenticate", nil)
+		r.RemoteAddr = tt.remote
+		if tt.xff != "" {
+			r.Header.Set("X-Forwarded-For", tt.xff)
+		}
+		if got := clientIP(r, tt.trusted); got != tt.want {
+			t.Errorf("clientIP(%s, X-Forwarded-For: %s) = %s; want %s", tt.remote, tt.xff, got, tt.want)
+		}
+	}
+}
+
+func TestCredentialsMatch(t *testing.T) {
+	s := specs.New(t)
+	s.Expect(true, credentialsMatch("admin", "secret", "admin", "secret"))
+	s.Expect(false, credentialsMatch("admin", "secre", "admin", "secret"))
+	s.Expect(false, credentialsMatch("admin", "secrets", "admin", "secret"))
+	s.Expect(false, credentialsMatch("Admin", "secret", "admin", "secret"))
+	s.Expect(false, credentialsMatch("", "", "admin", "secret"))
+}
+
+func TestAuthenticateLimits(t *testing.T) {
+	s := specs.New(t)
+	app := newTestApp(t, dept{1, "main", 0})
+	clock := newFakeClock()
+	app.authLimits.byIP.now = clock.now
+	app.authLimits.byUser.now = clock.now
+	app.authLimits.lockout.now = clock.now
+
+	login := func(ip, user, pass string) *httptest.ResponseRecorder {
+		form := url.Values{"username": {user}, "password": {pass}}
+		req, _ := http.NewRequest("POST", "/authenticate", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, req)
+		return w
+	}
+
+	// burst of 5 attempts, refilled at 10 per minute
+	for i := 0; i < 5; i++ {
+		s.Expect(http.StatusOK, login("10.0.0.1", "admin", "secret").Code)
+	}
+	w := login("10.0.0.1", "admin", "secret")
+	s.Expect(http.StatusTooManyRequests, w.Code)
+	s.Expect("6", w.Header().Get("Retry-After"))
+	clock.add(6 * time.Second)
+	s.Expect(http.StatusOK, login("10.0.0.1", "admin", "secret").Code)
+
+	// the limit is also per username
+	clock.add(time.Hour)
+	for i := 0; i < 5; i++ {
+		s.Expect(http.StatusUnauthorized, login("10.0.1."+strconv.Itoa(i), "admin", "guess").Code)
+	}
+	s.Expect(http.StatusTooManyRequests, login("10.0.0.2", "admin", "secret").Code)
+	s.Expect(http.StatusUnauthorized, login("10.0.0.2", "other", "guess").Code)
+
+	// lockout after 5 failures from an IP for a username
+	clock.add(time.Hour)
+	for i := 0; i < 5; i++ {
+		s.Expect(http.StatusUnauthorized, login("10.0.0.1", "admin", "guess").Code)
+	}
+	clock.add(30 * time.Second)
+	w = login("10.0.0.1", "admin", "secret")
+	s.Expect(http.StatusTooManyRequests, w.Code)
+	s.Expect("30", w.Header().Get("Retry-After"))
+	s.Expect(http.StatusOK, login("10.0.0.2", "admin", "secret").Code)
+	clock.add(30 * time.Second)
+	s.Expect(http.StatusUnauthorized, login("10.0.0.1", "admin", "guess").Code)
+	w = login("10.0.0.1", "admin", "secret")
+	s.Expect(http.StatusTooManyRequests, w.Code)
+	s.Expect("120", w.Header().Get("Retry-After"))
+
+	// a success resets the failures
+	clock.add(time.Hour)
+	s.Expect(http.StatusOK, login("10.0.0.1", "admin", "secret").Code)
+	for i := 0; i < 4; i++ {
+		s.Expect(http.StatusUnauthorized, login("10.0.0.1", "admin", "guess").Code)
+	}
+	s.Expect(time.Duration(0), app.authLimits.lockout.locked(lockoutKey("10.0.0.1", "admin")))
+
+	// behind a trusted proxy, a client locked out doesn't lock out the others
+	clock.add(time.Hour)
+	app.trustedProxies, _ = parseTrustedProxies("10.0.0.9")
+	viaProxy := func(client, pass string) int {
+		form := url.Values{"username": {"admin"}, "password": {pass}}
+		req, _ := http.NewRequest("POST", "/authenticate", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-Forwarded-For", client)
+		req.RemoteAddr = "10.0.0.9:1234"
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, req)
+		return w.Code
+	}
+	for i := 0; i < 5; i++ {
+		s.Expect(http.StatusUnauthorized, viaProxy("1.2.3.4", "guess"))
+	}
+	clock.add(30 * time.Second) // refills the limit per username
+	s.Expect(http.StatusTooManyRequests, viaProxy("1.2.3.4", "secret"))
+	s.Expect(http.StatusOK, viaProxy("5.6.7.8", "secret"))
+}
+
+func TestAPIWriteLimit(t *testing.T) {
+	s := specs.New(t)
+	app := newTestApp(t, dept{1, "main", 0})
+	clock := newFakeClock()
+	app.writeLimit = newLimiter(1, 2)
+	app.writeLimit.now = clock.now
+	auth := "Bearer " + testToken(t, app, scopePersonsWrite)
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("Authorization", auth)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, req)
+		return w
+	}
+
+	s.Expect(http.StatusCreated, do("POST", "/api/person", `{"Name":"A","Department":1,"Email":"a@example.com"}`).Code)
+	s.Expect(http.StatusCreated, do("POST", "/api/person", `{"Name":"B","Department":1,"Email":"b@example.com"}`).Code)
+	w := do("DELETE", "/api/person/1", "")
+	s.Expect(http.StatusTooManyRequests, w.Code)
+	s.Expect("1", w.Header().Get("Retry-After"))
+
+	// reads aren't limited
+	s.Expect(http.StatusOK, do("GET", "/api/person/1", "").Code)
+
+	// uploads are writes
+	s.Expect(http.StatusTooManyRequests, do("POST", "/upload", "").Code)
+
+	clock.add(time.Second)
+	s.Expect(http.StatusOK, do("DELETE", "/api/person/1", "").Code)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// saver saves the db to a file when max edits have been made, or interval
+// after the first unsaved edit, whichever comes first. A failed save is
+// retried on the next edit or interval.
+type saver struct {
+	sync.Mutex
+	db       Store
+	file     string
+	max      int
+	interval time.Duration
+
+	count    int         // unsaved edits
+	timer    *time.Timer // running while there are unsaved edits
+	lastSave time.Time
+	lastErr  error
+	failures int
+}
+
+func newSaver(db Store, file string, max int, interval time.Duration) *saver {
+	return &saver{db: db, file: file, max: max, interval: interval}
+}
+
+// SaverStatus describes the state of a saver, for monitoring.
+type SaverStatus struct {
+	File string
+	// Dirty is the number of edits not yet saved.
+	Dirty int
+	// LastSave is the time of the last successful save, or zero.
+	LastSave time.Time
+	// LastError is the error of the last save, if it failed.
+	LastError string `json:",omitempty"`
+	// Failures is the total number of failed saves.
+	Failures int
+}
+
+// Inc records an edit, and saves the db if max edits have been made.
+func (s *saver) Inc() {
+	s.Lock()
+	defer s.Unlock()
+	s.count++
+	if s.count >= s.max {
+		s.save()
+		return
+	}
+	if s.timer == nil {
+		s.timer = time.AfterFunc(s.interval, s.timeout)
+	}
+}
+
+func (s *saver) timeout() {
+	s.Lock()
+	defer s.Unlock()
+	s.timer = nil
+	if s.count > 0 {
+		s.save()
+	}
+}
+
+// save dumps the db. It must be called with the lock held. If the save fails,
+// the edits are kept as unsaved, and a new save is scheduled.
+func (s *saver) save() error {
+	log.Printf("Saving db: %s", s.file)
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	s.lastErr = s.db.Dump(s.file)
+	if s.lastErr != nil {
+		s.failures++
+		log.Printf("Failed to save db: %s (%d unsaved edits): %v", s.file, s.count, s.lastErr)
+		s.timer = time.AfterFunc(s.interval, s.timeout)
+		return s.lastErr
+	}
+	s.count = 0
+	s.lastSave = time.Now()
+	return nil
+}
+
+// Flush saves the db if there are unsaved edits. It is called on shutdown,
+// so a failed save is not retried.
+func (s *saver) Flush() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.count == 0 {
+		return nil
+	}
+	err := s.save()
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	return err
+}
+
+// Status returns the current state of the saver.
+func (s *saver) Status() SaverStatus {
+	s.Lock()
+	defer s.Unlock()
+	st := SaverStatus{File: s.file, Dirty: s.count, LastSave: s.lastSave, Failures: s.failures}
+	if s.lastErr != nil {
+		st.LastError = s.lastErr.Error()
+	}
+	return st
+}
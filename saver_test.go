@@ -0,0 +1,81 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/knakk/specs"
+)
+
+func TestSaverCount(t *testing.T) {
+	s := specs.New(t)
+	fname := filepath.Join(t.TempDir(), "folk.db")
+	db := New(8)
+	sv := newSaver(db, fname, 3, time.Hour)
+
+	b := []byte(`{"Name":"a"}`)
+	for i := 0; i < 2; i++ {
+		db.Create(&b)
+		sv.Inc()
+	}
+	s.Expect(2, sv.Status().Dirty)
+	s.Expect(true, sv.Status().LastSave.IsZero())
+	db.Create(&b)
+	sv.Inc()
+	st := sv.Status()
+	s.Expect(0, st.Dirty)
+	s.Expect(false, st.LastSave.IsZero())
+	saved, err := NewFromFile(fname)
+	s.ExpectNilFatal(err)
+	s.Expect(3, saved.Size())
+
+	// nothing to flush
+	s.ExpectNilFatal(sv.Flush())
+	s.Expect(st.LastSave, sv.Status().LastSave)
+}
+
+func TestSaverInterval(t *testing.T) {
+	s := specs.New(t)
+	fname := filepath.Join(t.TempDir(), "folk.db")
+	db := New(8)
+	sv := newSaver(db, fname, 100, 20*time.Millisecond)
+
+	b := []byte(`{"Name":"a"}`)
+	db.Create(&b)
+	sv.Inc()
+	s.Expect(1, sv.Status().Dirty)
+	deadline := time.Now().Add(5 * time.Second)
+	for sv.Status().Dirty != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("edit not saved after interval")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	saved, err := NewFromFile(fname)
+	s.ExpectNilFatal(err)
+	s.Expect(1, saved.Size())
+}
+
+func TestSaverFailure(t *testing.T) {
+	s := specs.New(t)
+	dir := t.TempDir()
+	db := New(8)
+	sv := newSaver(db, filepath.Join(dir, "missing", "folk.db"), 1, time.Hour)
+
+	sv.Inc()
+	st := sv.Status()
+	s.Expect(1, st.Dirty)
+	s.Expect(1, st.Failures)
+	s.ExpectMatches(st.LastError, "no such file or directory")
+	s.ExpectNot(nil, sv.Flush())
+	s.Expect(2, sv.Status().Failures)
+
+	// the edits are saved once saving works again
+	sv.file = filepath.Join(dir, "folk.db")
+	s.ExpectNilFatal(sv.Flush())
+	st = sv.Status()
+	s.Expect(0, st.Dirty)
+	s.Expect("", st.LastError)
+	s.Expect(2, st.Failures)
+}
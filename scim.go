@@ -0,0 +1,941 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rcrowley/go-tigertonic"
+)
+
+// SCIM 2.0 provisioning (RFC 7643, 7644), with persons as Users and
+// departments as Groups. Identity providers push hires and departures to
+// /scim/v2, authenticated with an API token.
+
+const (
+	scimContentType      = "application/scim+json"
+	scimUserSchema       = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimGroupSchema      = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	scimEnterpriseSchema = "urn:ietf:params:scim:schemas:extension:enterprise:2.0:User"
+	scimListSchema       = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimPatchSchema      = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	scimErrorSchema      = "urn:ietf:params:scim:api:messages:2.0:Error"
+
+	scimDefaultCount = 100
+	scimMaxCount     = 1000
+)
+
+type scimValue struct {
+	Value   string `json:"value"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+type scimName struct {
+	Formatted  string `json:"formatted,omitempty"`
+	GivenName  string `json:"givenName,omitempty"`
+	FamilyName string `json:"familyName,omitempty"`
+}
+
+// full returns the formatted name, or the given and family names.
+func (n scimName) full() string {
+	if n.Formatted != "" {
+		return n.Formatted
+	}
+	return strings.TrimSpace(n.GivenName + " " + n.FamilyName)
+}
+
+type scimEnterprise struct {
+	Department string `json:"department,omitempty"`
+}
+
+type scimMeta struct {
+	ResourceType string `json:"resourceType"`
+	Location     string `json:"location"`
+}
+
+type scimMember struct {
+	Value   string `json:"value"`
+	Display string `json:"display,omitempty"`
+	Ref     string `json:"$ref,omitempty"`
+}
+
+type scimUser struct {
+	Schemas      []string        `json:"schemas"`
+	ID           string          `json:"id,omitempty"`
+	UserName     string          `json:"userName"`
+	Name         *scimName       `json:"name,omitempty"`
+	DisplayName  string          `json:"displayName,omitempty"`
+	Title        string          `json:"title,omitempty"`
+	Emails       []scimValue     `json:"emails,omitempty"`
+	PhoneNumbers []scimValue     `json:"phoneNumbers,omitempty"`
+	Active       *bool           `json:"active,omitempty"`
+	Groups       []scimMember    `json:"groups,omitempty"`
+	Enterprise   *scimEnterprise `json:"urn:ietf:params:scim:schemas:extension:enterprise:2.0:User,omitempty"`
+	Meta         *scimMeta       `json:"meta,omitempty"`
+}
+
+type scimGroup struct {
+	Schemas     []string     `json:"schemas"`
+	ID          string       `json:"id"`
+	DisplayName string       `json:"displayName"`
+	Members     []scimMember `json:"members,omitempty"`
+	Meta        *scimMeta    `json:"meta,omitempty"`
+}
+
+type scimListResponse struct {
+	Schemas      []string      `json:"schemas"`
+	TotalResults int           `json:"totalResults"`
+	StartIndex   int           `json:"startIndex"`
+	ItemsPerPage int           `json:"itemsPerPage"`
+	Resources    []interface{} `json:"Resources"`
+}
+
+type scimPatchOp struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+}
+
+type scimPatchRequest struct {
+	Schemas    []string      `json:"schemas"`
+	Operations []scimPatchOp `json:"Operations"`
+}
+
+// scimError is an error response, with scimType as in RFC 7644 3.12.
+type scimError struct {
+	status   int
+	scimType string
+	detail   string
+}
+
+func (e *scimError) Error() string { return e.detail }
+
+func scimErrorf(status int, scimType, format string, args ...interface{}) *scimError {
+	return &scimError{status, scimType, fmt.Sprintf(format, args...)}
+}
+
+func writeSCIM(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", scimContentType)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeSCIMError(w http.ResponseWriter, err *scimError) {
+	writeSCIM(w, err.status, struct {
+		Schemas  []string `json:"schemas"`
+		Status   string   `json:"status"`
+		ScimType string   `json:"scimType,omitempty"`
+		Detail   string   `json:"detail"`
+	}{[]string{scimErrorSchema}, strconv.Itoa(err.status), err.scimType, err.detail})
+}
+
+// readSCIM decodes the JSON request body of r into v.
+func readSCIM(r *http.Request, v interface{}) *scimError {
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(v); err != nil {
+		return scimErrorf(http.StatusBadRequest, "invalidSyntax", "invalid JSON: %v", err)
+	}
+	return nil
+}
+
+// scimBase returns the URL of the SCIM endpoints, for resource locations.
+func scimBase(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + "/scim/v2"
+}
+
+// scimAuth wraps the SCIM handler h to require a bearer token, with the read
+// scope for reading and persons:write for provisioning.
+func (app *App) scimAuth(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secret, ok := bearerToken(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeSCIMError(w, scimErrorf(http.StatusUnauthorized, "", "a bearer token is required"))
+			return
+		}
+		if app.authorizeToken(w, r, secret, requiredScope(r.Method, "")) {
+			h.ServeHTTP(w, r)
+		}
+	})
+}
+
+func (app *App) setupSCIMRouting() {
+	app.scimMux = tigertonic.NewTrieServeMux()
+	scim := router{app, app.scimMux, "/scim/v2"}
+	scim.HandleFunc("GET", "/ServiceProviderConfig", app.scimServiceProviderConfig)
+	scim.HandleFunc("GET", "/Users", app.scimListUsers)
+	scim.HandleFunc("POST", "/Users", app.scimCreateUser)
+	scim.HandleFunc("GET", "/Users/{id}", app.scimGetUser)
+	scim.HandleFunc("PUT", "/Users/{id}", app.scimReplaceUser)
+	scim.HandleFunc("PATCH", "/Users/{id}", app.scimPatchUser)
+	scim.HandleFunc("DELETE", "/Users/{id}", app.scimDeleteUser)
+	scim.HandleFunc("GET", "/Groups", app.scimListGroups)
+	scim.HandleFunc("POST", "/Groups", app.scimGroupsReadOnly)
+	scim.HandleFunc("GET", "/Groups/{id}", app.scimGetGroup)
+	scim.HandleFunc("PUT", "/Groups/{id}", app.scimGroupsReadOnly)
+	scim.HandleFunc("PATCH", "/Groups/{id}", app.scimPatchGroup)
+	scim.HandleFunc("DELETE", "/Groups/{id}", app.scimGroupsReadOnly)
+}
+
+// GET /ServiceProviderConfig
+func (app *App) scimServiceProviderConfig(w http.ResponseWriter, r *http.Request) {
+	supported := func(ok bool) map[string]bool { return map[string]bool{"supported": ok} }
+	writeSCIM(w, http.StatusOK, map[string]interface{}{
+		"schemas":        []string{"urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"},
+		"patch":          supported(true),
+		"bulk":           map[string]interface{}{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":         map[string]interface{}{"supported": true, "maxResults": scimMaxCount},
+		"changePassword": supported(false),
+		"sort":           supported(false),
+		"etag":           supported(false),
+		"authenticationSchemes": []map[string]string{{
+			"type":        "oauthbearertoken",
+			"name":        "API token",
+			"description": "A folk API token, as a bearer token",
+		}},
+	})
+}
+
+// scimFilter is a filter of a single attribute comparison, like
+// `userName eq "kari@example.com"`. Comparisons ignore case.
+type scimFilter struct {
+	attr  string // lower case
+	op    string // eq, ne, co, sw, ew or pr
+	value string // lower case
+}
+
+var scimFilterRx = regexp.MustCompile(`(?i)^\s*(\S+)\s+(eq|ne|co|sw|ew|pr)\b\s*(.*?)\s*$`)
+
+// parseSCIMFilter parses a filter; an empty one matches everything.
+func parseSCIMFilter(s string) (*scimFilter, *scimError) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	m := scimFilterRx.FindStringSubmatch(s)
+	if m == nil {
+		return nil, scimErrorf(http.StatusBadRequest, "invalidFilter", "unsupported filter: %s", s)
+	}
+	f := &scimFilter{attr: scimPath(m[1]), op: strings.ToLower(m[2])}
+	if f.op == "pr" {
+		if m[3] != "" {
+			return nil, scimErrorf(http.StatusBadRequest, "invalidFilter", "unsupported filter: %s", s)
+		}
+		return f, nil
+	}
+	var v interface{}
+	if err := json.Unmarshal([]byte(m[3]), &v); err != nil {
+		return nil, scimErrorf(http.StatusBadRequest, "invalidFilter", "unsupported filter value: %s", m[3])
+	}
+	switch v := v.(type) {
+	case string:
+		f.value = strings.ToLower(v)
+	case bool:
+		f.value = strconv.FormatBool(v)
+	default:
+		return nil, scimErrorf(http.StatusBadRequest, "invalidFilter", "unsupported filter value: %s", m[3])
+	}
+	return f, nil
+}
+
+// match reports whether an attribute with value v matches the filter.
+func (f *scimFilter) match(v string) bool {
+	v = strings.ToLower(v)
+	switch f.op {
+	case "eq":
+		return v == f.value
+	case "ne":
+		return v != f.value
+	case "co":
+		return strings.Contains(v, f.value)
+	case "sw":
+		return strings.HasPrefix(v, f.value)
+	case "ew":
+		return strings.HasSuffix(v, f.value)
+	}
+	return v != "" // pr
+}
+
+// scimPath returns an attribute path in lower case, without the User schema.
+func scimPath(path string) string {
+	return strings.TrimPrefix(strings.ToLower(strings.TrimSpace(path)), strings.ToLower(scimUserSchema)+":")
+}
+
+var (
+	scimDepartmentPath = strings.ToLower(scimEnterpriseSchema) + ":department"
+	scimEnterprisePath = strings.ToLower(scimEnterpriseSchema)
+)
+
+// scimPage returns the items of a page given by the startIndex and count
+// query parameters, as a list response.
+func scimPage(r *http.Request, items []interface{}) *scimListResponse {
+	start, err := strconv.Atoi(r.URL.Query().Get("startIndex"))
+	if err != nil || start < 1 {
+		start = 1
+	}
+	count, err := strconv.Atoi(r.URL.Query().Get("count"))
+	if err != nil {
+		count = scimDefaultCount
+	}
+	if count < 0 {
+		count = 0
+	}
+	if count > scimMaxCount {
+		count = scimMaxCount
+	}
+	res := &scimListResponse{
+		Schemas:      []string{scimListSchema},
+		TotalResults: len(items),
+		StartIndex:   start,
+		Resources:    []interface{}{},
+	}
+	if start <= len(items) {
+		items = items[start-1:]
+		if len(items) > count {
+			items = items[:count]
+		}
+		res.Resources = items
+	}
+	res.ItemsPerPage = len(res.Resources)
+	return res
+}
+
+// scimID parses the id path parameter.
+func scimID(r *http.Request, resource string) (int, *scimError) {
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		return 0, scimErrorf(http.StatusNotFound, "", "%s not found", resource)
+	}
+	return id, nil
+}
+
+// Users:
+
+// scimUser returns p as a SCIM User.
+func (app *App) scimUser(p person, base string) scimUser {
+	id := strconv.Itoa(p.ID)
+	active := !p.Inactive
+	u := scimUser{
+		Schemas:     []string{scimUserSchema, scimEnterpriseSchema},
+		ID:          id,
+		UserName:    p.Email,
+		Name:        &scimName{Formatted: p.Name},
+		DisplayName: p.Name,
+		Title:       p.Role,
+		Emails:      []scimValue{{Value: p.Email, Type: "work", Primary: true}},
+		Active:      &active,
+		Meta:        &scimMeta{"User", base + "/Users/" + id},
+	}
+	if p.Phone != "" {
+		u.PhoneNumbers = []scimValue{{Value: p.Phone, Type: "work", Primary: true}}
+	}
+	if d, ok := app.mapDepartments[p.Department]; ok {
+		did := strconv.Itoa(d.ID)
+		u.Groups = []scimMember{{Value: did, Display: d.Name, Ref: base + "/Groups/" + did}}
+		u.Enterprise = &scimEnterprise{Department: d.Name}
+	}
+	return u
+}
+
+// scimUserAttr returns the value of a User attribute of p, for filtering.
+func (app *App) scimUserAttr(p person, attr string) (string, bool) {
+	switch attr {
+	case "id":
+		return strconv.Itoa(p.ID), true
+	case "username", "emails", "emails.value":
+		return p.Email, true
+	case "displayname", "name.formatted":
+		return p.Name, true
+	case "title":
+		return p.Role, true
+	case "phonenumbers", "phonenumbers.value":
+		return p.Phone, true
+	case "active":
+		return strconv.FormatBool(!p.Inactive), true
+	case scimDepartmentPath:
+		return app.mapDepartments[p.Department].Name, true
+	}
+	return "", false
+}
+
+// primaryValue returns the primary value of vs, or else the first one.
+func primaryValue(vs []scimValue) string {
+	for _, v := range vs {
+		if v.Primary {
+			return v.Value
+		}
+	}
+	if len(vs) > 0 {
+		return vs[0].Value
+	}
+	return ""
+}
+
+// setSCIMDepartment sets the department of p to the one named name.
+func (app *App) setSCIMDepartment(p *person, name string) *scimError {
+	id, ok := app.departmentByName(name)
+	if !ok {
+		return scimErrorf(http.StatusBadRequest, "invalidValue", "unknown department: %s", name)
+	}
+	p.Department = id
+	return nil
+}
+
+// applySCIMUser sets the fields of p to those of the User u. Fields without a
+// SCIM attribute, like the image, are kept, and so is the department if u has
+// none.
+func (app *App) applySCIMUser(p *person, u scimUser) *scimError {
+	p.Email = primaryValue(u.Emails)
+	if p.Email == "" {
+		p.Email = u.UserName
+	}
+	if p.Email == "" {
+		return scimErrorf(http.StatusBadRequest, "invalidValue", "userName or emails is required")
+	}
+	p.Name = u.DisplayName
+	if p.Name == "" && u.Name != nil {
+		p.Name = u.Name.full()
+	}
+	if p.Name == "" {
+		return scimErrorf(http.StatusBadRequest, "invalidValue", "displayName or name is required")
+	}
+	p.Role = u.Title
+	p.Phone = primaryValue(u.PhoneNumbers)
+	p.Inactive = u.Active != nil && !*u.Active
+	if u.Enterprise != nil && u.Enterprise.Department != "" {
+		if err := app.setSCIMDepartment(p, u.Enterprise.Department); err != nil {
+			return err
+		}
+	}
+	if p.Department == 0 {
+		return scimErrorf(http.StatusBadRequest, "invalidValue", "department is required")
+	}
+	return nil
+}
+
+// scimString decodes a string value.
+func scimString(v json.RawMessage, path string) (string, *scimError) {
+	var s string
+	if err := json.Unmarshal(v, &s); err != nil {
+		return "", scimErrorf(http.StatusBadRequest, "invalidValue", "%s must be a string", path)
+	}
+	return s, nil
+}
+
+// scimBool decodes a boolean value, which some providers send as a string.
+func scimBool(v json.RawMessage, path string) (bool, *scimError) {
+	var b bool
+	if err := json.Unmarshal(v, &b); err == nil {
+		return b, nil
+	}
+	var s string
+	json.Unmarshal(v, &s)
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return false, scimErrorf(http.StatusBadRequest, "invalidValue", "%s must be a boolean", path)
+	}
+	return b, nil
+}
+
+// setSCIMAttr sets the User attribute at path of p to v.
+func (app *App) setSCIMAttr(p *person, path string, v json.RawMessage) *scimError {
+	nonEmpty := func(dst *string) *scimError {
+		s, err := scimString(v, path)
+		if err != nil {
+			return err
+		}
+		if s == "" {
+			return scimErrorf(http.StatusBadRequest, "invalidValue", "%s can't be empty", path)
+		}
+		*dst = s
+		return nil
+	}
+	values := func() ([]scimValue, *scimError) {
+		var vs []scimValue
+		if err := json.Unmarshal(v, &vs); err != nil {
+			return nil, scimErrorf(http.StatusBadRequest, "invalidValue", "%s must be a list of values", path)
+		}
+		return vs, nil
+	}
+	switch scimPath(path) {
+	case "username", "emails.value", `emails[type eq "work"].value`:
+		return nonEmpty(&p.Email)
+	case "displayname", "name.formatted":
+		return nonEmpty(&p.Name)
+	case "name":
+		var n scimName
+		if err := json.Unmarshal(v, &n); err != nil || n.full() == "" {
+			return scimErrorf(http.StatusBadRequest, "invalidValue", "name must have a formatted name")
+		}
+		p.Name = n.full()
+	case "title":
+		s, err := scimString(v, path)
+		if err != nil {
+			return err
+		}
+		p.Role = s
+	case "active":
+		b, err := scimBool(v, path)
+		if err != nil {
+			return err
+		}
+		p.Inactive = !b
+	case "emails":
+		vs, err := values()
+		if err != nil {
+			return err
+		}
+		if email := primaryValue(vs); email != "" {
+			p.Email = email
+		}
+	case "phonenumbers":
+		vs, err := values()
+		if err != nil {
+			return err
+		}
+		p.Phone = primaryValue(vs)
+	case "phonenumbers.value", `phonenumbers[type eq "work"].value`:
+		s, err := scimString(v, path)
+		if err != nil {
+			return err
+		}
+		p.Phone = s
+	case scimDepartmentPath:
+		s, err := scimString(v, path)
+		if err != nil {
+			return err
+		}
+		return app.setSCIMDepartment(p, s)
+	case scimEnterprisePath:
+		var e scimEnterprise
+		if err := json.Unmarshal(v, &e); err != nil {
+			return scimErrorf(http.StatusBadRequest, "invalidValue", "invalid enterprise extension")
+		}
+		if e.Department != "" {
+			return app.setSCIMDepartment(p, e.Department)
+		}
+	case "externalid":
+		// not stored; persons are matched by email
+	default:
+		return scimErrorf(http.StatusBadRequest, "invalidPath", "unsupported attribute: %s", path)
+	}
+	return nil
+}
+
+// patchSCIMUser applies a PATCH operation to p.
+func (app *App) patchSCIMUser(p *person, op scimPatchOp) *scimError {
+	switch strings.ToLower(op.Op) {
+	case "add", "replace":
+		if op.Path != "" {
+			return app.setSCIMAttr(p, op.Path, op.Value)
+		}
+		var attrs map[string]json.RawMessage
+		if err := json.Unmarshal(op.Value, &attrs); err != nil {
+			return scimErrorf(http.StatusBadRequest, "invalidValue", "value must be an object without a path")
+		}
+		paths := make([]string, 0, len(attrs))
+		for path := range attrs {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			if err := app.setSCIMAttr(p, path, attrs[path]); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "remove":
+		switch scimPath(op.Path) {
+		case "":
+			return scimErrorf(http.StatusBadRequest, "noTarget", "remove needs a path")
+		case "title":
+			p.Role = ""
+		case "phonenumbers", "phonenumbers.value", `phonenumbers[type eq "work"].value`:
+			p.Phone = ""
+		case "externalid":
+		default:
+			return scimErrorf(http.StatusBadRequest, "mutability", "%s can't be removed", op.Path)
+		}
+		return nil
+	}
+	return scimErrorf(http.StatusBadRequest, "invalidSyntax", "unknown operation: %s", op.Op)
+}
+
+// GET /Users
+func (app *App) scimListUsers(w http.ResponseWriter, r *http.Request) {
+	f, serr := parseSCIMFilter(r.URL.Query().Get("filter"))
+	if serr != nil {
+		writeSCIMError(w, serr)
+		return
+	}
+	if f != nil {
+		if _, ok := app.scimUserAttr(person{}, f.attr); !ok {
+			writeSCIMError(w, scimErrorf(http.StatusBadRequest, "invalidFilter", "unsupported filter attribute: %s", f.attr))
+			return
+		}
+	}
+	var ps []person
+	if f != nil && f.op == "eq" && (f.attr == "username" || f.attr == "emails" || f.attr == "emails.value") {
+		for _, id := range app.persons.Lookup("email", emailKey(f.value)) {
+			if p, err := app.persons.Get(id); err == nil {
+				ps = append(ps, p)
+			}
+		}
+	} else {
+		err := app.persons.Iterate(func(id int, p person) error {
+			if v, _ := app.scimUserAttr(p, f.attrOr()); f == nil || f.match(v) {
+				ps = append(ps, p)
+			}
+			return nil
+		})
+		if err != nil {
+			app.logError(r.Header, "GET /scim/v2/Users: %v", err)
+			writeSCIMError(w, scimErrorf(http.StatusInternalServerError, "", "failed to read database"))
+			return
+		}
+	}
+	sort.Slice(ps, func(i, j int) bool { return ps[i].ID < ps[j].ID })
+	base := scimBase(r)
+	items := make([]interface{}, len(ps))
+	for i, p := range ps {
+		items[i] = app.scimUser(p, base)
+	}
+	writeSCIM(w, http.StatusOK, scimPage(r, items))
+}
+
+// attrOr returns the filtered attribute, or "id" for no filter.
+func (f *scimFilter) attrOr() string {
+	if f == nil {
+		return "id"
+	}
+	return f.attr
+}
+
+// scimGetPerson returns the person with the id of the request.
+func (app *App) scimGetPerson(r *http.Request) (person, *scimError) {
+	id, serr := scimID(r, "user")
+	if serr != nil {
+		return person{}, serr
+	}
+	p, err := app.persons.Get(id)
+	if err == ErrNotFound {
+		return p, scimErrorf(http.StatusNotFound, "", "user not found")
+	}
+	if err != nil {
+		app.logError(r.Header, "%s /scim/v2/Users/%d: %v", r.Method, id, err)
+		return p, scimErrorf(http.StatusInternalServerError, "", "failed to read database")
+	}
+	return p, nil
+}
+
+// storeSCIMError maps an error storing a person to a SCIM error.
+func (app *App) storeSCIMError(r *http.Request, err error) *scimError {
+	if _, ok := err.(*UniqueError); ok {
+		return scimErrorf(http.StatusConflict, "uniqueness", "a person with this email already exists")
+	}
+	app.logError(r.Header, "%s %s: %v", r.Method, r.URL.Path, err)
+	return scimErrorf(http.StatusInternalServerError, "", "failed to store in database")
+}
+
+// GET /Users/{id}
+func (app *App) scimGetUser(w http.ResponseWriter, r *http.Request) {
+	p, serr := app.scimGetPerson(r)
+	if serr != nil {
+		writeSCIMError(w, serr)
+		return
+	}
+	writeSCIM(w, http.StatusOK, app.scimUser(p, scimBase(r)))
+}
+
+// POST /Users
+func (app *App) scimCreateUser(w http.ResponseWriter, r *http.Request) {
+	var u scimUser
+	if serr := readSCIM(r, &u); serr != nil {
+		writeSCIMError(w, serr)
+		return
+	}
+	p := person{Img: "dummy.png"}
+	if serr := app.applySCIMUser(&p, u); serr != nil {
+		writeSCIMError(w, serr)
+		return
+	}
+	id, err := app.addPerson(p)
+	if err != nil {
+		writeSCIMError(w, app.storeSCIMError(r, err))
+		return
+	}
+	p.ID = id
+	su := app.scimUser(p, scimBase(r))
+	w.Header().Set("Location", su.Meta.Location)
+	writeSCIM(w, http.StatusCreated, su)
+}
+
+// PUT /Users/{id}
+func (app *App) scimReplaceUser(w http.ResponseWriter, r *http.Request) {
+	oldp, serr := app.scimGetPerson(r)
+	if serr != nil {
+		writeSCIMError(w, serr)
+		return
+	}
+	var u scimUser
+	if serr := readSCIM(r, &u); serr != nil {
+		writeSCIMError(w, serr)
+		return
+	}
+	p := oldp
+	if serr := app.applySCIMUser(&p, u); serr != nil {
+		writeSCIMError(w, serr)
+		return
+	}
+	if err := app.replacePerson(p.ID, oldp, p); err != nil {
+		writeSCIMError(w, app.storeSCIMError(r, err))
+		return
+	}
+	writeSCIM(w, http.StatusOK, app.scimUser(p, scimBase(r)))
+}
+
+// PATCH /Users/{id}
+func (app *App) scimPatchUser(w http.ResponseWriter, r *http.Request) {
+	oldp, serr := app.scimGetPerson(r)
+	if serr != nil {
+		writeSCIMError(w, serr)
+		return
+	}
+	var rq scimPatchRequest
+	if serr := readSCIM(r, &rq); serr != nil {
+		writeSCIMError(w, serr)
+		return
+	}
+	p := oldp
+	for _, op := range rq.Operations {
+		if serr := app.patchSCIMUser(&p, op); serr != nil {
+			writeSCIMError(w, serr)
+			return
+		}
+	}
+	if p != oldp {
+		if err := app.replacePerson(p.ID, oldp, p); err != nil {
+			writeSCIMError(w, app.storeSCIMError(r, err))
+			return
+		}
+	}
+	writeSCIM(w, http.StatusOK, app.scimUser(p, scimBase(r)))
+}
+
+// DELETE /Users/{id}
+func (app *App) scimDeleteUser(w http.ResponseWriter, r *http.Request) {
+	p, serr := app.scimGetPerson(r)
+	if serr != nil {
+		writeSCIMError(w, serr)
+		return
+	}
+	_, err := app.removePerson(p.ID)
+	if err == ErrNotFound {
+		writeSCIMError(w, scimErrorf(http.StatusNotFound, "", "user not found"))
+		return
+	}
+	if err != nil {
+		writeSCIMError(w, app.storeSCIMError(r, err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Groups:
+
+// scimGroup returns the department d as a SCIM Group, with its members
+// unless they're excluded.
+func (app *App) scimGroup(d dept, base string, members bool) scimGroup {
+	id := strconv.Itoa(d.ID)
+	g := scimGroup{
+		Schemas:     []string{scimGroupSchema},
+		ID:          id,
+		DisplayName: d.Name,
+		Meta:        &scimMeta{"Group", base + "/Groups/" + id},
+	}
+	if !members {
+		return g
+	}
+	ids := app.persons.Lookup("department", id)
+	sort.Ints(ids)
+	for _, pid := range ids {
+		if p, err := app.persons.Get(pid); err == nil {
+			pidStr := strconv.Itoa(pid)
+			g.Members = append(g.Members, scimMember{pidStr, p.Name, base + "/Users/" + pidStr})
+		}
+	}
+	return g
+}
+
+// scimMembers reports whether the request wants the members of groups.
+func scimMembers(r *http.Request) bool {
+	return !strings.Contains(strings.ToLower(r.URL.Query().Get("excludedAttributes")), "members")
+}
+
+// GET /Groups
+func (app *App) scimListGroups(w http.ResponseWriter, r *http.Request) {
+	f, serr := parseSCIMFilter(r.URL.Query().Get("filter"))
+	if serr != nil {
+		writeSCIMError(w, serr)
+		return
+	}
+	if f != nil && f.attr != "id" && f.attr != "displayname" {
+		writeSCIMError(w, scimErrorf(http.StatusBadRequest, "invalidFilter", "unsupported filter attribute: %s", f.attr))
+		return
+	}
+	var ds []dept
+	for _, d := range app.mapDepartments {
+		v := d.Name
+		if f.attrOr() == "id" {
+			v = strconv.Itoa(d.ID)
+		}
+		if f == nil || f.match(v) {
+			ds = append(ds, d)
+		}
+	}
+	sort.Slice(ds, func(i, j int) bool { return ds[i].ID < ds[j].ID })
+	base := scimBase(r)
+	members := scimMembers(r)
+	items := make([]interface{}, len(ds))
+	for i, d := range ds {
+		items[i] = app.scimGroup(d, base, members)
+	}
+	writeSCIM(w, http.StatusOK, scimPage(r, items))
+}
+
+// scimGetDept returns the department with the id of the request.
+func (app *App) scimGetDept(r *http.Request) (dept, *scimError) {
+	id, serr := scimID(r, "group")
+	if serr != nil {
+		return dept{}, serr
+	}
+	d, ok := app.mapDepartments[id]
+	if !ok {
+		return d, scimErrorf(http.StatusNotFound, "", "group not found")
+	}
+	return d, nil
+}
+
+// GET /Groups/{id}
+func (app *App) scimGetGroup(w http.ResponseWriter, r *http.Request) {
+	d, serr := app.scimGetDept(r)
+	if serr != nil {
+		writeSCIMError(w, serr)
+		return
+	}
+	writeSCIM(w, http.StatusOK, app.scimGroup(d, scimBase(r), scimMembers(r)))
+}
+
+// PATCH /Groups/{id}
+//
+// Adding members moves the persons to the department. A person can't be
+// without a department, so removing a member leaves them in it until they're
+// added to another.
+func (app *App) scimPatchGroup(w http.ResponseWriter, r *http.Request) {
+	d, serr := app.scimGetDept(r)
+	if serr != nil {
+		writeSCIMError(w, serr)
+		return
+	}
+	var rq scimPatchRequest
+	if serr := readSCIM(r, &rq); serr != nil {
+		writeSCIMError(w, serr)
+		return
+	}
+	var add []int
+	for _, op := range rq.Operations {
+		path := scimPath(op.Path)
+		switch strings.ToLower(op.Op) {
+		case "add", "replace":
+			var members []scimMember
+			if path == "" {
+				var attrs struct {
+					Members     []scimMember `json:"members"`
+					DisplayName *string      `json:"displayName"`
+				}
+				if err := json.Unmarshal(op.Value, &attrs); err != nil {
+					writeSCIMError(w, scimErrorf(http.StatusBadRequest, "invalidValue", "value must be an object without a path"))
+					return
+				}
+				if attrs.DisplayName != nil && *attrs.DisplayName != d.Name {
+					writeSCIMError(w, scimErrorf(http.StatusBadRequest, "mutability", "departments can't be renamed"))
+					return
+				}
+				members = attrs.Members
+			} else if path == "members" {
+				if err := json.Unmarshal(op.Value, &members); err != nil {
+					writeSCIMError(w, scimErrorf(http.StatusBadRequest, "invalidValue", "members must be a list"))
+					return
+				}
+			} else {
+				writeSCIMError(w, scimErrorf(http.StatusBadRequest, "mutability", "%s can't be changed", op.Path))
+				return
+			}
+			for _, m := range members {
+				id, err := strconv.Atoi(m.Value)
+				if err != nil {
+					writeSCIMError(w, scimErrorf(http.StatusBadRequest, "invalidValue", "unknown member: %s", m.Value))
+					return
+				}
+				add = append(add, id)
+			}
+		case "remove":
+			if path != "members" && !strings.HasPrefix(path, "members[") {
+				writeSCIMError(w, scimErrorf(http.StatusBadRequest, "mutability", "%s can't be removed", op.Path))
+				return
+			}
+		default:
+			writeSCIMError(w, scimErrorf(http.StatusBadRequest, "invalidSyntax", "unknown operation: %s", op.Op))
+			return
+		}
+	}
+
+	c := newBatchChanges()
+	err := app.persons.Update(func(tx *TypedTx[person]) error {
+		for _, id := range add {
+			old, err := tx.Get(id)
+			if err == ErrNotFound {
+				return scimErrorf(http.StatusBadRequest, "invalidValue", "unknown member: %d", id)
+			}
+			if err != nil {
+				return err
+			}
+			if old.Department == d.ID {
+				continue
+			}
+			p := old
+			p.Department = d.ID
+			if err := tx.Put(id, p); err != nil {
+				return err
+			}
+			c.record(id, &old, &p)
+		}
+		return nil
+	})
+	if serr, ok := err.(*scimError); ok {
+		writeSCIMError(w, serr)
+		return
+	}
+	if err != nil {
+		writeSCIMError(w, app.storeSCIMError(r, err))
+		return
+	}
+	if len(c.ids) > 0 {
+		app.personsChanged(c)
+	}
+	writeSCIM(w, http.StatusOK, app.scimGroup(d, scimBase(r), true))
+}
+
+// POST /Groups, PUT and DELETE /Groups/{id}
+func (app *App) scimGroupsReadOnly(w http.ResponseWriter, r *http.Request) {
+	writeSCIMError(w, scimErrorf(http.StatusNotImplemented, "",
+		"departments are managed in folk, and can't be created, replaced or deleted by SCIM"))
+}
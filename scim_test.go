@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/knakk/specs"
+)
+
+func TestSCIMUsers(t *testing.T) {
+	s := specs.New(t)
+	app := newTestApp(t, dept{1, "IT", 0}, dept{2, "HR", 0})
+	for name, scope := range map[string]string{"idp": scopePersonsWrite, "reader": scopeRead} {
+		_, err := app.tokens.Create(apiToken{Name: name, Scope: scope, Hash: hashToken(name + "secret"), Created: time.Now()})
+		s.ExpectNilFatal(err)
+	}
+	do := func(method, target, token, body string) (int, string) {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", scimContentType)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, req)
+		return w.Code, w.Body.String()
+	}
+	user := func(body string) scimUser {
+		var u scimUser
+		s.ExpectNilFatal(json.Unmarshal([]byte(body), &u))
+		return u
+	}
+	list := func(body string) scimListResponse {
+		var l scimListResponse
+		s.ExpectNilFatal(json.Unmarshal([]byte(body), &l))
+		return l
+	}
+
+	code, body := do("POST", "/scim/v2/Users", "idpsecret", `{
+		"schemas": ["`+scimUserSchema+`", "`+scimEnterpriseSchema+`"],
+		"userName": "kari@example.com",
+		"name": {"givenName": "Kari", "familyName": "Nordmann"},
+		"emails": [{"value": "kari@example.com", "type": "work", "primary": true}],
+		"phoneNumbers": [{"value": "123", "type": "work"}],
+		"title": "Leder",
+		"active": true,
+		"`+scimEnterpriseSchema+`": {"department": "it"}
+	}`)
+	s.Expect(http.StatusCreated, code)
+	kari := user(body)
+	s.Expect("1", kari.ID)
+	s.Expect("http://example.com/scim/v2/Users/1", kari.Meta.Location)
+	s.Expect([]scimMember{{"1", "IT", "http://example.com/scim/v2/Groups/1"}}, kari.Groups)
+	p, err := app.persons.Get(1)
+	s.ExpectNilFatal(err)
+	s.Expect(person{ID: 1, Name: "Kari Nordmann", Role: "Leder", Department: 1, Email: "kari@example.com",
+		Img: "dummy.png", Phone: "123"}, p)
+
+	// created persons are searchable
+	app.bg.Wait()
+	_, body = do("GET", "/api/person?q=nordmann", "", "")
+	s.ExpectMatches(body, `^\{"Count":1,`)
+
+	var tests = []struct {
+		method, target, token, body string
+		wantCode                    int
+		wantBody                    string // regexp
+	}{
+		{"GET", "/scim/v2/Users", "", "", http.StatusUnauthorized, `"status":"401"`},
+		{"GET", "/scim/v2/Users", "wrong", "", http.StatusUnauthorized, "invalid"},
+		{"GET", "/scim/v2/Users", "readersecret", "", http.StatusOK, `"totalResults":1`},
+		{"POST", "/scim/v2/Users", "readersecret", `{}`, http.StatusForbidden, "scope"},
+		{"GET", "/scim/v2/Users/1", "readersecret", "", http.StatusOK, `"userName":"kari@example.com"`},
+		{"GET", "/scim/v2/Users/9", "readersecret", "", http.StatusNotFound, `"detail":"user not found"`},
+		{"POST", "/scim/v2/Users", "idpsecret", `{"userName":"KARI@example.com","displayName":"Kari",
+			"` + scimEnterpriseSchema + `":{"department":"HR"}}`, http.StatusConflict, `"scimType":"uniqueness"`},
+		{"POST", "/scim/v2/Users", "idpsecret", `{"userName":"ola@example.com","displayName":"Ola"}`,
+			http.StatusBadRequest, "department is required"},
+		{"POST", "/scim/v2/Users", "idpsecret", `{"userName":"ola@example.com","displayName":"Ola",
+			"` + scimEnterpriseSchema + `":{"department":"Salg"}}`, http.StatusBadRequest, "unknown department: Salg"},
+		{"POST", "/scim/v2/Users", "idpsecret", `{"userName":"ola@example.com"}`,
+			http.StatusBadRequest, "displayName or name is required"},
+		{"GET", "/scim/v2/Users?filter=" + url.QueryEscape(`userName eq "x" and title eq "y"`), "idpsecret", "",
+			http.StatusBadRequest, `"scimType":"invalidFilter"`},
+		{"GET", "/scim/v2/Users?filter=" + url.QueryEscape(`password eq "x"`), "idpsecret", "",
+			http.StatusBadRequest, `"scimType":"invalidFilter"`},
+		{"PATCH", "/scim/v2/Users/1", "idpsecret", `{"Operations":[{"op":"replace","path":"password","value":"x"}]}`,
+			http.StatusBadRequest, `"scimType":"invalidPath"`},
+		{"PATCH", "/scim/v2/Users/1", "idpsecret", `{"Operations":[{"op":"remove","path":"userName"}]}`,
+			http.StatusBadRequest, `"scimType":"mutability"`},
+	}
+	for _, tt := range tests {
+		code, body := do(tt.method, tt.target, tt.token, tt.body)
+		if code != tt.wantCode {
+			t.Errorf("%s %s => %d %s; want %d", tt.method, tt.target, code, body, tt.wantCode)
+		}
+		s.ExpectMatches(body, tt.wantBody)
+	}
+
+	code, body = do("POST", "/scim/v2/Users", "idpsecret", `{"userName":"ola@example.com","displayName":"Ola",
+		"`+scimEnterpriseSchema+`":{"department":"HR"}}`)
+	s.Expect(http.StatusCreated, code)
+
+	// filtering and paging
+	var filters = []struct {
+		filter string
+		want   []string
+	}{
+		{`userName eq "OLA@example.com"`, []string{"ola@example.com"}},
+		{`emails.value eq "nobody@example.com"`, nil},
+		{`displayName sw "k"`, []string{"kari@example.com"}},
+		{`title pr`, []string{"kari@example.com"}},
+		{`active eq true`, []string{"kari@example.com", "ola@example.com"}},
+		{`urn:ietf:params:scim:schemas:extension:enterprise:2.0:User:department eq "hr"`, []string{"ola@example.com"}},
+	}
+	for _, f := range filters {
+		code, body := do("GET", "/scim/v2/Users?filter="+url.QueryEscape(f.filter), "idpsecret", "")
+		s.Expect(http.StatusOK, code)
+		var got []string
+		for _, r := range list(body).Resources {
+			got = append(got, r.(map[string]interface{})["userName"].(string))
+		}
+		if strings.Join(got, ",") != strings.Join(f.want, ",") {
+			t.Errorf("filter %s => %v; want %v", f.filter, got, f.want)
+		}
+	}
+	_, body = do("GET", "/scim/v2/Users?startIndex=2&count=5", "idpsecret", "")
+	l := list(body)
+	s.Expect(2, l.TotalResults)
+	s.Expect(2, l.StartIndex)
+	s.Expect(1, l.ItemsPerPage)
+	_, body = do("GET", "/scim/v2/Users?count=0", "idpsecret", "")
+	s.Expect(0, len(list(body).Resources))
+
+	// a departure, as sent by Azure AD
+	code, body = do("PATCH", "/scim/v2/Users/1", "idpsecret", `{
+		"schemas": ["`+scimPatchSchema+`"],
+		"Operations": [
+			{"op": "Replace", "path": "active", "value": "False"},
+			{"op": "Replace", "path": "emails[type eq \"work\"].value", "value": "kari.n@example.com"},
+			{"op": "Remove", "path": "phoneNumbers"},
+			{"op": "Add", "value": {"title": "Pensjonist", "`+scimEnterpriseSchema+`:department": "HR"}}
+		]}`)
+	s.Expect(http.StatusOK, code)
+	s.Expect(false, *user(body).Active)
+	p, _ = app.persons.Get(1)
+	s.Expect(person{ID: 1, Name: "Kari Nordmann", Role: "Pensjonist", Department: 2, Email: "kari.n@example.com",
+		Img: "dummy.png", Inactive: true}, p)
+	_, body = do("GET", "/scim/v2/Users?filter="+url.QueryEscape(`active eq false`), "idpsecret", "")
+	s.Expect(1, list(body).TotalResults)
+	app.bg.Wait()
+
+	// PUT replaces the SCIM attributes, and keeps the others
+	code, _ = do("PUT", "/scim/v2/Users/1", "idpsecret", `{"userName":"kari@example.com","displayName":"Kari"}`)
+	s.Expect(http.StatusOK, code)
+	p, _ = app.persons.Get(1)
+	s.Expect(person{ID: 1, Name: "Kari", Department: 2, Email: "kari@example.com", Img: "dummy.png"}, p)
+	app.bg.Wait()
+
+	code, _ = do("DELETE", "/scim/v2/Users/1", "idpsecret", "")
+	s.Expect(http.StatusNoContent, code)
+	code, _ = do("GET", "/scim/v2/Users/1", "idpsecret", "")
+	s.Expect(http.StatusNotFound, code)
+	app.bg.Wait()
+	_, body = do("GET", "/api/person?q=kari", "", "")
+	s.ExpectMatches(body, `^\{"Count":0,`)
+}
+
+func TestSCIMGroups(t *testing.T) {
+	s := specs.New(t)
+	app := newTestApp(t, dept{1, "IT", 0}, dept{2, "Drift", 1}, dept{3, "HR", 0})
+	_, err := app.tokens.Create(apiToken{Name: "idp", Scope: scopePersonsWrite, Hash: hashToken("idpsecret"), Created: time.Now()})
+	s.ExpectNilFatal(err)
+	for _, p := range []person{
+		{Name: "Kari", Email: "kari@example.com", Department: 1},
+		{Name: "Ola", Email: "ola@example.com", Department: 2},
+	} {
+		_, err := app.persons.Create(p)
+		s.ExpectNilFatal(err)
+	}
+	do := func(method, target, body string) (int, string) {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer idpsecret")
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, req)
+		return w.Code, w.Body.String()
+	}
+	group := func(body string) scimGroup {
+		var g scimGroup
+		s.ExpectNilFatal(json.Unmarshal([]byte(body), &g))
+		return g
+	}
+
+	code, body := do("GET", "/scim/v2/Groups", "")
+	s.Expect(http.StatusOK, code)
+	s.ExpectMatches(body, `"totalResults":3`)
+	code, body = do("GET", "/scim/v2/Groups?filter="+url.QueryEscape(`displayName eq "drift"`), "")
+	s.Expect(http.StatusOK, code)
+	s.ExpectMatches(body, `"totalResults":1,.*"id":"2","displayName":"Drift","members":\[\{"value":"2","display":"Ola"`)
+	_, body = do("GET", "/scim/v2/Groups?excludedAttributes=members", "")
+	s.ExpectNotMatches(body, `"members"`)
+
+	code, body = do("GET", "/scim/v2/Groups/1", "")
+	s.Expect(http.StatusOK, code)
+	s.Expect([]scimMember{{"1", "Kari", "http://example.com/scim/v2/Users/1"}}, group(body).Members)
+
+	// adding members moves them to the department
+	code, body = do("PATCH", "/scim/v2/Groups/3", `{"schemas":["`+scimPatchSchema+`"],"Operations":[
+		{"op":"add","path":"members","value":[{"value":"1"},{"value":"2"}]},
+		{"op":"remove","path":"members[value eq \"2\"]"}]}`)
+	s.Expect(http.StatusOK, code)
+	s.Expect(2, len(group(body).Members))
+	p, _ := app.persons.Get(2)
+	s.Expect(3, p.Department)
+	app.bg.Wait()
+	req := httptest.NewRequest("GET", "/api/department/3/persons", nil)
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, req)
+	s.ExpectMatches(w.Body.String(), `^\{"Count":2,`)
+
+	var tests = []struct {
+		method, target, body string
+		wantCode             int
+	}{
+		{"GET", "/scim/v2/Groups/9", "", http.StatusNotFound},
+		{"POST", "/scim/v2/Groups", `{"displayName":"Salg"}`, http.StatusNotImplemented},
+		{"DELETE", "/scim/v2/Groups/1", "", http.StatusNotImplemented},
+		{"PATCH", "/scim/v2/Groups/1", `{"Operations":[{"op":"replace","value":{"displayName":"Data"}}]}`, http.StatusBadRequest},
+		{"PATCH", "/scim/v2/Groups/1", `{"Operations":[{"op":"add","path":"members","value":[{"value":"9"}]}]}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if code, body := do(tt.method, tt.target, tt.body); code != tt.wantCode {
+			t.Errorf("%s %s => %d %s; want %d", tt.method, tt.target, code, body, tt.wantCode)
+		}
+	}
+	p, _ = app.persons.Get(1)
+	s.Expect(3, p.Department)
+}
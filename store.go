@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Store is a database of JSON documents keyed by integer IDs. DB is the
+// in-memory implementation, which is persisted by dumping it to a JSON file.
+// BoltDB stores the documents in an embedded on-disk database.
+type Store interface {
+	// Create inserts a new document, and returns its ID.
+	Create(data *[]byte) (int, error)
+	// Get returns a document, or ErrNotFound.
+	Get(id int) (*[]byte, error)
+	// Set stores a document at the given ID, which does not need to exist.
+	Set(id int, data *[]byte) error
+	// Del removes a document, and returns false if it doesn't exist.
+	Del(id int) bool
+	// Size returns the number of documents.
+	Size() int
+	// IDs returns the IDs of all documents, in ascending order.
+	IDs() []int
+	// Update runs fn in a transaction, see Tx.
+	Update(fn func(tx *Tx) error) error
+	// Changes returns the last change to each document made after the change
+	// numbered seq, in order, and the number of the last change. Every
+	// write is numbered, from 1. Deleted documents are returned as
+	// tombstones.
+	Changes(seq uint64) ([]Change, uint64)
+	// Compact removes the tombstones of the documents deleted more than keep
+	// changes ago, and returns the number removed. The last change before
+	// the kept ones becomes the horizon. The tombstone of the highest ID is
+	// kept, so that the ID isn't reused when a dump is loaded.
+	Compact(keep uint64) (int, error)
+	// Horizon returns the number of the change up to which tombstones have
+	// been removed, or 0. The changes after a seq below it may be missing
+	// deletions.
+	Horizon() uint64
+	// Iterate calls fn for each of the documents with the given IDs, in
+	// order, skipping IDs which don't exist. No locks are held while fn
+	// runs. Iteration stops at the first error returned by fn.
+	Iterate(ids []int, fn func(id int, data []byte) error) error
+
+	// WriteSeveral writes the documents with the given IDs to w as a JSON
+	// array, in the form: [{"ID": 1, "Data": {jsonData}},{..},{..}]
+	WriteSeveral(w io.Writer, ids []int) error
+	// WriteAll writes all documents to w in the same form as WriteSeveral.
+	WriteAll(w io.Writer) error
+	// All returns all documents in the same form as WriteSeveral.
+	All() []byte
+	// GetSeveral returns the documents with the given IDs in the same form
+	// as WriteSeveral.
+	GetSeveral(ids []int) []byte
+	// Dump writes all documents, with the sequence numbers of their last
+	// changes, the tombstones of deleted documents, and the horizon, to a
+	// JSON file, which can be loaded with NewFromFile.
+	Dump(fname string) error
+
+	// AddIndex declares a secondary index, see DB.AddIndex.
+	AddIndex(name string, unique bool, fn IndexFunc) error
+	// Lookup returns the IDs of the documents with the given key in the
+	// named index, in ascending order.
+	Lookup(name, key string) []int
+}
+
+// Change is the last change to a document, numbered by a sequence number
+// which is global to the store. Data is nil if the document was deleted.
+type Change struct {
+	Seq     uint64
+	ID      int
+	Deleted bool
+	Data    []byte
+}
+
+// writeSeveral implements Store.WriteSeveral on top of Store.Iterate.
+func writeSeveral(s Store, w io.Writer, ids []int) error {
+	sep := "["
+	err := s.Iterate(ids, func(id int, data []byte) error {
+		if _, err := fmt.Fprintf(w, "%s{\"ID\":%d,\"Data\":", sep, id); err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+		_, err := io.WriteString(w, "}")
+		sep = ","
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if sep == "[" { // no documents written
+		_, err = io.WriteString(w, "[]")
+		return err
+	}
+	_, err = io.WriteString(w, "]")
+	return err
+}
+
+// writeChanges writes cs to w as a JSON array in the form of WriteSeveral,
+// with the sequence number of each change, and deleted documents as
+// tombstones: [{"ID":1,"Seq":3,"Data":{jsonData}},{"ID":2,"Seq":4,"Deleted":true}]
+func writeChanges(w io.Writer, cs []Change) error {
+	sep := "["
+	for _, c := range cs {
+		var err error
+		if c.Deleted {
+			_, err = fmt.Fprintf(w, "%s{\"ID\":%d,\"Seq\":%d,\"Deleted\":true}", sep, c.ID, c.Seq)
+		} else if _, err = fmt.Fprintf(w, "%s{\"ID\":%d,\"Seq\":%d,\"Data\":", sep, c.ID, c.Seq); err == nil {
+			if _, err = w.Write(c.Data); err == nil {
+				_, err = io.WriteString(w, "}")
+			}
+		}
+		if err != nil {
+			return err
+		}
+		sep = ","
+	}
+	if sep == "[" { // no documents written
+		_, err := io.WriteString(w, "[]")
+		return err
+	}
+	_, err := io.WriteString(w, "]")
+	return err
+}
+
+// dump implements Store.Dump on top of Store.Changes. The horizon is written
+// as the tombstone of ID 0, which no document has.
+func dump(s Store, fname string) error {
+	f, err := os.Create(fname)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	h := s.Horizon()
+	cs, _ := s.Changes(0)
+	if h > 0 {
+		cs = append([]Change{{Seq: h, Deleted: true}}, cs...)
+	}
+	if err = writeChanges(w, cs); err == nil {
+		err = w.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// copyStore copies all documents from src to dst, keeping their IDs.
+func copyStore(dst, src Store) error {
+	return src.Iterate(src.IDs(), func(id int, data []byte) error {
+		b := append([]byte(nil), data...)
+		return dst.Set(id, &b)
+	})
+}
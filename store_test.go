@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/knakk/specs"
+)
+
+// testStore runs the tests every Store implementation must pass. newStore
+// must return a new, empty store.
+func testStore(t *testing.T, newStore func(t *testing.T) Store) {
+	t.Run("CRUD", func(t *testing.T) {
+		s := specs.New(t)
+		db := newStore(t)
+		s.Expect(0, db.Size())
+		_, err := db.Get(1)
+		s.Expect(ErrNotFound, err)
+
+		sult, _ := json.Marshal(Book{"Knut Hamsun", "Sult", 1890})
+		id, err := db.Create(&sult)
+		s.ExpectNilFatal(err)
+		s.Expect(1, id)
+		b, err := db.Get(id)
+		s.ExpectNilFatal(err)
+		s.Expect(string(sult), string(*b))
+
+		pan, _ := json.Marshal(Book{"Knut Hamsun", "Pan", 1894})
+		s.ExpectNilFatal(db.Set(id, &pan))
+		b, err = db.Get(id)
+		s.ExpectNilFatal(err)
+		s.Expect(string(pan), string(*b))
+
+		// Set may create documents, and Create continues after the highest ID
+		s.ExpectNilFatal(db.Set(10, &sult))
+		id2, err := db.Create(&sult)
+		s.ExpectNilFatal(err)
+		s.Expect(11, id2)
+		s.Expect(3, db.Size())
+		s.Expect([]int{1, 10, 11}, db.IDs())
+
+		s.Expect(true, db.Del(10))
+		s.Expect(false, db.Del(10))
+		_, err = db.Get(10)
+		s.Expect(ErrNotFound, err)
+		s.Expect([]int{1, 11}, db.IDs())
+	})
+
+	t.Run("JSON", func(t *testing.T) {
+		s := specs.New(t)
+		db := newStore(t)
+		s.Expect("[]", string(db.All()))
+		s.Expect("[]", string(db.GetSeveral([]int{1})))
+
+		sult := []byte(`{"Title":"Sult"}`)
+		pan := []byte(`{"Title":"Pan"}`)
+		db.Create(&sult)
+		db.Create(&pan)
+		s.Expect(`[{"ID":1,"Data":{"Title":"Sult"}},{"ID":2,"Data":{"Title":"Pan"}}]`, string(db.All()))
+		s.Expect(`[{"ID":2,"Data":{"Title":"Pan"}}]`, string(db.GetSeveral([]int{99, 2})))
+
+		var ids []int
+		err := db.Iterate([]int{2, 3, 1}, func(id int, data []byte) error {
+			ids = append(ids, id)
+			return nil
+		})
+		s.ExpectNilFatal(err)
+		s.Expect([]int{2, 1}, ids)
+
+		fname := filepath.Join(t.TempDir(), "dump.json")
+		s.ExpectNilFatal(db.Dump(fname))
+		loaded, err := NewFromFile(fname)
+		s.ExpectNilFatal(err)
+		s.Expect(string(db.All()), string(loaded.All()))
+
+		cpy := newStore(t)
+		s.ExpectNilFatal(copyStore(cpy, loaded))
+		s.Expect(string(db.All()), string(cpy.All()))
+	})
+
+	t.Run("Indexes", func(t *testing.T) {
+		s := specs.New(t)
+		db := newStore(t)
+		sult, _ := json.Marshal(Book{"Knut Hamsun", "Sult", 1890})
+		db.Create(&sult)
+
+		byTitle := func(b []byte) (string, bool) {
+			var book Book
+			err := json.Unmarshal(b, &book)
+			return book.Title, err == nil
+		}
+		s.ExpectNilFatal(db.AddIndex("title", true, byTitle))
+		s.Expect([]int{1}, db.Lookup("title", "Sult"))
+		s.Expect(0, len(db.Lookup("nosuchindex", "Sult")))
+
+		_, err := db.Create(&sult)
+		s.Expect(&UniqueError{"title", "Sult"}, err)
+		s.Expect(1, db.Size())
+
+		pan, _ := json.Marshal(Book{"Knut Hamsun", "Pan", 1894})
+		id, err := db.Create(&pan)
+		s.ExpectNilFatal(err)
+		s.Expect(&UniqueError{"title", "Sult"}, db.Set(id, &sult))
+		b, _ := db.Get(id)
+		s.Expect(string(pan), string(*b))
+
+		db.Del(1)
+		s.ExpectNilFatal(db.Set(id, &sult))
+		s.Expect([]int{id}, db.Lookup("title", "Sult"))
+		s.Expect(0, len(db.Lookup("title", "Pan")))
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		s := specs.New(t)
+		db := newStore(t)
+		byTitle := func(b []byte) (string, bool) {
+			var book Book
+			err := json.Unmarshal(b, &book)
+			return book.Title, err == nil
+		}
+		s.ExpectNilFatal(db.AddIndex("title", true, byTitle))
+		sult, _ := json.Marshal(Book{"Knut Hamsun", "Sult", 1890})
+		pan, _ := json.Marshal(Book{"Knut Hamsun", "Pan", 1894})
+		victoria, _ := json.Marshal(Book{"Knut Hamsun", "Victoria", 1898})
+		markens, _ := json.Marshal(Book{"Knut Hamsun", "Markens grøde", 1917})
+		db.Create(&sult)
+		db.Create(&pan)
+		before := string(db.All())
+
+		// rolled back when fn fails
+		errFail := errors.New("fail")
+		err := db.Update(func(tx *Tx) error {
+			if _, err := tx.Create(&victoria); err != nil {
+				return err
+			}
+			s.ExpectNilFatal(tx.Set(1, &markens))
+			s.Expect(true, tx.Del(1))
+			s.Expect(true, tx.Del(2))
+			_, err := tx.Get(2)
+			s.Expect(ErrNotFound, err)
+			return errFail
+		})
+		s.Expect(errFail, err)
+		s.Expect(before, string(db.All()))
+		s.Expect([]int{1}, db.Lookup("title", "Sult"))
+		s.Expect([]int{2}, db.Lookup("title", "Pan"))
+		s.Expect(0, len(db.Lookup("title", "Victoria")))
+		s.Expect(0, len(db.Lookup("title", "Markens grøde")))
+
+		// rolled back on a unique index violation
+		var tx0 *Tx
+		err = db.Update(func(tx *Tx) error {
+			tx0 = tx
+			s.ExpectNilFatal(tx.Set(1, &victoria))
+			return tx.Set(2, &victoria)
+		})
+		s.Expect(&UniqueError{"title", "Victoria"}, err)
+		s.Expect(before, string(db.All()))
+		s.Expect(errTxDone, tx0.Set(1, &victoria))
+
+		// committed; the ID of the rolled back Create is free again
+		err = db.Update(func(tx *Tx) error {
+			s.Expect(true, tx.Del(1))
+			id, err := tx.Create(&sult)
+			s.Expect(3, id)
+			return err
+		})
+		s.ExpectNilFatal(err)
+		s.Expect([]int{2, 3}, db.IDs())
+		s.Expect([]int{3}, db.Lookup("title", "Sult"))
+	})
+
+	t.Run("Changes", func(t *testing.T) {
+		s := specs.New(t)
+		db := newStore(t)
+		cs, last := db.Changes(0)
+		s.Expect(0, len(cs))
+		s.Expect(uint64(0), last)
+
+		sult := []byte(`{"Title":"Sult"}`)
+		pan := []byte(`{"Title":"Pan"}`)
+		db.Create(&sult)                  // 1
+		db.Create(&pan)                   // 2
+		s.ExpectNilFatal(db.Set(1, &pan)) // 3
+		db.Del(2)                         // 4
+		db.Del(2)                         // not a change
+		cs, last = db.Changes(0)
+		s.Expect(uint64(4), last)
+		s.Expect([]Change{{3, 1, false, pan}, {4, 2, true, nil}}, cs)
+		cs, _ = db.Changes(3)
+		s.Expect([]Change{{4, 2, true, nil}}, cs)
+		cs, _ = db.Changes(4)
+		s.Expect(0, len(cs))
+
+		// rolled back transactions leave no changes
+		err := db.Update(func(tx *Tx) error {
+			tx.Create(&sult)
+			tx.Set(1, &sult)
+			tx.Del(1)
+			return errors.New("fail")
+		})
+		s.ExpectNot(nil, err)
+		cs, last = db.Changes(0)
+		s.Expect(uint64(4), last)
+		s.Expect([]Change{{3, 1, false, pan}, {4, 2, true, nil}}, cs)
+		s.ExpectNilFatal(db.Update(func(tx *Tx) error {
+			_, err := tx.Create(&sult)
+			return err
+		}))
+		cs, last = db.Changes(4)
+		s.Expect(uint64(5), last)
+		s.Expect([]Change{{5, 3, false, sult}}, cs)
+
+		// the changes are kept when dumped and loaded, and the IDs of
+		// deleted documents are not reused
+		fname := filepath.Join(t.TempDir(), "dump.json")
+		s.ExpectNilFatal(db.Dump(fname))
+		loaded, err := NewFromFile(fname)
+		s.ExpectNilFatal(err)
+		lcs, llast := loaded.Changes(0)
+		cs, last = db.Changes(0)
+		s.Expect(last, llast)
+		s.Expect(cs, lcs)
+		db.Del(3)
+		loaded.Del(3)
+		id, _ := loaded.Create(&sult)
+		s.Expect(4, id)
+		cs, last = loaded.Changes(5)
+		s.Expect(uint64(7), last)
+		s.Expect([]Change{{6, 3, true, nil}, {7, 4, false, sult}}, cs)
+	})
+
+	t.Run("Compact", func(t *testing.T) {
+		s := specs.New(t)
+		db := newStore(t)
+		sult := []byte(`{"Title":"Sult"}`)
+		for i := 0; i < 4; i++ {
+			db.Create(&sult) // 1-4
+		}
+		db.Del(1) // 5
+		db.Del(4) // 6
+		db.Del(3) // 7
+		n, err := db.Compact(9)
+		s.ExpectNilFatal(err)
+		s.Expect(0, n)
+		s.Expect(uint64(0), db.Horizon())
+
+		// the tombstones of the changes before the last keep are removed,
+		// but for the one of the highest ID
+		n, err = db.Compact(1)
+		s.ExpectNilFatal(err)
+		s.Expect(1, n)
+		s.Expect(uint64(6), db.Horizon())
+		cs, last := db.Changes(0)
+		s.Expect(uint64(7), last)
+		s.Expect([]Change{{2, 2, false, sult}, {6, 4, true, nil}, {7, 3, true, nil}}, cs)
+
+		// the horizon is kept when dumped and loaded
+		fname := filepath.Join(t.TempDir(), "dump.json")
+		s.ExpectNilFatal(db.Dump(fname))
+		loaded, err := NewFromFile(fname)
+		s.ExpectNilFatal(err)
+		s.Expect(uint64(6), loaded.Horizon())
+		lcs, llast := loaded.Changes(0)
+		s.Expect(last, llast)
+		s.Expect(cs, lcs)
+		id, _ := loaded.Create(&sult)
+		s.Expect(5, id)
+	})
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, func(t *testing.T) Store {
+		return New(8)
+	})
+}
+
+func TestBoltStore(t *testing.T) {
+	testStore(t, func(t *testing.T) Store {
+		db, err := OpenBolt(filepath.Join(t.TempDir(), "test.bolt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+		return db
+	})
+}
+
+func TestBoltReopen(t *testing.T) {
+	s := specs.New(t)
+	fname := filepath.Join(t.TempDir(), "test.bolt")
+	db, err := OpenBolt(fname)
+	s.ExpectNilFatal(err)
+	sult := []byte(`{"Title":"Sult"}`)
+	id, err := db.Create(&sult)
+	s.ExpectNilFatal(err)
+	s.ExpectNilFatal(db.Close())
+
+	db, err = OpenBolt(fname)
+	s.ExpectNilFatal(err)
+	defer db.Close()
+	b, err := db.Get(id)
+	s.ExpectNilFatal(err)
+	s.Expect(string(sult), string(*b))
+	id2, err := db.Create(&sult)
+	s.ExpectNilFatal(err)
+	s.Expect(id+1, id2)
+	cs, last := db.Changes(0)
+	s.Expect(uint64(2), last)
+	s.Expect(2, len(cs))
+}
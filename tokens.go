@@ -0,0 +1,317 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The scopes of API tokens. Each scope allows what the ones before it allow.
+const (
+	scopeRead         = "read"          // GET requests
+	scopePersonsWrite = "persons:write" // and writes to persons
+	scopeAdmin        = "admin"         // and managing tokens and webhooks
+)
+
+var scopeLevels = map[string]int{
+	scopeRead:         1,
+	scopePersonsWrite: 2,
+	scopeAdmin:        3,
+}
+
+// scopeAllows reports whether a token with scope has the scope needed.
+func scopeAllows(scope, needed string) bool {
+	return scopeLevels[scope] >= scopeLevels[needed]
+}
+
+// tokenLastUsedInterval is how often the last-used time of a token is
+// updated, so that a busy script doesn't keep tokens.db dirty.
+const tokenLastUsedInterval = time.Minute
+
+// apiToken is an API token, used by scripts as "Authorization: Bearer
+// <token>". Only the SHA-256 hash of the token is stored; the token itself is
+// shown once, when it is created.
+type apiToken struct {
+	ID       int `json:"-"`
+	Name     string
+	Scope    string
+	Hash     string
+	Created  time.Time
+	Expires  *time.Time `json:",omitempty"`
+	LastUsed *time.Time `json:",omitempty"`
+	Revoked  *time.Time `json:",omitempty"`
+}
+
+func (t *apiToken) setID(id int) { t.ID = id }
+
+// hashToken returns the hash of a token, as stored.
+func hashToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// newTokenStore returns a store of API tokens backed by db, with unique
+// indexes on name and hash.
+func newTokenStore(db Store) *TypedStore[apiToken] {
+	s := NewTypedStore[apiToken](db)
+	s.AddIndex("name", true, func(t apiToken) string { return t.Name })
+	s.AddIndex("hash", true, func(t apiToken) string { return t.Hash })
+	return s
+}
+
+type TokenRequest struct {
+	Name  string
+	Scope string
+	// Expires is when the token stops working, or never if nil.
+	Expires *time.Time
+}
+
+type TokenResponse struct {
+	ID       int
+	Name     string
+	Scope    string
+	Created  time.Time
+	Expires  *time.Time `json:",omitempty"`
+	LastUsed *time.Time `json:",omitempty"`
+	Revoked  *time.Time `json:",omitempty"`
+	// Token is only returned when the token is created.
+	Token string `json:",omitempty"`
+}
+
+func tokenResponse(t apiToken) *TokenResponse {
+	return &TokenResponse{
+		ID:       t.ID,
+		Name:     t.Name,
+		Scope:    t.Scope,
+		Created:  t.Created,
+		Expires:  t.Expires,
+		LastUsed: t.LastUsed,
+		Revoked:  t.Revoked,
+	}
+}
+
+type TokensResponse struct {
+	Tokens []*TokenResponse
+}
+
+// GET /tokens
+func (app *App) listTokens(u *url.URL, h http.Header, _ interface{}) (int, http.Header, *TokensResponse, error) {
+	res := &TokensResponse{Tokens: []*TokenResponse{}}
+	app.tokens.Iterate(func(id int, t apiToken) error {
+		res.Tokens = append(res.Tokens, tokenResponse(t))
+		return nil
+	})
+	return http.StatusOK, nil, res, nil
+}
+
+// POST /tokens
+func (app *App) createToken(u *url.URL, h http.Header, rq *TokenRequest) (int, http.Header, *TokenResponse, error) {
+	if rq.Name == "" {
+		return http.StatusBadRequest, nil, nil, errors.New("required parameters: name, scope")
+	}
+	if _, ok := scopeLevels[rq.Scope]; !ok {
+		return http.StatusBadRequest, nil, nil, fmt.Errorf(`scope must be %q, %q or %q`, scopeRead, scopePersonsWrite, scopeAdmin)
+	}
+	now := time.Now().UTC()
+	if rq.Expires != nil && !rq.Expires.After(now) {
+		return http.StatusBadRequest, nil, nil, errors.New("expires must be in the future")
+	}
+	secret := "folk_" + newToken()
+	t := apiToken{Name: rq.Name, Scope: rq.Scope, Hash: hashToken(secret), Created: now, Expires: rq.Expires}
+	id, err := app.tokens.Create(t)
+	if _, ok := err.(*UniqueError); ok {
+		return http.StatusConflict, nil, nil, errors.New("a token with this name already exists")
+	}
+	if err != nil {
+		app.logError(h, "POST /tokens: %v", err)
+		return http.StatusInternalServerError, nil, nil, errors.New("failed to save token to database")
+	}
+	t.ID = id
+	app.saveTokens(h)
+
+	res := tokenResponse(t)
+	res.Token = secret
+	return http.StatusCreated, nil, res, nil
+}
+
+// DELETE /tokens/{id}
+//
+// The token is revoked, but kept, so it is still listed.
+func (app *App) revokeToken(u *url.URL, h http.Header, _ interface{}) (int, http.Header, *TokenResponse, error) {
+	id, err := strconv.Atoi(u.Query().Get("id"))
+	if err != nil {
+		return http.StatusBadRequest, nil, nil, errors.New("token ID must be an integer")
+	}
+	var t apiToken
+	err = app.tokens.Update(func(tx *TypedTx[apiToken]) error {
+		var err error
+		t, err = tx.Get(id)
+		if err != nil {
+			return err
+		}
+		if t.Revoked == nil {
+			now := time.Now().UTC()
+			t.Revoked = &now
+		}
+		return tx.Put(id, t)
+	})
+	if err == ErrNotFound {
+		return http.StatusNotFound, nil, nil, errors.New("token not found")
+	}
+	if err != nil {
+		app.logError(h, "DELETE /tokens/%d: %v", id, err)
+		return http.StatusInternalServerError, nil, nil, errors.New("failed to store in database")
+	}
+	app.saveTokens(h)
+	return http.StatusOK, nil, tokenResponse(t), nil
+}
+
+// saveTokens saves tokens.db right away, as tokens are rarely created or
+// revoked, and revoking one should survive a crash.
+func (app *App) saveTokens(h http.Header) {
+	app.tokenSaver.Inc()
+	if err := app.tokenSaver.Flush(); err != nil {
+		app.logError(h, "failed to save tokens: %v", err)
+	}
+}
+
+var errInvalidToken = errors.New("invalid, expired or revoked token")
+
+// checkToken returns the token with the given secret, if it is valid, and
+// records that it was used.
+func (app *App) checkToken(secret string) (apiToken, error) {
+	ids := app.tokens.Lookup("hash", hashToken(secret))
+	if len(ids) == 0 {
+		return apiToken{}, errInvalidToken
+	}
+	var t apiToken
+	now := time.Now().UTC()
+	used := false
+	err := app.tokens.Update(func(tx *TypedTx[apiToken]) error {
+		var err error
+		t, err = tx.Get(ids[0])
+		if err != nil {
+			return err
+		}
+		if t.Revoked != nil || (t.Expires != nil && !t.Expires.After(now)) {
+			return errInvalidToken
+		}
+		if t.LastUsed != nil && now.Sub(*t.LastUsed) < tokenLastUsedInterval {
+			return nil
+		}
+		t.LastUsed = &now
+		used = true
+		return tx.Put(t.ID, t)
+	})
+	if err == ErrNotFound {
+		err = errInvalidToken
+	}
+	if used {
+		app.tokenSaver.Inc()
+	}
+	return t, err
+}
+
+// bearerToken returns the token in the Authorization header of r, if any.
+func bearerToken(r *http.Request) (string, bool) {
+	const prefix = "Bearer "
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, prefix) {
+		return "", false
+	}
+	return strings.TrimSpace(h[len(prefix):]), true
+}
+
+// authorizeToken checks that the token with the given secret is valid, and
+// has the scope needed for r, and records it in the access log. If not, it
+// responds with 401 or 403, and returns false.
+func (app *App) authorizeToken(w http.ResponseWriter, r *http.Request, secret, needed string) bool {
+	t, err := app.checkToken(secret)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return false
+	}
+	if info := requestInfoFrom(r); info != nil {
+		info.token = t.Name
+	}
+	if !scopeAllows(t.Scope, needed) {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope=%q`, needed))
+		http.Error(w, fmt.Sprintf("token scope %q does not allow this request", t.Scope), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// adminPaths are the API resources only admins can access.
+var adminPaths = []string{"/tokens", "/webhooks", "/deliveries"}
+
+// requiredScope returns the token scope needed for a request to the API, with
+// path relative to /api.
+func requiredScope(method, path string) string {
+	for _, p := range adminPaths {
+		if path == p || strings.HasPrefix(path, p+"/") {
+			return scopeAdmin
+		}
+	}
+	switch method {
+	case "GET", "HEAD", "OPTIONS":
+		return scopeRead
+	}
+	return scopePersonsWrite
+}
+
+// authorize checks that r has the scope needed, and responds with 401 or 403
+// and returns false if not. Reads need no credentials. Writes need a token
+// with the scope, or a user logged in with a role which allows it.
+func (app *App) authorize(w http.ResponseWriter, r *http.Request, needed string) bool {
+	if secret, ok := bearerToken(r); ok {
+		return app.authorizeToken(w, r, secret, needed)
+	}
+	if needed == scopeRead {
+		return true
+	}
+	role := app.sessionRole(r)
+	if scopeAllows(role, needed) {
+		return true
+	}
+	if role != "" {
+		http.Error(w, fmt.Sprintf("role %q does not allow this request", role), http.StatusForbidden)
+		return false
+	}
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	if needed == scopeAdmin {
+		http.Error(w, "admin login or an admin token is required", http.StatusUnauthorized)
+	} else {
+		http.Error(w, "login or a token is required", http.StatusUnauthorized)
+	}
+	return false
+}
+
+// requireScope wraps h to serve only requests with the scope needed, see
+// authorize.
+func (app *App) requireScope(needed string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.authorize(w, r, needed) {
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// authenticate wraps the API handler h to serve only requests with the
+// scope needed, see authorize.
+func (app *App) authenticate(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.authorize(w, r, requiredScope(r.Method, r.URL.Path)) {
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
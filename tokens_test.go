@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/knakk/specs"
+)
+
+func TestAPITokens(t *testing.T) {
+	s := specs.New(t)
+	app := newTestApp(t, dept{1, "main", 0})
+	var logBuf bytes.Buffer
+	app.logOut = &logBuf
+	testServer := httptest.NewServer(app)
+	defer testServer.Close()
+
+	// the first admin token
+	_, err := app.tokens.Create(apiToken{Name: "root", Scope: scopeAdmin, Hash: hashToken("rootsecret"), Created: time.Now()})
+	s.ExpectNilFatal(err)
+
+	do := func(method, path, token, body string) (int, string) {
+		req, err := http.NewRequest(method, testServer.URL+path, strings.NewReader(body))
+		s.ExpectNilFatal(err)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Accept", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		s.ExpectNilFatal(err)
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		s.ExpectNilFatal(err)
+		return resp.StatusCode, string(b)
+	}
+	create := func(name, scope string) string {
+		code, body := do("POST", "/api/tokens", "rootsecret", `{"Name":"`+name+`","Scope":"`+scope+`"}`)
+		s.Expect(http.StatusCreated, code)
+		var res TokenResponse
+		s.ExpectNilFatal(json.Unmarshal([]byte(body), &res))
+		s.ExpectMatches(res.Token, "^folk_[0-9a-f]{64}$")
+		return res.Token
+	}
+	reader := create("hr-read", scopeRead)
+	writer := create("hr-sync", scopePersonsWrite)
+
+	var tests = []struct {
+		method, path, token, body string
+		want                      int
+	}{
+		// tokens can't be managed without login or an admin token
+		{"GET", "/api/tokens", "", "", http.StatusUnauthorized},
+		{"GET", "/api/tokens", writer, "", http.StatusForbidden},
+		{"POST", "/api/tokens", "", `{"Name":"x","Scope":"admin"}`, http.StatusUnauthorized},
+		{"POST", "/api/tokens", "rootsecret", `{"Name":"hr-read","Scope":"read"}`, http.StatusConflict},
+		{"POST", "/api/tokens", "rootsecret", `{"Name":"x","Scope":"superuser"}`, http.StatusBadRequest},
+		{"POST", "/api/tokens", "rootsecret", `{"Name":"x","Scope":"read","Expires":"2001-01-01T00:00:00Z"}`, http.StatusBadRequest},
+		// tokens are checked, and their scope enforced
+		{"GET", "/api/person/1", "nosuchtoken", "", http.StatusUnauthorized},
+		{"POST", "/api/person", reader, `{"Name":"A","Department":1,"Email":"a@example.com"}`, http.StatusForbidden},
+		{"POST", "/api/person", writer, `{"Name":"A","Department":1,"Email":"a@example.com"}`, http.StatusCreated},
+		{"GET", "/api/person/1", reader, "", http.StatusOK},
+		{"DELETE", "/api/person/1", reader, "", http.StatusForbidden},
+		// reads need no credentials, but writes do
+		{"GET", "/api/person/1", "", "", http.StatusOK},
+		{"POST", "/api/person", "", `{"Name":"B","Department":1,"Email":"b@example.com"}`, http.StatusUnauthorized},
+		{"DELETE", "/api/person/1", "", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		if code, body := do(tt.method, tt.path, tt.token, tt.body); code != tt.want {
+			t.Errorf("%s %s with token %q => %d %s; want %d", tt.method, tt.path, tt.token, code, body, tt.want)
+		}
+	}
+
+	// the tokens are listed, with their last use, but not their hashes
+	code, body := do("GET", "/api/tokens", "rootsecret", "")
+	s.Expect(http.StatusOK, code)
+	s.ExpectNotMatches(body, "Hash|Token\"|folk_")
+	var list TokensResponse
+	s.ExpectNilFatal(json.Unmarshal([]byte(body), &list))
+	s.Expect(3, len(list.Tokens))
+	for _, tok := range list.Tokens {
+		if tok.LastUsed == nil {
+			t.Errorf("token %s: LastUsed not set", tok.Name)
+		}
+	}
+
+	// the token name is in the access log
+	s.ExpectMatches(logBuf.String(), `"method":"POST","route":"/api/person",.*"status":201,.*"token":"hr-sync"`)
+
+	// revoked tokens are refused, but still listed
+	code, body = do("DELETE", "/api/tokens/3", "rootsecret", "")
+	s.Expect(http.StatusOK, code)
+	s.ExpectMatches(body, `"Name":"hr-sync".*"Revoked":"`)
+	code, _ = do("GET", "/api/person/1", writer, "")
+	s.Expect(http.StatusUnauthorized, code)
+	code, _ = do("DELETE", "/api/tokens/9", "rootsecret", "")
+	s.Expect(http.StatusNotFound, code)
+
+	// so are expired ones
+	expired := time.Now().Add(-time.Second)
+	_, err = app.tokens.Create(apiToken{Name: "old", Scope: scopeAdmin, Hash: hashToken("oldsecret"), Expires: &expired})
+	s.ExpectNilFatal(err)
+	code, _ = do("GET", "/api/person/1", "oldsecret", "")
+	s.Expect(http.StatusUnauthorized, code)
+
+	// the tokens are saved hashed
+	b, err := ioutil.ReadFile(app.dataPath("tokens.db"))
+	s.ExpectNilFatal(err)
+	s.ExpectNotMatches(string(b), reader)
+	s.ExpectMatches(string(b), hashToken(reader))
+}
+
+func TestTokenScopes(t *testing.T) {
+	s := specs.New(t)
+	var tests = []struct {
+		method, path, want string
+	}{
+		{"GET", "/person", scopeRead},
+		{"GET", "/export", scopeRead},
+		{"POST", "/person", scopePersonsWrite},
+		{"DELETE", "/person/1", scopePersonsWrite},
+		{"POST", "/batch", scopePersonsWrite},
+		{"GET", "/tokens", scopeAdmin},
+		{"DELETE", "/tokens/1", scopeAdmin},
+	}
+	for _, tt := range tests {
+		s.Expect(tt.want, requiredScope(tt.method, tt.path))
+	}
+	s.Expect(true, scopeAllows(scopeAdmin, scopePersonsWrite))
+	s.Expect(true, scopeAllows(scopeRead, scopeRead))
+	s.Expect(false, scopeAllows(scopeRead, scopePersonsWrite))
+	s.Expect(false, scopeAllows("", scopeRead))
+}
@@ -0,0 +1,134 @@
+package main
+
+import "errors"
+
+// errTxDone is returned when a Tx is used after its Update has returned.
+var errTxDone = errors.New("transaction has already been committed or rolled back")
+
+// txOps are the primitive operations of a store, used by Tx. They are called
+// with the store's write lock held, and keep the secondary indexes and the
+// change log up to date.
+type txOps interface {
+	get(id int) ([]byte, bool)
+	create(data []byte) (int, error)
+	set(id int, data []byte) error
+	del(id int) bool
+	maxID() int
+	setMaxID(id int) error
+	changeOf(id int) (change, bool)
+	setChange(id int, c change, ok bool) error
+	lastSeq() uint64
+	setLastSeq(seq uint64) error
+}
+
+// undo restores a single document, and its last change, to how they were
+// before a write.
+type undo struct {
+	id      int
+	data    []byte
+	existed bool
+	change  change
+	changed bool
+}
+
+// Tx is a transaction, as passed to the Update method of a Store. Writes are
+// applied as they are made, but the store is locked for the whole transaction,
+// so that other readers and writers never see a partially applied
+// transaction. If the transaction fails, the writes are undone in reverse
+// order.
+type Tx struct {
+	ops   txOps
+	undos []undo
+	done  bool
+}
+
+// runTx runs fn in a transaction on ops, rolling back if fn returns an error.
+// The caller must hold the store's write lock.
+func runTx(ops txOps, fn func(tx *Tx) error) error {
+	tx := &Tx{ops: ops}
+	maxID, seq := ops.maxID(), ops.lastSeq()
+	err := fn(tx)
+	tx.done = true
+	if err != nil {
+		if rerr := tx.rollback(maxID, seq); rerr != nil {
+			return rerr
+		}
+	}
+	return err
+}
+
+func (tx *Tx) rollback(maxID int, seq uint64) error {
+	for i := len(tx.undos) - 1; i >= 0; i-- {
+		u := tx.undos[i]
+		if !u.existed {
+			tx.ops.del(u.id)
+		} else if err := tx.ops.set(u.id, u.data); err != nil {
+			return err
+		}
+		if err := tx.ops.setChange(u.id, u.change, u.changed); err != nil {
+			return err
+		}
+	}
+	if err := tx.ops.setLastSeq(seq); err != nil {
+		return err
+	}
+	return tx.ops.setMaxID(maxID)
+}
+
+// record saves the current state of the document id, so it can be restored
+// on rollback.
+func (tx *Tx) record(id int) {
+	data, ok := tx.ops.get(id)
+	c, changed := tx.ops.changeOf(id)
+	tx.undos = append(tx.undos, undo{id, data, ok, c, changed})
+}
+
+// Get returns a document, including any writes made by the transaction.
+func (tx *Tx) Get(id int) (*[]byte, error) {
+	if tx.done {
+		return nil, errTxDone
+	}
+	if b, ok := tx.ops.get(id); ok {
+		return &b, nil
+	}
+	return nil, ErrNotFound
+}
+
+// Create inserts a new document, and returns its id.
+func (tx *Tx) Create(data *[]byte) (int, error) {
+	if tx.done {
+		return 0, errTxDone
+	}
+	id, err := tx.ops.create(*data)
+	if err != nil {
+		return 0, err
+	}
+	tx.undos = append(tx.undos, undo{id: id})
+	return id, nil
+}
+
+// Set updates a document at a given id. The document does not need to exist.
+func (tx *Tx) Set(id int, data *[]byte) error {
+	if tx.done {
+		return errTxDone
+	}
+	tx.record(id)
+	if err := tx.ops.set(id, *data); err != nil {
+		tx.undos = tx.undos[:len(tx.undos)-1]
+		return err
+	}
+	return nil
+}
+
+// Del removes a document. It returns false if the document doesn't exist.
+func (tx *Tx) Del(id int) bool {
+	if tx.done {
+		return false
+	}
+	tx.record(id)
+	if !tx.ops.del(id) {
+		tx.undos = tx.undos[:len(tx.undos)-1]
+		return false
+	}
+	return true
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// identifiable is implemented by document types which keep their own ID. The
+// ID is the key of the document in the database, and is not stored as part of
+// the document itself.
+type identifiable interface {
+	setID(id int)
+}
+
+// TypedStore is a typed layer over a Store, storing values of type T as JSON
+// documents. All marshalling to and from the database goes through it.
+type TypedStore[T any] struct {
+	db Store
+}
+
+// NewTypedStore returns a TypedStore of values of type T, backed by db.
+func NewTypedStore[T any](db Store) *TypedStore[T] {
+	return &TypedStore[T]{db: db}
+}
+
+// DB returns the underlying database.
+func (s *TypedStore[T]) DB() Store {
+	return s.db
+}
+
+// Size returns the number of documents in the store.
+func (s *TypedStore[T]) Size() int {
+	return s.db.Size()
+}
+
+// IDs returns the IDs of all documents in the store, in ascending order.
+func (s *TypedStore[T]) IDs() []int {
+	return s.db.IDs()
+}
+
+func (s *TypedStore[T]) decode(id int, b []byte) (T, error) {
+	var v T
+	if err := json.Unmarshal(b, &v); err != nil {
+		return v, fmt.Errorf("failed to decode document %d: %v", id, err)
+	}
+	if i, ok := any(&v).(identifiable); ok {
+		i.setID(id)
+	}
+	return v, nil
+}
+
+// Get returns the document with the given id. The error is ErrNotFound if the
+// document doesn't exist.
+func (s *TypedStore[T]) Get(id int) (T, error) {
+	b, err := s.db.Get(id)
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	return s.decode(id, *b)
+}
+
+// Create stores v as a new document, and returns its id.
+func (s *TypedStore[T]) Create(v T) (int, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return 0, err
+	}
+	return s.db.Create(&b)
+}
+
+// Put stores v as the document with the given id, replacing any existing
+// document.
+func (s *TypedStore[T]) Put(id int, v T) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.db.Set(id, &b)
+}
+
+// Delete removes a document. It returns false if the document doesn't exist.
+func (s *TypedStore[T]) Delete(id int) bool {
+	return s.db.Del(id)
+}
+
+// Iterate calls fn with each document in the store, in order of ID. It stops
+// at the first error, either from decoding a document or returned by fn.
+func (s *TypedStore[T]) Iterate(fn func(id int, v T) error) error {
+	return s.IterateSeveral(s.db.IDs(), fn)
+}
+
+// IterateSeveral is like Iterate, but only for the documents with the given
+// IDs. IDs not in the store are skipped.
+func (s *TypedStore[T]) IterateSeveral(ids []int, fn func(id int, v T) error) error {
+	return s.db.Iterate(ids, func(id int, b []byte) error {
+		v, err := s.decode(id, b)
+		if err != nil {
+			return err
+		}
+		return fn(id, v)
+	})
+}
+
+// TypedChange is the last change to a document, see Change. Value is nil if
+// the document was deleted.
+type TypedChange[T any] struct {
+	Seq     uint64
+	ID      int
+	Deleted bool
+	Value   *T
+}
+
+// Changes returns the changes made after the change numbered seq, and the
+// number of the last change, as described for Store.Changes.
+func (s *TypedStore[T]) Changes(seq uint64) ([]TypedChange[T], uint64, error) {
+	cs, last := s.db.Changes(seq)
+	res := make([]TypedChange[T], len(cs))
+	for i, c := range cs {
+		res[i] = TypedChange[T]{Seq: c.Seq, ID: c.ID, Deleted: c.Deleted}
+		if c.Deleted {
+			continue
+		}
+		v, err := s.decode(c.ID, c.Data)
+		if err != nil {
+			return nil, 0, err
+		}
+		res[i].Value = &v
+	}
+	return res, last, nil
+}
+
+// AddIndex declares a secondary index on the key returned by fn, as described
+// for Store.AddIndex. Documents for which fn returns "" are not indexed.
+func (s *TypedStore[T]) AddIndex(name string, unique bool, fn func(v T) string) error {
+	return s.db.AddIndex(name, unique, func(b []byte) (string, bool) {
+		var v T
+		if err := json.Unmarshal(b, &v); err != nil {
+			return "", false
+		}
+		key := fn(v)
+		return key, key != ""
+	})
+}
+
+// Lookup returns the IDs of the documents with the given key in the named
+// index, in ascending order.
+func (s *TypedStore[T]) Lookup(name, key string) []int {
+	return s.db.Lookup(name, key)
+}
+
+// TypedTx is a transaction on a TypedStore, see Tx.
+type TypedTx[T any] struct {
+	s  *TypedStore[T]
+	tx *Tx
+}
+
+// Update runs fn in a transaction, as described for Store.Update. If fn
+// returns an error, none of its writes are applied.
+func (s *TypedStore[T]) Update(fn func(tx *TypedTx[T]) error) error {
+	return s.db.Update(func(tx *Tx) error {
+		return fn(&TypedTx[T]{s, tx})
+	})
+}
+
+// Get returns the document with the given id, including any writes made by
+// the transaction.
+func (tx *TypedTx[T]) Get(id int) (T, error) {
+	b, err := tx.tx.Get(id)
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	return tx.s.decode(id, *b)
+}
+
+// Create stores v as a new document, and returns its id.
+func (tx *TypedTx[T]) Create(v T) (int, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return 0, err
+	}
+	return tx.tx.Create(&b)
+}
+
+// Put stores v as the document with the given id.
+func (tx *TypedTx[T]) Put(id int, v T) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return tx.tx.Set(id, &b)
+}
+
+// Delete removes a document. It returns false if the document doesn't exist.
+func (tx *TypedTx[T]) Delete(id int) bool {
+	return tx.tx.Del(id)
+}
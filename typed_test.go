@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/knakk/specs"
+)
+
+func TestStore(t *testing.T) {
+	s := specs.New(t)
+	db := New(8)
+	st := NewTypedStore[person](db)
+
+	_, err := st.Get(1)
+	s.Expect(ErrNotFound, err)
+
+	id, err := st.Create(person{Name: "Åse", Department: 2, Email: "ase@example.com"})
+	s.ExpectNilFatal(err)
+	p, err := st.Get(id)
+	s.ExpectNilFatal(err)
+	s.Expect(id, p.ID)
+	s.Expect("Åse", p.Name)
+
+	// the ID is the key, and not part of the stored document
+	b, err := db.Get(id)
+	s.ExpectNilFatal(err)
+	s.ExpectNotMatches(string(*b), `"ID"`)
+
+	p.Role = "Sjef"
+	s.ExpectNilFatal(st.Put(id, p))
+	p, err = st.Get(id)
+	s.ExpectNilFatal(err)
+	s.Expect("Sjef", p.Role)
+
+	id2, err := st.Create(person{Name: "Bjørn"})
+	s.ExpectNilFatal(err)
+	var names []string
+	err = st.Iterate(func(id int, p person) error {
+		s.Expect(id, p.ID)
+		names = append(names, p.Name)
+		return nil
+	})
+	s.ExpectNilFatal(err)
+	s.Expect([]string{"Åse", "Bjørn"}, names)
+
+	s.Expect(true, st.Delete(id2))
+	s.Expect(1, st.Size())
+
+	// decoding errors are reported
+	bad := []byte(`{"Name": 1}`)
+	db.Set(id2, &bad)
+	_, err = st.Get(id2)
+	s.ExpectNot(nil, err)
+	s.ExpectNot(nil, st.Iterate(func(int, person) error { return nil }))
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// vCard lines should not be longer than 75 octets, excluding the line break.
+const vCardLineLen = 75
+
+var vCardEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	`,`, `\,`,
+	`;`, `\;`,
+	"\r\n", `\n`,
+	"\n", `\n`)
+
+// vCardEscape escapes a text value according to RFC 6350, section 3.4.
+func vCardEscape(s string) string {
+	return vCardEscaper.Replace(s)
+}
+
+// vCardWriter writes content lines, folding them at vCardLineLen octets
+// without splitting multi-byte UTF-8 characters.
+type vCardWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (vw *vCardWriter) line(s string) {
+	if vw.err != nil {
+		return
+	}
+	var b bytes.Buffer
+	max := vCardLineLen
+	for len(s) > max {
+		i := max
+		for i > 0 && !utf8.RuneStart(s[i]) {
+			i--
+		}
+		b.WriteString(s[:i])
+		b.WriteString("\r\n ")
+		s = s[i:]
+		max = vCardLineLen - 1 // continuation lines start with a space
+	}
+	b.WriteString(s)
+	b.WriteString("\r\n")
+	_, vw.err = vw.w.Write(b.Bytes())
+}
+
+// writeVCard writes a person as a vCard 4.0. If photo is non-empty it is
+// used as the value of the PHOTO property, which must be an URI.
+func (app *App) writeVCard(w io.Writer, id int, p person, photo string) error {
+	vw := &vCardWriter{w: w}
+	vw.line("BEGIN:VCARD")
+	vw.line("VERSION:4.0")
+	vw.line(fmt.Sprintf("UID:urn:folk:person:%d", id))
+	vw.line("FN:" + vCardEscape(p.Name))
+	given, family := splitName(p.Name)
+	vw.line(fmt.Sprintf("N:%s;%s;;;", vCardEscape(family), vCardEscape(given)))
+	if p.Role != "" {
+		vw.line("TITLE:" + vCardEscape(p.Role))
+	}
+	if d, ok := app.mapDepartments[p.Department]; ok {
+		org := vCardEscape(d.Name)
+		if parent, ok := app.mapDepartments[d.Parent]; ok {
+			org = vCardEscape(parent.Name) + ";" + org
+		}
+		vw.line("ORG:" + org)
+	}
+	if p.Email != "" {
+		vw.line("EMAIL;TYPE=work:" + vCardEscape(p.Email))
+	}
+	if p.Phone != "" {
+		vw.line("TEL;TYPE=work,voice;VALUE=text:" + vCardEscape(p.Phone))
+	}
+	if photo != "" {
+		vw.line("PHOTO:" + photo)
+	}
+	vw.line("END:VCARD")
+	return vw.err
+}
+
+// splitName splits a full name into given names and family name. The family
+// name is taken to be the last word.
+func splitName(name string) (given, family string) {
+	fields := strings.Fields(name)
+	if len(fields) < 2 {
+		return "", name
+	}
+	return strings.Join(fields[:len(fields)-1], " "), fields[len(fields)-1]
+}
+
+// photoURI returns the value of the vCard PHOTO property for a person. If
+// inline is true, the image is embedded as a data URI, otherwise it is a link
+// to the image served from /data/img.
+func (app *App) photoURI(r *http.Request, img string, inline bool) string {
+	if img == "" || img == "dummy.png" {
+		return ""
+	}
+	if inline {
+		b, err := ioutil.ReadFile(filepath.Join(app.dataPath("img"), filepath.Base(img)))
+		if err != nil {
+			return ""
+		}
+		return fmt.Sprintf("data:%s;base64,%s",
+			http.DetectContentType(b), base64.StdEncoding.EncodeToString(b))
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s/data/img/%s", scheme, r.Host, img)
+}
+
+// vCardID parses an ID in the form "12.vcf". The second return value is false
+// if the ID is not suffixed by .vcf.
+func vCardID(s string) (int, bool, error) {
+	if !strings.HasSuffix(s, ".vcf") {
+		return 0, false, nil
+	}
+	id, err := strconv.Atoi(strings.TrimSuffix(s, ".vcf"))
+	return id, true, err
+}
+
+// withVCard serves vCards for IDs ending in .vcf using vcf, and passes all
+// other requests on to h.
+func withVCard(h http.Handler, vcf func(http.ResponseWriter, *http.Request, int)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok, err := vCardID(r.URL.Query().Get("id"))
+		if !ok {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, "ID must be an integer", http.StatusBadRequest)
+			return
+		}
+		vcf(w, r, id)
+	}
+}
+
+// GET /person/{id}.vcf
+func (app *App) personVCard(w http.ResponseWriter, r *http.Request, id int) {
+	p, err := app.persons.Get(id)
+	if err == ErrNotFound {
+		http.Error(w, "person not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to read person from database", http.StatusInternalServerError)
+		return
+	}
+	inline := r.URL.Query().Get("photo") == "inline"
+	w.Header().Set("Content-Type", "text/vcard; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%d.vcf\"", id))
+	app.writeVCard(w, id, p, app.photoURI(r, p.Img, inline))
+}
+
+// GET /department/{id}.vcf
+func (app *App) departmentVCard(w http.ResponseWriter, r *http.Request, id int) {
+	if _, ok := app.mapDepartments[id]; !ok {
+		http.Error(w, "department not found", http.StatusNotFound)
+		return
+	}
+	inline := r.URL.Query().Get("photo") == "inline"
+	w.Header().Set("Content-Type", "text/vcard; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"avd-%d.vcf\"", id))
+	err := app.persons.IterateSeveral(app.departmentMembers(id), func(pid int, p person) error {
+		return app.writeVCard(w, pid, p, app.photoURI(r, p.Img, inline))
+	})
+	if err != nil {
+		app.logError(r.Header, "GET /department/%d.vcf: %v", id, err)
+	}
+}
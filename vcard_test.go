@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/knakk/specs"
+)
+
+var update = flag.Bool("update", false, "update golden files in testdata")
+
+// golden compares got with the contents of testdata/name, or writes got to
+// the file if the -update flag is given.
+func golden(t *testing.T, name string, got []byte) {
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := ioutil.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s: got:\n%s\nwant:\n%s", name, got, want)
+	}
+}
+
+// vCardValues unfolds a vCard and returns the unescaped value of each
+// property, keyed by property name (without parameters).
+func vCardValues(card string) map[string]string {
+	unescaper := strings.NewReplacer(`\n`, "\n", `\,`, ",", `\;`, ";", `\\`, `\`)
+	card = strings.Replace(card, "\r\n ", "", -1)
+	vals := make(map[string]string)
+	for _, l := range strings.Split(card, "\r\n") {
+		i := strings.Index(l, ":")
+		if i == -1 {
+			continue
+		}
+		name := strings.SplitN(l[:i], ";", 2)[0]
+		vals[name] = unescaper.Replace(l[i+1:])
+	}
+	return vals
+}
+
+func setupVCardTest(t *testing.T) *App {
+	app := newTestApp(t,
+		dept{1, "Deichmanske bibliotek", 0},
+		dept{2, "Økonomi, lønn; og årsoppgjør", 1},
+		dept{3, "Tøyen", 1},
+	)
+
+	for _, p := range []person{
+		{
+			Name:       "Åse Kjærstad Ødegård",
+			Role:       "Seniorrådgiver for økonomi- og virksomhetsstyring i Deichmanske bibliotek",
+			Department: 2,
+			Email:      "ase.odegard@example.com",
+			Phone:      "+47 23 43 29 00",
+			Img:        "ase.jpg",
+		},
+		{
+			Name:       "Bjørn Æsop",
+			Department: 3,
+			Email:      "bjorn@example.com",
+			Img:        "dummy.png",
+		},
+	} {
+		app.persons.Create(p)
+	}
+	return app
+}
+
+func TestVCardGolden(t *testing.T) {
+	app := setupVCardTest(t)
+	testServer := httptest.NewServer(app.apiMux)
+	defer testServer.Close()
+
+	var tests = []struct {
+		url    string
+		golden string
+	}{
+		{"/person/1.vcf", "person.vcf"},
+		{"/person/2.vcf", "person-nophoto.vcf"},
+		{"/department/2.vcf", "department.vcf"},
+		{"/department/1.vcf", "department-parent.vcf"},
+	}
+
+	for _, tt := range tests {
+		resp, err := http.Get(testServer.URL + tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET %s: got status %d", tt.url, resp.StatusCode)
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != "text/vcard; charset=utf-8" {
+			t.Errorf("GET %s: got Content-Type %q", tt.url, ct)
+		}
+		// The photo URL depends on the test server's address.
+		body = bytes.Replace(body, []byte(strings.TrimPrefix(testServer.URL, "http://")), []byte("folk.test"), -1)
+		golden(t, tt.golden, body)
+	}
+}
+
+func TestVCardRoundTrip(t *testing.T) {
+	app := setupVCardTest(t)
+	s := specs.New(t)
+
+	p, err := app.persons.Get(1)
+	s.ExpectNilFatal(err)
+	// make sure folding happens in the middle of multi-byte characters
+	p.Role += " " + strings.Repeat("Ærø ", 20)
+
+	var buf bytes.Buffer
+	s.ExpectNilFatal(app.writeVCard(&buf, 1, p, ""))
+	for _, l := range strings.Split(buf.String(), "\r\n") {
+		if len(l) > vCardLineLen {
+			t.Errorf("line longer than %d octets: %q", vCardLineLen, l)
+		}
+		if !utf8.ValidString(l) {
+			t.Errorf("line is not valid UTF-8: %q", l)
+		}
+	}
+
+	vals := vCardValues(buf.String())
+	s.Expect(p.Name, vals["FN"])
+	s.Expect(p.Role, vals["TITLE"])
+	s.Expect(p.Email, vals["EMAIL"])
+	s.Expect(p.Phone, vals["TEL"])
+	s.Expect("Deichmanske bibliotek;Økonomi, lønn; og årsoppgjør", vals["ORG"])
+}
+
+func TestVCardNotFound(t *testing.T) {
+	app := setupVCardTest(t)
+	s := specs.New(t)
+	testServer := httptest.NewServer(app.apiMux)
+	defer testServer.Close()
+
+	var tests = []struct {
+		url      string
+		respCode int
+	}{
+		{"/person/99.vcf", 404},
+		{"/person/x.vcf", 400},
+		{"/department/99.vcf", 404},
+		{"/department/2", 404},
+	}
+
+	for _, tt := range tests {
+		resp, err := http.Get(testServer.URL + tt.url)
+		s.ExpectNilFatal(err)
+		s.Expect(tt.respCode, resp.StatusCode)
+		resp.Body.Close()
+	}
+}
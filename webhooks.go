@@ -0,0 +1,561 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The events webhooks can be registered for.
+const (
+	eventPersonCreated = "person.created"
+	eventPersonUpdated = "person.updated" // including moves to another department
+	eventPersonDeleted = "person.deleted"
+)
+
+var webhookEvents = []string{eventPersonCreated, eventPersonUpdated, eventPersonDeleted}
+
+// The states of a delivery.
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryFailed    = "failed" // given up after WebhookMaxAttempts
+)
+
+// webhook is a URL which is sent the events it is registered for, as JSON
+// POSTs signed with its secret.
+type webhook struct {
+	ID      int `json:"-"`
+	URL     string
+	Events  []string
+	Secret  string
+	Created time.Time
+}
+
+func (h *webhook) setID(id int) { h.ID = id }
+
+// wants reports whether the webhook is registered for event.
+func (h webhook) wants(event string) bool {
+	for _, e := range h.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// delivery is the sending of an event to a webhook, as kept in the delivery
+// log.
+type delivery struct {
+	ID          int `json:"-"`
+	Webhook     int
+	Event       string
+	Payload     string
+	Status      string
+	Attempts    int
+	Created     time.Time
+	LastAttempt *time.Time `json:",omitempty"`
+	NextAttempt *time.Time `json:",omitempty"`
+	// LastCode and LastError are the response status code and error of the
+	// last attempt.
+	LastCode  int    `json:",omitempty"`
+	LastError string `json:",omitempty"`
+}
+
+func (d *delivery) setID(id int) { d.ID = id }
+
+// webhookEvent is the payload of a delivery.
+type webhookEvent struct {
+	// ID identifies the change, and is the same for each webhook notified
+	// of it.
+	ID string
+	changeEvent
+}
+
+func newWebhookStore(db Store) *TypedStore[webhook] {
+	return NewTypedStore[webhook](db)
+}
+
+// newDeliveryStore returns a store of deliveries backed by db, indexed by
+// status and webhook.
+func newDeliveryStore(db Store) *TypedStore[delivery] {
+	s := NewTypedStore[delivery](db)
+	s.AddIndex("status", false, func(d delivery) string { return d.Status })
+	s.AddIndex("webhook", false, func(d delivery) string { return strconv.Itoa(d.Webhook) })
+	return s
+}
+
+// webhookWorkers is the number of webhooks delivered to at once.
+const webhookWorkers = 8
+
+// webhookSignatureTolerance is how far the time of a signature may be from
+// the clock of the receiver, which should reject older signatures as replays.
+const webhookSignatureTolerance = 5 * time.Minute
+
+// webhookDispatcher sends the pending deliveries. Each webhook is sent its
+// deliveries in order by a worker of its own, so that a slow webhook doesn't
+// hold up the others. A delivery waiting to be retried holds back the later
+// ones to its webhook.
+type webhookDispatcher struct {
+	client  *http.Client
+	now     func() time.Time
+	wake    chan struct{}
+	workers chan struct{} // a slot for each running worker
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+	busy    map[int]bool // the webhooks which have a worker, guarded by mu
+}
+
+func newWebhookDispatcher(cfg Config) *webhookDispatcher {
+	return &webhookDispatcher{
+		client:  &http.Client{Timeout: time.Duration(cfg.WebhookTimeout) * time.Second},
+		now:     time.Now,
+		wake:    make(chan struct{}, 1),
+		workers: make(chan struct{}, webhookWorkers),
+		busy:    make(map[int]bool),
+	}
+}
+
+// wait waits for the running workers to finish.
+func (d *webhookDispatcher) wait() {
+	d.wg.Wait()
+}
+
+// signWebhook returns the signature of a payload sent at t, as sent in the
+// X-Folk-Signature header: "t=" and the Unix time, then ",sha256=" and the
+// hex HMAC-SHA256 of the Unix time, "." and the payload, with the secret of
+// the webhook. Receivers should check that t is within
+// webhookSignatureTolerance of their clock, as each attempt is signed anew.
+func signWebhook(secret string, t time.Time, payload string) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	io.WriteString(mac, ts+"."+payload)
+	return "t=" + ts + ",sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// notifyWebhooks adds a delivery of each event to the webhooks registered for
+// it, and wakes the dispatcher.
+func (app *App) notifyWebhooks(evs []changeEvent) {
+	var hooks []webhook
+	app.webhooks.Iterate(func(id int, h webhook) error {
+		hooks = append(hooks, h)
+		return nil
+	})
+	if len(hooks) == 0 || len(evs) == 0 {
+		return
+	}
+	now := app.dispatcher.now().UTC()
+	n := 0
+	err := app.deliveries.Update(func(tx *TypedTx[delivery]) error {
+		for _, ev := range evs {
+			payload, err := json.Marshal(webhookEvent{newToken()[:32], ev})
+			if err != nil {
+				return err
+			}
+			for _, h := range hooks {
+				if !h.wants(ev.Event) {
+					continue
+				}
+				_, err := tx.Create(delivery{Webhook: h.ID, Event: ev.Event, Payload: string(payload),
+					Status: deliveryPending, Created: now, NextAttempt: &now})
+				if err != nil {
+					return err
+				}
+				n++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to add webhook deliveries: %v", err)
+		return
+	}
+	if n > 0 {
+		app.deliverySaver.Inc()
+		app.wakeDispatcher()
+	}
+}
+
+func (app *App) wakeDispatcher() {
+	select {
+	case app.dispatcher.wake <- struct{}{}:
+	default:
+	}
+}
+
+// retryDelay returns the time to wait before retrying a delivery which has
+// failed attempts times: WebhookRetrySeconds, doubling with each further
+// failure, up to a day.
+func (app *App) retryDelay(attempts int) time.Duration {
+	d := time.Duration(app.cfg.WebhookRetrySeconds) * time.Second
+	for i := 1; i < attempts && d < 24*time.Hour; i++ {
+		d *= 2
+	}
+	if d > 24*time.Hour {
+		d = 24 * time.Hour
+	}
+	return d
+}
+
+// deliver makes an attempt at sending d, and records the outcome in the
+// delivery log.
+func (app *App) deliver(d delivery) {
+	code, postErr := 0, error(nil)
+	h, hookErr := app.webhooks.Get(d.Webhook)
+	if hookErr == nil {
+		code, postErr = app.post(h, d)
+	}
+	now := app.dispatcher.now().UTC()
+	err := app.deliveries.Update(func(tx *TypedTx[delivery]) error {
+		cur, err := tx.Get(d.ID)
+		if err != nil {
+			return err
+		}
+		cur.Attempts++
+		cur.LastAttempt = &now
+		cur.LastCode = code
+		cur.LastError = ""
+		cur.NextAttempt = nil
+		switch {
+		case hookErr != nil:
+			cur.Status = deliveryFailed
+			cur.LastError = "webhook deleted"
+		case postErr == nil:
+			cur.Status = deliveryDelivered
+		case cur.Attempts >= app.cfg.WebhookMaxAttempts:
+			cur.Status = deliveryFailed
+			cur.LastError = postErr.Error()
+		default:
+			cur.LastError = postErr.Error()
+			next := now.Add(app.retryDelay(cur.Attempts))
+			cur.NextAttempt = &next
+		}
+		return tx.Put(cur.ID, cur)
+	})
+	if err != nil {
+		log.Printf("Failed to record webhook delivery %d: %v", d.ID, err)
+		return
+	}
+	app.deliverySaver.Inc()
+}
+
+// post sends the payload of d to the webhook h, and returns the response
+// status code, and an error unless it is 2xx.
+func (app *App) post(h webhook, d delivery) (int, error) {
+	req, err := http.NewRequest("POST", h.URL, strings.NewReader(d.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "folk-webhooks")
+	req.Header.Set("X-Folk-Event", d.Event)
+	req.Header.Set("X-Folk-Delivery", strconv.Itoa(d.ID))
+	req.Header.Set("X-Folk-Signature", signWebhook(h.Secret, app.dispatcher.now(), d.Payload))
+	resp, err := app.dispatcher.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("response status %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// due reports whether d is pending, and due to be attempted at now.
+func (d delivery) due(now time.Time) bool {
+	return d.Status == deliveryPending && (d.NextAttempt == nil || !d.NextAttempt.After(now))
+}
+
+// deliverDue starts a worker for each webhook whose oldest pending delivery
+// is due, unless it has one already. Use dispatcher.wait to wait for them.
+func (app *App) deliverDue() {
+	app.dispatcher.mu.Lock()
+	defer app.dispatcher.mu.Unlock()
+	ids := app.deliveries.Lookup("status", deliveryPending)
+	sort.Ints(ids)
+	now := app.dispatcher.now()
+	seen := make(map[int]bool)
+	for _, id := range ids {
+		d, err := app.deliveries.Get(id)
+		if err != nil || seen[d.Webhook] {
+			continue
+		}
+		seen[d.Webhook] = true
+		if !d.due(now) || app.dispatcher.busy[d.Webhook] {
+			continue
+		}
+		app.dispatcher.busy[d.Webhook] = true
+		app.dispatcher.wg.Add(1)
+		go app.deliverWebhook(d)
+	}
+}
+
+// deliverWebhook attempts d, then the next pending deliveries to its webhook,
+// oldest first, as long as they are due.
+func (app *App) deliverWebhook(d delivery) {
+	defer app.dispatcher.wg.Done()
+	app.dispatcher.workers <- struct{}{}
+	defer func() { <-app.dispatcher.workers }()
+	for {
+		app.deliver(d)
+		var ok bool
+		if d, ok = app.nextDue(d.Webhook); !ok {
+			return
+		}
+	}
+}
+
+// nextDue returns the oldest pending delivery to webhook, if it is due. If
+// not, the webhook's worker is done, so that deliverDue starts another once it
+// is, or for deliveries added later.
+func (app *App) nextDue(webhook int) (delivery, bool) {
+	app.dispatcher.mu.Lock()
+	defer app.dispatcher.mu.Unlock()
+	ids := app.deliveries.Lookup("webhook", strconv.Itoa(webhook))
+	sort.Ints(ids)
+	for _, id := range ids {
+		d, err := app.deliveries.Get(id)
+		if err != nil || d.Status != deliveryPending {
+			continue
+		}
+		if d.due(app.dispatcher.now()) {
+			return d, true
+		}
+		break
+	}
+	delete(app.dispatcher.busy, webhook)
+	return delivery{}, false
+}
+
+// pruneDeliveries removes the delivered and failed deliveries older than
+// WebhookLogDays from the delivery log.
+func (app *App) pruneDeliveries() {
+	if app.cfg.WebhookLogDays == 0 {
+		return
+	}
+	cutoff := app.dispatcher.now().AddDate(0, 0, -app.cfg.WebhookLogDays)
+	var old []int
+	app.deliveries.Iterate(func(id int, d delivery) error {
+		if d.Status != deliveryPending && d.Created.Before(cutoff) {
+			old = append(old, id)
+		}
+		return nil
+	})
+	for _, id := range old {
+		app.deliveries.Delete(id)
+	}
+	if len(old) > 0 {
+		app.deliverySaver.Inc()
+	}
+}
+
+// startWebhooks sends the pending deliveries as they are added or become due,
+// and prunes the delivery log hourly. The returned function stops it, and
+// waits for the running deliveries to finish.
+func (app *App) startWebhooks() (stop func()) {
+	ticker := time.NewTicker(time.Second)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		var lastPrune time.Time
+		for {
+			if time.Since(lastPrune) > time.Hour {
+				app.pruneDeliveries()
+				lastPrune = time.Now()
+			}
+			app.deliverDue()
+			select {
+			case <-done:
+				return
+			case <-app.dispatcher.wake:
+			case <-ticker.C:
+			}
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		close(done)
+		wg.Wait()
+		app.dispatcher.wait()
+	}
+}
+
+// API:
+
+type WebhookRequest struct {
+	URL string
+	// Events are the events to send, or all if empty.
+	Events []string
+	// Secret signs the payloads. One is generated if empty.
+	Secret string
+}
+
+type WebhookResponse struct {
+	ID      int
+	URL     string
+	Events  []string
+	Created time.Time
+	// Secret is only returned when the webhook is created.
+	Secret string `json:",omitempty"`
+}
+
+func webhookResponse(h webhook) *WebhookResponse {
+	return &WebhookResponse{ID: h.ID, URL: h.URL, Events: h.Events, Created: h.Created}
+}
+
+type WebhooksResponse struct {
+	Webhooks []*WebhookResponse
+}
+
+type DeliveryResponse struct {
+	ID int
+	delivery
+}
+
+type DeliveriesResponse struct {
+	Deliveries []DeliveryResponse
+}
+
+// saveWebhooks saves webhooks.db right away, as webhooks are rarely changed.
+func (app *App) saveWebhooks(h http.Header) {
+	app.webhookSaver.Inc()
+	if err := app.webhookSaver.Flush(); err != nil {
+		app.logError(h, "failed to save webhooks: %v", err)
+	}
+}
+
+// GET /webhooks
+func (app *App) listWebhooks(u *url.URL, h http.Header, _ interface{}) (int, http.Header, *WebhooksResponse, error) {
+	res := &WebhooksResponse{Webhooks: []*WebhookResponse{}}
+	app.webhooks.Iterate(func(id int, hook webhook) error {
+		res.Webhooks = append(res.Webhooks, webhookResponse(hook))
+		return nil
+	})
+	sort.Slice(res.Webhooks, func(i, j int) bool { return res.Webhooks[i].ID < res.Webhooks[j].ID })
+	return http.StatusOK, nil, res, nil
+}
+
+// POST /webhooks
+func (app *App) createWebhook(u *url.URL, h http.Header, rq *WebhookRequest) (int, http.Header, *WebhookResponse, error) {
+	hu, err := url.Parse(rq.URL)
+	if err != nil || (hu.Scheme != "http" && hu.Scheme != "https") || hu.Host == "" {
+		return http.StatusBadRequest, nil, nil, errors.New("url must be an http(s) URL")
+	}
+	events := rq.Events
+	if len(events) == 0 {
+		events = webhookEvents
+	}
+	for _, e := range events {
+		if !(webhook{Events: webhookEvents}).wants(e) {
+			return http.StatusBadRequest, nil, nil, fmt.Errorf("events must be %s", strings.Join(webhookEvents, ", "))
+		}
+	}
+	secret := rq.Secret
+	if secret == "" {
+		secret = "whsec_" + newToken()
+	}
+	hook := webhook{URL: rq.URL, Events: events, Secret: secret, Created: time.Now().UTC()}
+	id, err := app.webhooks.Create(hook)
+	if err != nil {
+		app.logError(h, "POST /webhooks: %v", err)
+		return http.StatusInternalServerError, nil, nil, errors.New("failed to save webhook to database")
+	}
+	hook.ID = id
+	app.saveWebhooks(h)
+
+	res := webhookResponse(hook)
+	res.Secret = secret
+	return http.StatusCreated, nil, res, nil
+}
+
+// DELETE /webhooks/{id}
+//
+// Its pending deliveries fail, and its delivery log is kept.
+func (app *App) deleteWebhook(u *url.URL, h http.Header, _ interface{}) (int, http.Header, *WebhookResponse, error) {
+	id, err := strconv.Atoi(u.Query().Get("id"))
+	if err != nil {
+		return http.StatusBadRequest, nil, nil, errors.New("webhook ID must be an integer")
+	}
+	hook, err := app.webhooks.Get(id)
+	if err == ErrNotFound {
+		return http.StatusNotFound, nil, nil, errors.New("webhook not found")
+	}
+	if err != nil {
+		app.logError(h, "DELETE /webhooks/%d: %v", id, err)
+		return http.StatusInternalServerError, nil, nil, errors.New("failed to store in database")
+	}
+	app.webhooks.Delete(id)
+	app.saveWebhooks(h)
+	return http.StatusOK, nil, webhookResponse(hook), nil
+}
+
+// GET /webhooks/{id}/deliveries
+//
+// The delivery log of a webhook, newest first.
+func (app *App) listDeliveries(u *url.URL, h http.Header, _ interface{}) (int, http.Header, *DeliveriesResponse, error) {
+	id, err := strconv.Atoi(u.Query().Get("id"))
+	if err != nil {
+		return http.StatusBadRequest, nil, nil, errors.New("webhook ID must be an integer")
+	}
+	ids := app.deliveries.Lookup("webhook", strconv.Itoa(id))
+	if _, err := app.webhooks.Get(id); err == ErrNotFound && len(ids) == 0 {
+		return http.StatusNotFound, nil, nil, errors.New("webhook not found")
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(ids)))
+	res := &DeliveriesResponse{Deliveries: []DeliveryResponse{}}
+	for _, did := range ids {
+		if d, err := app.deliveries.Get(did); err == nil {
+			res.Deliveries = append(res.Deliveries, DeliveryResponse{did, d})
+		}
+	}
+	return http.StatusOK, nil, res, nil
+}
+
+// POST /deliveries/{id}/redeliver
+//
+// Sends the payload of a delivery again, as a new delivery.
+func (app *App) redeliver(u *url.URL, h http.Header, _ interface{}) (int, http.Header, *DeliveryResponse, error) {
+	id, err := strconv.Atoi(u.Query().Get("id"))
+	if err != nil {
+		return http.StatusBadRequest, nil, nil, errors.New("delivery ID must be an integer")
+	}
+	d, err := app.deliveries.Get(id)
+	if err == ErrNotFound {
+		return http.StatusNotFound, nil, nil, errors.New("delivery not found")
+	}
+	if err != nil {
+		app.logError(h, "POST /deliveries/%d/redeliver: %v", id, err)
+		return http.StatusInternalServerError, nil, nil, errors.New("failed to read database")
+	}
+	if _, err := app.webhooks.Get(d.Webhook); err == ErrNotFound {
+		return http.StatusConflict, nil, nil, errors.New("the webhook has been deleted")
+	}
+	now := app.dispatcher.now().UTC()
+	d = delivery{Webhook: d.Webhook, Event: d.Event, Payload: d.Payload,
+		Status: deliveryPending, Created: now, NextAttempt: &now}
+	newID, err := app.deliveries.Create(d)
+	if err != nil {
+		app.logError(h, "POST /deliveries/%d/redeliver: %v", id, err)
+		return http.StatusInternalServerError, nil, nil, errors.New("failed to store in database")
+	}
+	app.deliverySaver.Inc()
+	app.wakeDispatcher()
+	return http.StatusAccepted, nil, &DeliveryResponse{newID, d}, nil
+}
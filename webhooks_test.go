@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/knakk/specs"
+)
+
+// webhookReceiver records the requests it gets, and responds with the status
+// codes in codes, then 200.
+type webhookReceiver struct {
+	*httptest.Server
+	sync.Mutex
+	codes    []int
+	requests []*http.Request
+	bodies   []string
+}
+
+func newWebhookReceiver(t *testing.T) *webhookReceiver {
+	rc := &webhookReceiver{}
+	rc.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		rc.Lock()
+		defer rc.Unlock()
+		rc.requests = append(rc.requests, r)
+		rc.bodies = append(rc.bodies, string(b))
+		if len(rc.codes) > 0 {
+			w.WriteHeader(rc.codes[0])
+			rc.codes = rc.codes[1:]
+		}
+	}))
+	t.Cleanup(rc.Close)
+	return rc
+}
+
+func (rc *webhookReceiver) received() int {
+	rc.Lock()
+	defer rc.Unlock()
+	return len(rc.bodies)
+}
+
+func TestWebhooks(t *testing.T) {
+	s := specs.New(t)
+	dir := t.TempDir()
+	writeTestData(t, dir, dept{1, "IT", 0}, dept{2, "HR", 0})
+	cfg := defaultConfig()
+	cfg.DataDir = dir
+	app, err := NewApp(cfg)
+	s.ExpectNilFatal(err)
+	app.logOut = testLogWriter{t}
+	clock := newFakeClock()
+	app.dispatcher.now = clock.now
+	_, err = app.tokens.Create(apiToken{Name: "root", Scope: scopeAdmin, Hash: hashToken("rootsecret"), Created: time.Now()})
+	s.ExpectNilFatal(err)
+
+	do := func(method, target, token, body string) (int, string) {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Accept", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, req)
+		return w.Code, w.Body.String()
+	}
+	deliverDue := func() {
+		app.deliverDue()
+		app.dispatcher.wait()
+	}
+	deliveries := func(hook string) []DeliveryResponse {
+		code, body := do("GET", "/api/webhooks/"+hook+"/deliveries", "rootsecret", "")
+		s.Expect(http.StatusOK, code)
+		var res DeliveriesResponse
+		s.ExpectNilFatal(json.Unmarshal([]byte(body), &res))
+		return res.Deliveries
+	}
+
+	all := newWebhookReceiver(t)
+	gone := newWebhookReceiver(t)
+	var tests = []struct {
+		method, target, token, body string
+		wantCode                    int
+	}{
+		{"GET", "/api/webhooks", "", "", http.StatusUnauthorized},
+		{"POST", "/api/webhooks", "", `{"URL":"` + all.URL + `"}`, http.StatusUnauthorized},
+		{"POST", "/api/webhooks", "rootsecret", `{"URL":"ftp://example.com"}`, http.StatusBadRequest},
+		{"POST", "/api/webhooks", "rootsecret", `{"URL":"` + all.URL + `","Events":["person.moved"]}`, http.StatusBadRequest},
+		{"POST", "/api/webhooks", "rootsecret", `{"URL":"` + all.URL + `","Secret":"hemmelig"}`, http.StatusCreated},
+		{"POST", "/api/webhooks", "rootsecret", `{"URL":"` + gone.URL + `","Events":["person.deleted"]}`, http.StatusCreated},
+		{"GET", "/api/webhooks/9/deliveries", "rootsecret", "", http.StatusNotFound},
+		{"POST", "/api/deliveries/9/redeliver", "rootsecret", "", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if code, body := do(tt.method, tt.target, tt.token, tt.body); code != tt.wantCode {
+			t.Errorf("%s %s => %d %s; want %d", tt.method, tt.target, code, body, tt.wantCode)
+		}
+	}
+	code, body := do("GET", "/api/webhooks", "rootsecret", "")
+	s.Expect(http.StatusOK, code)
+	var hooks WebhooksResponse
+	s.ExpectNilFatal(json.Unmarshal([]byte(body), &hooks))
+	s.Expect(2, len(hooks.Webhooks))
+	s.Expect(webhookEvents, hooks.Webhooks[0].Events)
+	s.Expect("", hooks.Webhooks[0].Secret)
+
+	// changes are delivered as signed events
+	code, _ = do("POST", "/api/person", "rootsecret", `{"Name":"Kari","Email":"kari@example.com","Department":1}`)
+	s.Expect(http.StatusCreated, code)
+	code, _ = do("PATCH", "/api/person/1?full=yes", "rootsecret", `{"Name":"Kari","Email":"kari@example.com","Department":2}`)
+	s.Expect(http.StatusOK, code)
+	deliverDue()
+	s.Expect(2, all.received())
+	s.Expect(0, gone.received())
+	r := all.requests[1]
+	s.Expect("person.updated", r.Header.Get("X-Folk-Event"))
+	s.Expect(signWebhook("hemmelig", clock.now(), all.bodies[1]), r.Header.Get("X-Folk-Signature"))
+	var ev webhookEvent
+	s.ExpectNilFatal(json.Unmarshal([]byte(all.bodies[1]), &ev))
+	s.Expect("person.updated", ev.Event)
+	s.Expect(1, ev.PersonID)
+	s.Expect(1, ev.Previous.Department)
+	s.Expect(2, ev.Person.Department)
+	ds := deliveries("1")
+	s.Expect(2, len(ds))
+	s.Expect(deliveryDelivered, ds[0].Status)
+	s.Expect(http.StatusOK, ds[0].LastCode)
+
+	// failed deliveries are retried with exponential backoff, until they
+	// succeed or the attempts run out
+	all.codes = []int{500, 503}
+	gone.codes = []int{500, 500, 500, 500, 500, 500, 500, 500}
+	code, _ = do("DELETE", "/api/person/1", "rootsecret", "")
+	s.Expect(http.StatusOK, code)
+	for _, wait := range []time.Duration{0, 29 * time.Second, time.Second, 59 * time.Second, time.Second} {
+		clock.add(wait)
+		deliverDue()
+	}
+	s.Expect(5, all.received())
+	d := deliveries("1")[0]
+	s.Expect(deliveryDelivered, d.Status)
+	s.Expect(3, d.Attempts)
+	s.Expect(3, gone.received())
+	d = deliveries("2")[0]
+	s.Expect(deliveryPending, d.Status)
+	s.Expect("response status 500 Internal Server Error", d.LastError)
+	s.Expect(clock.now().Add(2*time.Minute).UTC(), *d.NextAttempt)
+	for i := 0; i < 8; i++ {
+		clock.add(time.Hour)
+		deliverDue()
+	}
+	s.Expect(8, gone.received())
+	d = deliveries("2")[0]
+	s.Expect(deliveryFailed, d.Status)
+	s.Expect(8, d.Attempts)
+
+	// a delivery can be sent again by hand
+	code, body = do("POST", "/api/deliveries/"+strconv.Itoa(d.ID)+"/redeliver", "rootsecret", "")
+	s.Expect(http.StatusAccepted, code)
+	deliverDue()
+	s.Expect(9, gone.received())
+	s.Expect(gone.bodies[0], gone.bodies[8])
+	ds = deliveries("2")
+	s.Expect(2, len(ds))
+	s.Expect(deliveryDelivered, ds[0].Status)
+
+	// the delivery log is kept across restarts, and pruned after
+	// WebhookLogDays
+	s.ExpectNil(app.Close())
+	app, err = NewApp(cfg)
+	s.ExpectNilFatal(err)
+	app.logOut = testLogWriter{t}
+	_, err = app.tokens.Create(apiToken{Name: "root2", Scope: scopeAdmin, Hash: hashToken("rootsecret2"), Created: time.Now()})
+	s.ExpectNilFatal(err)
+	s.Expect(5, app.deliveries.Size())
+	app.dispatcher.now = func() time.Time { return time.Now().AddDate(0, 0, cfg.WebhookLogDays+1) }
+	app.pruneDeliveries()
+	s.Expect(0, app.deliveries.Size())
+
+	code, _ = do("DELETE", "/api/webhooks/2", "rootsecret2", "")
+	s.Expect(http.StatusOK, code)
+	code, _ = do("GET", "/api/webhooks/2/deliveries", "rootsecret2", "")
+	s.Expect(http.StatusNotFound, code)
+}
+
+func TestSignWebhook(t *testing.T) {
+	s := specs.New(t)
+	at := time.Unix(1700000000, 0)
+	sig := signWebhook("hemmelig", at, `{"ID":"x"}`)
+	s.ExpectMatches(sig, `^t=1700000000,sha256=[0-9a-f]{64}$`)
+	// the time is signed with the payload, so that it can't be replaced
+	s.ExpectNot(sig[len("t=1700000000,"):], signWebhook("hemmelig", at.Add(time.Second), `{"ID":"x"}`)[len("t=1700000001,"):])
+	s.ExpectNot(sig, signWebhook("hemmelig", at, `{"ID":"y"}`))
+	s.ExpectNot(sig, signWebhook("annen", at, `{"ID":"x"}`))
+}
+
+func TestWebhookWorkers(t *testing.T) {
+	s := specs.New(t)
+	app := newTestApp(t, dept{1, "IT", 0})
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	fast := newWebhookReceiver(t)
+	for _, u := range []string{slow.URL, fast.URL} {
+		_, err := app.webhooks.Create(webhook{URL: u, Events: webhookEvents, Secret: "hemmelig"})
+		s.ExpectNilFatal(err)
+	}
+
+	// a webhook which is slow to respond doesn't hold up the others, nor
+	// does it get another worker while it has one
+	for i := 1; i <= 2; i++ {
+		_, err := app.addPerson(person{Name: "Kari", Department: 1, Email: strconv.Itoa(i) + "@example.com"})
+		s.ExpectNilFatal(err)
+		app.deliverDue()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for fast.received() < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.Expect(2, fast.received())
+	app.dispatcher.mu.Lock()
+	s.Expect(map[int]bool{1: true}, app.dispatcher.busy)
+	app.dispatcher.mu.Unlock()
+
+	// once it responds, it is sent its deliveries in order
+	close(release)
+	app.dispatcher.wait()
+	ids := app.deliveries.Lookup("webhook", "1")
+	sort.Ints(ids)
+	s.Expect(2, len(ids))
+	for _, id := range ids {
+		d, err := app.deliveries.Get(id)
+		s.ExpectNilFatal(err)
+		s.Expect(deliveryDelivered, d.Status)
+		s.Expect(1, d.Attempts)
+	}
+	s.Expect(0, len(app.dispatcher.busy))
+}
+
+func TestWebhookOrder(t *testing.T) {
+	s := specs.New(t)
+	app := newTestApp(t, dept{1, "IT", 0})
+	clock := newFakeClock()
+	app.dispatcher.now = clock.now
+	rc := newWebhookReceiver(t)
+	rc.codes = []int{500}
+	_, err := app.webhooks.Create(webhook{URL: rc.URL, Events: webhookEvents, Secret: "hemmelig"})
+	s.ExpectNilFatal(err)
+	deliverDue := func() {
+		app.deliverDue()
+		app.dispatcher.wait()
+	}
+
+	// a delivery waiting to be retried holds back the later ones
+	for i := 1; i <= 2; i++ {
+		_, err := app.addPerson(person{Name: "Kari", Department: 1, Email: strconv.Itoa(i) + "@example.com"})
+		s.ExpectNilFatal(err)
+		deliverDue()
+	}
+	s.Expect(1, rc.received())
+	s.Expect(0, len(app.dispatcher.busy))
+
+	clock.add(time.Duration(app.cfg.WebhookRetrySeconds) * time.Second)
+	deliverDue()
+	s.Expect(3, rc.received())
+	var got []string
+	for _, r := range rc.requests {
+		got = append(got, r.Header.Get("X-Folk-Delivery"))
+	}
+	s.Expect([]string{"1", "1", "2"}, got)
+}
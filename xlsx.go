@@ -0,0 +1,201 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// xlsxContentType is the media type of XLSX files.
+const xlsxContentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+
+// The parts of an XLSX file read by newXLSXRows.
+type (
+	xlsxWorkbook struct {
+		Sheets []struct {
+			RID string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+		} `xml:"sheets>sheet"`
+	}
+	xlsxRels struct {
+		Rels []struct {
+			ID     string `xml:"Id,attr"`
+			Target string `xml:"Target,attr"`
+		} `xml:"Relationship"`
+	}
+	// xlsxText is a string, which is either plain, or made of runs of rich
+	// text.
+	xlsxText struct {
+		T    string   `xml:"t"`
+		Runs []string `xml:"r>t"`
+	}
+	xlsxSharedStrings struct {
+		Items []xlsxText `xml:"si"`
+	}
+	xlsxSheet struct {
+		Rows []struct {
+			R     int `xml:"r,attr"`
+			Cells []struct {
+				R      string   `xml:"r,attr"`
+				T      string   `xml:"t,attr"`
+				V      string   `xml:"v"`
+				Inline xlsxText `xml:"is"`
+			} `xml:"c"`
+		} `xml:"sheetData>row"`
+	}
+)
+
+func (t xlsxText) String() string {
+	return t.T + strings.Join(t.Runs, "")
+}
+
+// xlsxRows reads the rows of the first sheet of an XLSX file, as importRows.
+// Empty rows, and empty cells at the end of rows, are left out, and rows are
+// padded with empty cells to the width of the first.
+type xlsxRows struct {
+	rows  [][]string
+	lines []int
+}
+
+func (r *xlsxRows) Read() ([]string, int, error) {
+	if len(r.rows) == 0 {
+		return nil, 0, io.EOF
+	}
+	record, line := r.rows[0], r.lines[0]
+	r.rows, r.lines = r.rows[1:], r.lines[1:]
+	return record, line, nil
+}
+
+// newXLSXRows reads the XLSX file r, which is read into memory.
+func newXLSXRows(r io.Reader) (*xlsxRows, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		return nil, fmt.Errorf("not an XLSX file: %v", err)
+	}
+	files := make(map[string]*zip.File)
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+	decode := func(name string, v interface{}) error {
+		f, ok := files[name]
+		if !ok {
+			return fmt.Errorf("not an XLSX file: %s is missing", name)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		if err := xml.NewDecoder(rc).Decode(v); err != nil {
+			return fmt.Errorf("failed to read %s of XLSX file: %v", name, err)
+		}
+		return nil
+	}
+
+	var wb xlsxWorkbook
+	if err := decode("xl/workbook.xml", &wb); err != nil {
+		return nil, err
+	}
+	if len(wb.Sheets) == 0 {
+		return nil, errors.New("XLSX file has no sheets")
+	}
+	var rels xlsxRels
+	if err := decode("xl/_rels/workbook.xml.rels", &rels); err != nil {
+		return nil, err
+	}
+	sheetName := ""
+	for _, rel := range rels.Rels {
+		if rel.ID == wb.Sheets[0].RID {
+			// targets are relative to xl/, unless absolute
+			sheetName = path.Join("xl", rel.Target)
+			if strings.HasPrefix(rel.Target, "/") {
+				sheetName = rel.Target[1:]
+			}
+		}
+	}
+	var sst xlsxSharedStrings
+	if _, ok := files["xl/sharedStrings.xml"]; ok {
+		if err := decode("xl/sharedStrings.xml", &sst); err != nil {
+			return nil, err
+		}
+	}
+	var sheet xlsxSheet
+	if err := decode(sheetName, &sheet); err != nil {
+		return nil, err
+	}
+
+	res := &xlsxRows{}
+	width := 0
+	for i, row := range sheet.Rows {
+		var record []string
+		for _, c := range row.Cells {
+			col := len(record)
+			if c.R != "" {
+				if col, err = xlsxColumn(c.R); err != nil {
+					return nil, err
+				}
+			}
+			v := c.V
+			switch c.T {
+			case "s":
+				n, err := strconv.Atoi(c.V)
+				if err != nil || n < 0 || n >= len(sst.Items) {
+					return nil, fmt.Errorf("invalid shared string in XLSX cell %s", c.R)
+				}
+				v = sst.Items[n].String()
+			case "inlineStr":
+				v = c.Inline.String()
+			}
+			for len(record) <= col {
+				record = append(record, "")
+			}
+			record[col] = v
+		}
+		for len(record) > 0 && strings.TrimSpace(record[len(record)-1]) == "" {
+			record = record[:len(record)-1]
+		}
+		if len(record) == 0 {
+			continue
+		}
+		if width == 0 {
+			width = len(record)
+		}
+		for len(record) < width {
+			record = append(record, "")
+		}
+		line := row.R
+		if line == 0 {
+			line = i + 1
+		}
+		res.rows = append(res.rows, record)
+		res.lines = append(res.lines, line)
+	}
+	return res, nil
+}
+
+// xlsxColumn returns the index of the column of a cell reference, like 1 for
+// "B7".
+func xlsxColumn(ref string) (int, error) {
+	letters := strings.TrimRight(ref, "0123456789")
+	if letters == "" || len(letters) > 3 || len(letters) == len(ref) {
+		return 0, fmt.Errorf("invalid XLSX cell reference %q", ref)
+	}
+	col := 0
+	for _, c := range letters {
+		if c < 'A' || c > 'Z' {
+			return 0, fmt.Errorf("invalid XLSX cell reference %q", ref)
+		}
+		col = col*26 + int(c-'A') + 1
+	}
+	return col - 1, nil
+}